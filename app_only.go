@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+const (
+	clientAssertionType     = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+	clientAssertionLifetime = 10 * time.Minute
+
+	appOnlyUserFields = "$select=displayName,userPrincipalName,mail"
+)
+
+// appOnly reports whether feeds are provisioned by the administrator and read
+// with the application permissions of the app, instead of on behalf of every
+// user logging in
+func appOnly() bool {
+	return viper.GetBool("app_only.enabled")
+}
+
+// graphScope asks for every application permission granted to the app on the
+// Graph served from graph_url
+func graphScope() (string, error) {
+	u, err := url.Parse(graphURL())
+	if err != nil {
+		return "", err
+	}
+
+	return u.Scheme + "://" + u.Host + "/.default", nil
+}
+
+// clientAssertion is the certificate the app authenticates with, signing a
+// short lived assertion for every token request
+type clientAssertion struct {
+	key        *rsa.PrivateKey
+	thumbprint string
+}
+
+// loadClientAssertion reads a PEM certificate and its RSA key, which may be
+// in the same file
+func loadClientAssertion(certFile string, keyFile string) (*clientAssertion, error) {
+	if keyFile == "" {
+		keyFile = certFile
+	}
+
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := pair.PrivateKey.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("app_only certificate must have an RSA key")
+	}
+
+	sum := sha1.Sum(pair.Certificate[0])
+
+	return &clientAssertion{
+		key:        key,
+		thumbprint: base64.RawURLEncoding.EncodeToString(sum[:]),
+	}, nil
+}
+
+// sign returns a JWT asserting the identity of the app to the token endpoint
+func (a *clientAssertion) sign(clientID string, audience string) (string, error) {
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+
+	header, err := json.Marshal(map[string]string{
+		"alg": "RS256",
+		"typ": "JWT",
+		"x5t": a.thumbprint,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	claims, err := json.Marshal(map[string]interface{}{
+		"aud": audience,
+		"iss": clientID,
+		"sub": clientID,
+		"jti": hex.EncodeToString(jti),
+		"nbf": now.Unix(),
+		"exp": now.Add(clientAssertionLifetime).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	sum := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, a.key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// assertionTokenSource requests app tokens with a freshly signed assertion
+type assertionTokenSource struct {
+	ctx       context.Context
+	conf      *clientcredentials.Config
+	assertion *clientAssertion
+}
+
+func (s *assertionTokenSource) Token() (*oauth2.Token, error) {
+	assertion, err := s.assertion.sign(s.conf.ClientID, s.conf.TokenURL)
+	if err != nil {
+		return nil, err
+	}
+
+	conf := *s.conf
+	conf.EndpointParams = url.Values{
+		"client_assertion_type": {clientAssertionType},
+		"client_assertion":      {assertion},
+	}
+
+	return conf.Token(s.ctx)
+}
+
+// appTokenSource gets tokens for the app itself through the client credentials
+// flow, authenticating with app_only.certificate when configured and with the
+// client secret otherwise
+func appTokenSource(ctx context.Context) (oauth2.TokenSource, error) {
+	if tenant := viper.GetString("tenant"); tenant == "" || tenant == "common" || tenant == "organizations" {
+		return nil, errors.New("app_only needs the tenant to be configured")
+	}
+
+	scope, err := graphScope()
+	if err != nil {
+		return nil, err
+	}
+
+	conf := &clientcredentials.Config{
+		ClientID:  viper.GetString("client_id"),
+		TokenURL:  oauthEndpoint().TokenURL,
+		Scopes:    []string{scope},
+		AuthStyle: oauth2.AuthStyleInParams,
+	}
+
+	if certFile := viper.GetString("app_only.certificate"); certFile != "" {
+		assertion, err := loadClientAssertion(certFile, viper.GetString("app_only.private_key"))
+		if err != nil {
+			return nil, err
+		}
+
+		return oauth2.ReuseTokenSource(nil, &assertionTokenSource{
+			ctx:       ctx,
+			conf:      conf,
+			assertion: assertion,
+		}), nil
+	}
+
+	conf.ClientSecret = viper.GetString("secret")
+	if conf.ClientSecret == "" {
+		return nil, errors.New("app_only needs either the secret or a certificate")
+	}
+
+	return conf.TokenSource(ctx), nil
+}
+
+// appOnlyUsers returns the users configured on app_only.mailboxes, followed by
+// the members of app_only.group
+func appOnlyUsers(graph GraphClient) ([]*User, error) {
+	var users []*User
+
+	for _, mailbox := range viper.GetStringSlice("app_only.mailboxes") {
+		var user User
+
+		body, err := graph.get("/users/" + url.PathEscape(mailbox) + "?" + appOnlyUserFields)
+		if err == nil {
+			err = decodeGraphResponse(body, &user)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("unable to look up mailbox %s: %w", mailbox, err)
+		}
+
+		users = append(users, &user)
+	}
+
+	group := viper.GetString("app_only.group")
+	if group == "" {
+		return users, nil
+	}
+
+	nextPage := "/groups/" + url.PathEscape(group) + "/transitiveMembers/microsoft.graph.user?" + appOnlyUserFields
+	for nextPage != "" {
+		var page UserPage
+
+		body, err := graph.get(nextPage)
+		if err == nil {
+			err = decodeGraphResponse(body, &page)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("unable to list the members of group %s: %w", group, err)
+		}
+
+		users = append(users, page.Value...)
+		nextPage = page.NextLink
+	}
+
+	return users, nil
+}
+
+// newAppOnlyCalendar returns the session of a feed provisioned for user, read
+// with the app token
+func newAppOnlyCalendar(src oauth2.TokenSource, graph GraphClient, user *User) *Calendar {
+	c := newCalendarHandler()
+	c.appMailbox = user.UserPrincipalName
+	c.displayName = user.DisplayName
+	c.userMail = user.UserPrincipalName
+	c.userName = c.userMail[0:strings.Index(c.userMail, "@")]
+	c.tokenSource = src
+	c.graph = graph
+	c.setValid(true)
+
+	return c
+}
+
+// provisionAppOnlyFeeds publishes a feed for every configured user, keeping
+// the feed tokens already stored for them
+func provisionAppOnlyFeeds(stored map[string]*StoredUser) error {
+	ctx := context.Background()
+
+	src, err := appTokenSource(ctx)
+	if err != nil {
+		return err
+	}
+
+	graph := newGraphClient(oauth2.NewClient(ctx, src))
+
+	users, err := appOnlyUsers(graph)
+	if err != nil {
+		return err
+	}
+
+	provisioned := make(map[string]bool)
+
+	for _, user := range users {
+		if !strings.Contains(user.UserPrincipalName, "@") {
+			log.Warn().
+				Str("user", user.UserPrincipalName).
+				Str("method", "provisionAppOnlyFeeds").
+				Msg("Skipping user with an unexpected user principal name")
+
+			continue
+		}
+
+		c := newAppOnlyCalendar(src, graph, user)
+		if provisioned[c.userName] {
+			continue
+		}
+
+		provisioned[c.userName] = true
+
+		var token string
+		if s, ok := stored[c.userName]; ok {
+			token = s.token
+		} else if token, err = secureRandomString(45); err != nil {
+			return err
+		} else if err := cachedData.storeToken(c.userName, token, nil, false); err != nil {
+			return err
+		}
+
+		sessions.register(c.userName, token, c)
+
+		log.Info().
+			Str("user", c.userName).
+			Str("mailbox", c.appMailbox).
+			Str("method", "provisionAppOnlyFeeds").
+			Msg("Provisioned feed")
+	}
+
+	return nil
+}
+
+// runFeedsCommand handles "feeds", listing the feeds provisioned in app_only
+// mode for the administrator to hand out
+func runFeedsCommand() error {
+	if !appOnly() {
+		return errors.New("feeds are only provisioned when app_only is enabled")
+	}
+
+	if err := initCache(); err != nil {
+		return err
+	}
+
+	stored, err := cachedData.loadUserTokens()
+	if err != nil {
+		return err
+	}
+
+	if err := provisionAppOnlyFeeds(stored); err != nil {
+		return err
+	}
+
+	feeds := sessions.loggedIn()
+
+	var tokens []string
+	for token := range feeds {
+		tokens = append(tokens, token)
+	}
+
+	sort.Slice(tokens, func(i, j int) bool {
+		return feeds[tokens[i]].userMail < feeds[tokens[j]].userMail
+	})
+
+	for _, token := range tokens {
+		fmt.Printf("%-40s /calendar?token=%s\n", feeds[token].userMail, token)
+	}
+
+	return nil
+}
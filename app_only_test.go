@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// newAppOnlyEnv enables app_only for the user of the fake Graph and the
+// members of a group holding a second mailbox
+func newAppOnlyEnv(t *testing.T) *fakeGraph {
+	graph := newTestEnv(t)
+
+	const boss = "boss@example.com"
+
+	graph.shareCalendar(boss, "boss-default", "Calendar", true)
+	graph.unshareMailbox(boss)
+	graph.addGroup("leads", boss, graph.user.UserPrincipalName)
+
+	monday, _ := getCurrentWeek()
+	graph.putEvent(newTestEvent("own", "Standup", monday.Add(9*time.Hour), time.Hour))
+	graph.putCalendarEvent("boss-default", newTestEvent("board", "Board meeting", monday.Add(14*time.Hour), 2*time.Hour))
+
+	viper.Set("app_only.enabled", true)
+	viper.Set("app_only.mailboxes", []string{graph.user.UserPrincipalName})
+	viper.Set("app_only.group", "leads")
+
+	return graph
+}
+
+// provisionedFeeds returns the provisioned feed tokens by user name
+func provisionedFeeds(t *testing.T) map[string]string {
+	stored, err := cachedData.loadUserTokens()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sessions = newSessionRegistry()
+	if err := provisionAppOnlyFeeds(stored); err != nil {
+		t.Fatal(err)
+	}
+
+	feeds := make(map[string]string)
+	for token, cal := range sessions.loggedIn() {
+		feeds[cal.userName] = token
+	}
+
+	return feeds
+}
+
+// writeCertificate saves a self signed certificate and its key as PEM files
+func writeCertificate(t *testing.T, key *rsa.PrivateKey) (string, string) {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "o365toical"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(t.TempDir(), "app.crt")
+	keyFile := filepath.Join(t.TempDir(), "app.key")
+
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return certFile, keyFile
+}
+
+func TestAppOnlySecret(t *testing.T) {
+	graph := newAppOnlyEnv(t)
+
+	feeds := provisionedFeeds(t)
+	if len(feeds) != 2 || feeds["jane.doe"] == "" || feeds["boss"] == "" {
+		t.Fatalf("provisioned %v", feeds)
+	}
+
+	server, client := newTestClient(t)
+
+	assertEvents(t, getFeed(t, client, server.URL+"/calendar?token="+feeds["jane.doe"]), []string{"own"}, []string{"board"})
+	assertEvents(t, getFeed(t, client, server.URL+"/calendar?token="+feeds["boss"]), []string{"board"}, []string{"own"})
+
+	if n := graph.countRequests("/me"); n != 0 {
+		t.Errorf("%d requests to /me with an app token", n)
+	}
+
+	// Nor through the calendars, nor from a named feed
+	for _, query := range []string{"&mailbox=boss@example.com", "&calendars=boss@example.com:", "&calendars=default,boss@example.com:calendar"} {
+		resp, _ := get(t, client, server.URL+"/calendar?token="+feeds["jane.doe"]+query)
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("shared mailbox on a provisioned feed with %q answered %d", query, resp.StatusCode)
+		}
+	}
+
+	status, body := postForm(t, server.URL+"/feeds", neturl.Values{"token": {feeds["jane.doe"]}, "name": {"Boss"}, "mailbox": {"boss@example.com"}})
+	named := regexp.MustCompile(`/calendar\?token=[\w-]+`).FindString(body)
+	if status != http.StatusCreated || named == "" {
+		t.Fatalf("POST /feeds answered %d: %q", status, body)
+	}
+
+	if resp, _ := get(t, client, server.URL+named); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("named feed of a shared mailbox on a provisioned feed answered %d", resp.StatusCode)
+	}
+
+	if n := graph.countRequests("/users/boss%40example.com/calendarView") + graph.countRequests("/users/boss@example.com/calendarView"); n != 1 {
+		t.Errorf("%d syncs of the mailbox of boss, expected only its own feed's", n)
+	}
+
+	resp, body := get(t, client, server.URL+"/")
+	if resp.StatusCode != http.StatusForbidden || !strings.Contains(body, "provisioned") {
+		t.Errorf("login in app_only mode answered %d: %q", resp.StatusCode, body)
+	}
+
+	// Provisioning again, as on a restart, keeps the feed URLs
+	for user, token := range provisionedFeeds(t) {
+		if feeds[user] != token {
+			t.Errorf("feed of %s moved from %s to %s", user, feeds[user], token)
+		}
+	}
+}
+
+func TestAppOnlyCertificate(t *testing.T) {
+	graph := newAppOnlyEnv(t)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile := writeCertificate(t, key)
+
+	viper.Set("secret", "")
+	viper.Set("app_only.certificate", certFile)
+	viper.Set("app_only.private_key", keyFile)
+
+	stored, _ := cachedData.loadUserTokens()
+	if err := provisionAppOnlyFeeds(stored); err == nil {
+		t.Fatal("provisioned with a certificate the tenant doesn't trust")
+	}
+
+	graph.trustCertificate(&key.PublicKey)
+
+	feeds := provisionedFeeds(t)
+	server, client := newTestClient(t)
+
+	assertEvents(t, getFeed(t, client, server.URL+"/calendar?token="+feeds["boss"]), []string{"board"}, nil)
+}
+
+func TestAppOnlyConfiguration(t *testing.T) {
+	newAppOnlyEnv(t)
+
+	viper.Set("tenant", "common")
+	if _, err := appTokenSource(context.Background()); err == nil {
+		t.Error("app tokens requested without a tenant")
+	}
+
+	viper.Set("tenant", fakeTenant)
+	viper.Set("secret", "")
+	if _, err := appTokenSource(context.Background()); err == nil {
+		t.Error("app tokens requested without credentials")
+	}
+}
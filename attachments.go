@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+const (
+	// Larger attachments are downloaded on their own, keeping batch responses small
+	batchDownloadMaxSize = 1 << 20
+)
+
+// attachmentDownload is an attachment to save to attachments_dir, from the
+// path of its contents
+type attachmentDownload struct {
+	path string
+	meta *EventAttachment
+}
+
+func (c *Calendar) attachmentsPath(mailbox string, id string) string {
+	return c.mailboxPath(mailbox) + "/events/" + id + "/attachments"
+}
+
+// validAttachmentID checks that an attachment id, naming its directory under
+// attachments_dir, stays within it
+func validAttachmentID(id string) bool {
+	return id != "" && id != "." && id != ".." && !strings.ContainsAny(id, `/\`)
+}
+
+// attachmentFileName keeps the last element of the name of an attachment,
+// which whoever sent the event chose
+func attachmentFileName(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, `\`, "/"))
+	if name == "." || name == ".." || name == "/" {
+		return "attachment"
+	}
+
+	return name
+}
+
+func createAttachmentFile(attId string, fname string) (*os.File, error) {
+	if !validAttachmentID(attId) {
+		return nil, fmt.Errorf("invalid attachment id %q", attId)
+	}
+
+	baseDir := filepath.Join(viper.GetString("attachments_dir"), attId)
+	if err := os.MkdirAll(baseDir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	return os.Create(filepath.Join(baseDir, attachmentFileName(fname)))
+}
+
+func saveAttachmentContent(attId string, fname string, content []byte) error {
+	file, err := createAttachmentFile(attId, fname)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	_, err = file.Write(content)
+
+	return err
+}
+
+func (c *Calendar) saveURLToFile(path string, attId string, fname string) error {
+	file, err := createAttachmentFile(attId, fname)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	return c.checkAuth(c.graph.download(path, file))
+}
+
+// getAttachments lists attachments from path onwards, following every page
+func (c *Calendar) getAttachments(path string) ([]*EventAttachment, error) {
+	var attachments []*EventAttachment
+
+	nextPage := path
+	for nextPage != "" {
+		var page AttachmentPage
+
+		body, err := c.getRemoteData(nextPage)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := decodeGraphResponse(body, &page); err != nil {
+			return nil, err
+		}
+
+		attachments = append(attachments, page.Value...)
+		nextPage = page.NextLink
+	}
+
+	return attachments, nil
+}
+
+// listAttachments lists the attachments of the events of the mailbox with ids
+// in batches, requesting on their own the ones that failed within a batch
+func (c *Calendar) listAttachments(mailbox string, ids []string) (map[string][]*EventAttachment, error) {
+	paths := make([]string, len(ids))
+	for i, id := range ids {
+		paths[i] = c.attachmentsPath(mailbox, id)
+	}
+
+	responses, err := c.batchGet(paths)
+	if err != nil {
+		return nil, err
+	}
+
+	attachments := make(map[string][]*EventAttachment)
+
+	for i, id := range ids {
+		var page AttachmentPage
+
+		err := responses[i].err()
+		if err == nil {
+			err = json.Unmarshal(responses[i].Body, &page)
+		}
+
+		if err != nil {
+			log.Warn().
+				Err(err).
+				Str("user", c.userName).
+				Str("event", id).
+				Str("method", "listAttachments").
+				Msg("Batched request failed, sending it alone")
+
+			page = AttachmentPage{NextLink: paths[i]}
+		}
+
+		values := page.Value
+
+		if page.NextLink != "" {
+			rest, err := c.getAttachments(page.NextLink)
+			if err != nil {
+				return nil, err
+			}
+
+			values = append(values, rest...)
+		}
+
+		attachments[id] = values
+	}
+
+	return attachments, nil
+}
+
+// prefetchAttachments lists the attachments of the events of the mailbox having
+// some, and starts downloading the ones not stored yet, returning them by
+// event id
+func (c *Calendar) prefetchAttachments(baseHost string, mailbox string, events []*Event) (map[string][]*Attachment, error) {
+	var ids []string
+	var downloads []*attachmentDownload
+
+	seen := make(map[string]bool)
+	for _, e := range events {
+		if e.HasAttachments && !seen[e.ID] {
+			seen[e.ID] = true
+			ids = append(ids, e.ID)
+		}
+	}
+
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	values, err := c.listAttachments(mailbox, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if len(downloads) > 0 {
+			go c.downloadAttachments(downloads)
+		}
+	}()
+
+	attachments := make(map[string][]*Attachment)
+
+	for _, id := range ids {
+		var atts []*Attachment
+
+		for _, v := range values[id] {
+			if !validAttachmentID(v.ID) {
+				log.Warn().
+					Str("user", c.userName).
+					Str("attachment", v.ID).
+					Str("method", "prefetchAttachments").
+					Msg("Skipping attachment with an invalid id")
+
+				continue
+			}
+
+			contentType := v.ContentType
+			if contentType == "" {
+				contentType = "application/octet-stream"
+			}
+
+			if attCache := cachedData.attachmentExists(v.ID); attCache != nil {
+				atts = append(atts, &Attachment{
+					url:      "https://" + baseHost + "/attachment/" + v.ID + "/" + url.PathEscape(attachmentFileName(attCache[0])),
+					mimeType: attCache[1],
+				})
+				continue
+			}
+
+			downloads = append(downloads, &attachmentDownload{
+				path: c.attachmentsPath(mailbox, id) + "/" + v.ID + "/$value",
+				meta: v,
+			})
+
+			if err := cachedData.saveAttachment(c.userName, v.ID, v.Name, contentType); err != nil {
+				return nil, err
+			}
+
+			atts = append(atts, &Attachment{
+				url:      "https://" + baseHost + "/attachment/" + v.ID + "/" + url.PathEscape(attachmentFileName(v.Name)),
+				mimeType: contentType,
+			})
+		}
+
+		attachments[id] = atts
+	}
+
+	return attachments, nil
+}
+
+// downloadAttachments saves the contents of the attachments to disk, the small
+// ones through batches
+func (c *Calendar) downloadAttachments(downloads []*attachmentDownload) {
+	var batched []*attachmentDownload
+	var single []*attachmentDownload
+
+	for _, d := range downloads {
+		if d.meta.Size <= batchDownloadMaxSize {
+			batched = append(batched, d)
+		} else {
+			single = append(single, d)
+		}
+	}
+
+	if len(batched) > 0 {
+		paths := make([]string, len(batched))
+		for i, d := range batched {
+			paths[i] = d.path
+		}
+
+		responses, err := c.batchGet(paths)
+		if err != nil {
+			log.Warn().
+				Err(err).
+				Str("user", c.userName).
+				Str("method", "downloadAttachments").
+				Msg("Batched downloads failed, downloading one by one")
+
+			responses = make([]*BatchResponse, len(batched))
+		}
+
+		for i, d := range batched {
+			var content []byte
+
+			err := responses[i].err()
+			if err == nil {
+				content, err = responses[i].content()
+			}
+
+			if err != nil {
+				single = append(single, d)
+				continue
+			}
+
+			if err := saveAttachmentContent(d.meta.ID, d.meta.Name, content); err != nil {
+				log.Error().
+					Err(err).
+					Str("Attachment ID", d.meta.ID).
+					Str("File name", d.meta.Name).
+					Msg("Error saving file to disk")
+			}
+		}
+	}
+
+	for _, d := range single {
+		if err := c.saveURLToFile(d.path, d.meta.ID, d.meta.Name); err != nil {
+			log.Error().
+				Err(err).
+				Str("Attachment ID", d.meta.ID).
+				Str("File name", d.meta.Name).
+				Msg("Error saving file to disk")
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+const (
+	graphBatchSize = 20
+)
+
+// err returns the error a response of a batch holds, if any. Requests left
+// unanswered by Graph have a nil response.
+func (r *BatchResponse) err() error {
+	if r == nil {
+		return errors.New("request missing from the batch response")
+	}
+
+	if r.Status >= 200 && r.Status < 300 {
+		return nil
+	}
+
+	var errResponse struct {
+		Error *GraphError `json:"error"`
+	}
+
+	graphErr := &GraphError{Code: http.StatusText(r.Status)}
+	if err := json.Unmarshal(r.Body, &errResponse); err == nil && errResponse.Error != nil {
+		graphErr = errResponse.Error
+	}
+
+	graphErr.StatusCode = r.Status
+
+	return graphErr
+}
+
+// content returns the raw body of the response, decoding it when not JSON
+func (r *BatchResponse) content() ([]byte, error) {
+	var content []byte
+
+	if len(r.Body) == 0 || r.Body[0] != '"' {
+		return r.Body, nil
+	}
+
+	err := json.Unmarshal(r.Body, &content)
+
+	return content, err
+}
+
+// batchGet fetches paths through JSON batches of up to graphBatchSize
+// requests, returning the responses in the order of paths
+func (c *Calendar) batchGet(paths []string) ([]*BatchResponse, error) {
+	responses := make([]*BatchResponse, len(paths))
+
+	for start := 0; start < len(paths); start += graphBatchSize {
+		end := start + graphBatchSize
+		if end > len(paths) {
+			end = len(paths)
+		}
+
+		var payload BatchPayload
+		var result BatchResult
+
+		for i := start; i < end; i++ {
+			payload.Requests = append(payload.Requests, &BatchRequest{
+				ID:     strconv.Itoa(i),
+				Method: http.MethodGet,
+				URL:    paths[i],
+			})
+		}
+
+		body, err := c.sendRemoteData(http.MethodPost, "/$batch", &payload)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := decodeGraphResponse(body, &result); err != nil {
+			return nil, err
+		}
+
+		// Responses come back in any order
+		for _, r := range result.Responses {
+			if r == nil {
+				continue
+			}
+
+			if i, err := strconv.Atoi(r.ID); err == nil && i >= start && i < end {
+				responses[i] = r
+			}
+		}
+	}
+
+	return responses, nil
+}
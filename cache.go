@@ -1,84 +1,70 @@
 package main
 
 import (
-	"encoding/json"
 	"time"
 
 	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
 )
 
-func getCalendarMonthForUser(c *Calendar, start time.Time, end time.Time) ([]interface{}, error) {
-	var calData map[string]interface{}
-	var cachedValues []interface{}
-
-	url := "https://graph.microsoft.com/v1.0/me/calendarview?startdatetime=" + start.Format(RFC3339Short) + "&enddatetime=" + end.Format(RFC3339Short) + "&top=10&skip=0"
-	body, err := c.getRemoteData(url)
-	if err != nil {
-		return nil, err
-	}
+// refreshCache keeps the local event store of every logged user in sync, so
+// feeds rarely have to wait on Graph, and their change notification
+// subscriptions alive. Feeds revoked from the command line stop here too.
+func refreshCache() {
+	for {
+		time.Sleep(60 * time.Second)
 
-	if err := json.Unmarshal(body, &calData); err != nil {
-		return nil, err
+		refreshSessions()
 	}
+}
 
-	for {
-		values := calData["value"].([]interface{})
-		cachedValues = append(cachedValues, values...)
+// refreshSessions does a single pass of refreshCache over the sessions. Those
+// failing for any other reason than their credentials being rejected stay
+// valid, and are retried on the next pass.
+func refreshSessions() {
+	interval := viper.GetDuration("delta_sync_interval")
 
-		if nextPage, ok := calData["@odata.nextLink"].(string); ok {
-			calData = make(map[string]interface{})
-			body, err := c.getRemoteData(nextPage)
-			if err != nil {
-				return nil, err
-			}
-
-			if err := json.Unmarshal(body, &calData); err != nil {
-				return nil, err
-			}
-		} else {
-			break
-		}
+	if err := dropRevokedSessions(); err != nil {
+		log.Error().
+			Err(err).
+			Str("method", "dropRevokedSessions").
+			Send()
 	}
 
-	return cachedValues, nil
-}
-
-func refreshCache() {
-	for {
-		time.Sleep(60 * time.Second)
-		for _, v := range loggedUsers {
-			if !v.valid {
-				continue
-			}
+	for _, v := range sessions.loggedIn() {
+		if !v.isValid() {
+			continue
+		}
 
-			start, end := getMonthAfterStartEndWeekDays()
+		v.getTimeZone()
 
-			lastUpdated, err := cachedData.getCacheForUserLastUpdate(v.userName, start, end)
-			if err != nil || time.Since(lastUpdated).Hours() >= 24 {
-				cachedValues, err := getCalendarMonthForUser(v, start, end)
-				if err != nil {
-					log.Error().
-						Err(err).
-						Str("user", v.userName).
-						Str("method", "getCalendarMonthForUser").
-						Send()
+		if err := v.ensureSubscription(); err != nil {
+			log.Error().
+				Err(err).
+				Str("user", v.userName).
+				Str("method", "ensureSubscription").
+				Send()
+		}
 
-					continue
-				}
+		calendars, err := v.syncedCalendars()
+		if err != nil {
+			log.Error().
+				Err(err).
+				Str("user", v.userName).
+				Str("method", "refreshCache").
+				Send()
 
-				err = cachedData.saveCacheForUser(v.userName, start, end, cachedValues)
-				if err != nil {
-					log.Error().
-						Err(err).
-						Str("user", v.userName).
-						Str("method", "saveCacheForUser").
-						Send()
-				}
+			continue
+		}
 
-				log.Info().
+		for _, calendar := range calendars {
+			if _, err := v.ensureSynced(calendar, interval); err != nil {
+				log.Error().
+					Err(err).
 					Str("user", v.userName).
+					Str("calendar", calendar).
 					Str("method", "refreshCache").
-					Msg("Updated cached data for user")
+					Send()
 			}
 		}
 	}
@@ -2,37 +2,107 @@ package main
 
 import (
 	"context"
-	"encoding/json"
-	"io"
-	"net/http"
-	"net/url"
-	"os"
+	"errors"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	ics "github.com/arran4/golang-ical"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/viper"
 	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/microsoft"
 )
 
 const (
 	RFC3339Short      = "2006-01-02T15:04:05"
 	StartEndTimeParse = "2006-01-02T15:04:05.0000000"
+
+	// busySummary replaces the subject of the events on feeds without titles
+	busySummary = "Busy"
+
+	// The activity of a user is written back at most this often
+	activityTouchInterval = time.Minute
 )
 
 type Calendar struct {
-	ctx    context.Context
-	conf   *oauth2.Config
-	client *http.Client
+	ctx         context.Context
+	conf        *oauth2.Config
+	graph       GraphClient
+	tokenSource oauth2.TokenSource
+
+	// publicClient is set on the sessions logged in with a device code, whose
+	// tokens are refreshed without the client secret
+	publicClient bool
+
+	// auth is the login started on "/" waiting for its redirect, if any
+	authMu sync.Mutex
+	auth   *authRequest
+
+	// device is the device code login in progress, if any
+	deviceMu sync.Mutex
+	device   *deviceLogin
+
+	// appMailbox is the mailbox read with the application permissions of the
+	// app, for the feeds provisioned in app_only mode, instead of /me
+	appMailbox string
 
 	displayName string
 	userName    string
 	userMail    string
-	valid       bool
+
+	// lastUpdated is when the feed was last fetched, or the session last
+	// logged in, lastStored when that was last stored, and reported set once
+	// the user was reported as inactive, until they're active again
+	activityMu  sync.Mutex
 	lastUpdated time.Time
+	lastStored  time.Time
+	reported    bool
+
+	// valid is set, atomically, while the session has working credentials
+	valid int32
+
+	tzMu            sync.Mutex
+	mailboxTimeZone string
+	location        *time.Location
+	locationUpdated time.Time
+
+	syncMu     sync.Mutex
+	syncQueued int32
+
+	subMu        sync.Mutex
+	subscription *Subscription
+
+	// masters are the series masters fetched for the recurring feeds, by
+	// mailbox, id and whether they come with their body, until a sync brings
+	// changes. mastersGen counts those syncs.
+	mastersMu  sync.Mutex
+	masters    map[string]*Event
+	mastersGen int
+}
+
+// FeedOptions are the per request options of a calendar feed
+type FeedOptions struct {
+	baseHost  string
+	full      bool
+	google    bool
+	recurring bool
+	weekends  bool
+	bodies    bool
+	titles    bool
+	past      int
+	future    int
+
+	// mailbox the calendars belong to, when shared by someone else
+	mailbox string
+
+	// calendars to merge into the feed, as synced
+	calendars []string
+
+	// attachments of the events on the feed, by event id
+	attachments map[string][]*Attachment
 }
 
 type Attachment struct {
@@ -45,240 +115,310 @@ func newCalendarHandler() *Calendar {
 	conf := &oauth2.Config{
 		ClientID:     viper.GetString("client_id"),
 		ClientSecret: viper.GetString("secret"),
-		Scopes:       []string{"offline_access", "user.read", "calendars.read"},
+		Scopes:       []string{"offline_access", "user.read", "calendars.read", "calendars.read.shared", "mailboxsettings.read"},
 		RedirectURL:  viper.GetString("redirect_url"),
-		Endpoint:     microsoft.AzureADEndpoint(viper.GetString("tenant")),
+		Endpoint:     oauthEndpoint(),
 	}
 
 	return &Calendar{
 		ctx:         ctx,
 		conf:        conf,
-		valid:       false,
 		lastUpdated: time.Now(),
 	}
 }
 
-func (c *Calendar) getURL() string {
-	return c.conf.AuthCodeURL("state", oauth2.AccessTypeOffline)
+// newCalendarHandlerFromToken rehydrates a logged in user from an OAuth token
+// previously stored in the database
+func newCalendarHandlerFromToken(userName string, tok *oauth2.Token, publicClient bool) *Calendar {
+	c := newCalendarHandler()
+	c.userName = userName
+
+	if publicClient {
+		c.usePublicClient()
+	}
+
+	c.setToken(tok)
+	c.setValid(true)
+
+	return c
 }
 
-func (c *Calendar) getRemoteData(url string) ([]byte, error) {
-	resp, err := c.client.Get(url)
-	if err != nil {
-		return []byte{}, err
+func (c *Calendar) isValid() bool {
+	return atomic.LoadInt32(&c.valid) == 1
+}
+
+func (c *Calendar) setValid(valid bool) {
+	if valid {
+		atomic.StoreInt32(&c.valid, 1)
+	} else {
+		atomic.StoreInt32(&c.valid, 0)
 	}
+}
 
-	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return []byte{}, err
+// touch records activity on the session, keeping the janitor away. The
+// activity of logged in users is stored, so it outlives restarts.
+func (c *Calendar) touch() {
+	now := time.Now().UTC()
+
+	c.activityMu.Lock()
+
+	c.lastUpdated = now
+	c.reported = false
+
+	store := c.userName != "" && now.Sub(c.lastStored) >= activityTouchInterval
+	if store {
+		c.lastStored = now
 	}
 
-	return body, nil
+	c.activityMu.Unlock()
+
+	if store {
+		if err := cachedData.touchUser(c.userName, now); err != nil {
+			log.Warn().
+				Err(err).
+				Str("user", c.userName).
+				Str("method", "touch").
+				Msg("Unable to record the activity of the user")
+		}
+	}
 }
 
-func (c *Calendar) saveURLToFile(url string, attId string, fname string) error {
-	baseDir := viper.GetString("attachments_dir") + "/" + attId
-	os.MkdirAll(baseDir, os.ModePerm)
+// restoreActivity sets when the user was last active, as stored
+func (c *Calendar) restoreActivity(last time.Time) {
+	if last.IsZero() {
+		return
+	}
 
-	file, err := os.Create(baseDir + "/" + fname)
-	if err != nil {
-		return err
+	c.activityMu.Lock()
+	c.lastUpdated = last
+	c.lastStored = last
+	c.activityMu.Unlock()
+}
+
+// reportInactive records that the user was reported as inactive, returning
+// false if they were already
+func (c *Calendar) reportInactive() bool {
+	c.activityMu.Lock()
+	defer c.activityMu.Unlock()
+
+	if c.reported {
+		return false
 	}
 
-	resp, err := c.client.Get(url)
-	if err != nil {
-		return err
+	c.reported = true
+
+	return true
+}
+
+// lastActivity returns when the feed was last fetched, or the session last
+// logged in
+func (c *Calendar) lastActivity() time.Time {
+	c.activityMu.Lock()
+	defer c.activityMu.Unlock()
+
+	return c.lastUpdated
+}
+
+func (c *Calendar) setToken(tok *oauth2.Token) {
+	c.tokenSource = &persistingTokenSource{
+		src:  c.conf.TokenSource(c.ctx, tok),
+		cal:  c,
+		last: tok,
 	}
 
-	defer resp.Body.Close()
+	c.graph = newGraphClient(oauth2.NewClient(c.ctx, c.tokenSource))
+}
+
+func (c *Calendar) currentToken() *oauth2.Token {
+	if c.tokenSource == nil {
+		return nil
+	}
 
-	_, err = io.Copy(file, resp.Body)
+	tok, err := c.tokenSource.Token()
 	if err != nil {
-		return err
+		return nil
 	}
 
-	defer file.Close()
+	return tok
+}
+
+func (c *Calendar) getRemoteData(path string, prefer ...string) ([]byte, error) {
+	// Have Graph return the dates in the mailbox time zone instead of UTC
+	if name := c.timeZoneName(); name != "" {
+		prefer = append(prefer, "outlook.timezone=\""+name+"\"")
+	}
 
-	return nil
+	body, err := c.graph.get(path, prefer...)
+
+	return body, c.checkAuth(err)
 }
 
-func (c *Calendar) handleToken(code string, cookieToken string) (string, error) {
-	var user map[string]interface{}
+// sendRemoteData sends payload, encoded as JSON, to path with the given method
+func (c *Calendar) sendRemoteData(method string, path string, payload interface{}) ([]byte, error) {
+	body, err := c.graph.send(method, path, payload)
+
+	return body, c.checkAuth(err)
+}
+
+// checkAuth flags the user as needing to log in again once its credentials
+// are rejected, so the session stops being used until then. Provisioned feeds
+// have nobody to log in, and keep trying with new app tokens instead.
+func (c *Calendar) checkAuth(err error) error {
+	if c.appMailbox == "" && isAuthError(err) && atomic.CompareAndSwapInt32(&c.valid, 1, 0) {
+
+		log.Warn().
+			Err(err).
+			Str("user", c.userName).
+			Str("method", "checkAuth").
+			Msg("Credentials rejected, user needs to log in again")
+	}
 
+	return err
+}
+
+func (c *Calendar) handleToken(code string, state string, cookieToken string) (string, error) {
 	// Use the authorization code that is pushed to the redirect
 	// URL. Exchange will do the handshake to retrieve the
-	// initial access token. The HTTP Client returned by
-	// conf.Client will refresh the token as necessary.
+	// initial access token. The token source set by setToken
+	// will refresh the token as necessary and persist it.
+
+	verifier, err := c.verifyState(state)
+	if err != nil {
+		return "", err
+	}
+
+	// Redirect logins are made by the app as a confidential client, even if
+	// the session logged in with a device code before
+	c.publicClient = false
+	c.conf.ClientSecret = viper.GetString("secret")
 
-	tok, err := c.conf.Exchange(c.ctx, code)
+	tok, err := c.conf.Exchange(c.ctx, code, oauth2.SetAuthURLParam("code_verifier", verifier))
 	if err != nil {
 		return "", err
 	}
 
-	c.client = c.conf.Client(c.ctx, tok)
+	return c.login(tok, cookieToken)
+}
+
+// login starts using tok, identifying the user and storing the session under
+// the feed token they had, if they logged in before
+func (c *Calendar) login(tok *oauth2.Token, cookieToken string) (string, error) {
+	var user User
+
+	c.setToken(tok)
 
-	body, err := c.getRemoteData("https://graph.microsoft.com/v1.0/me")
+	body, err := c.getRemoteData("/me")
 	if err != nil {
 		return "", err
 	}
 
-	if err := json.Unmarshal(body, &user); err != nil {
+	if err := decodeGraphResponse(body, &user); err != nil {
 		return "", err
 	}
 
-	c.displayName = user["displayName"].(string)
-	c.userMail = user["userPrincipalName"].(string)
+	if !strings.Contains(user.UserPrincipalName, "@") {
+		return "", errors.New("unexpected user principal name " + user.UserPrincipalName)
+	}
+
+	c.displayName = user.DisplayName
+	c.userMail = user.UserPrincipalName
 	userName := c.userMail[0:strings.Index(c.userMail, "@")]
 	c.userName = userName
 
-	for k, v := range loggedUsers {
-		if v.userName == userName && k != cookieToken {
-			cookieToken = k
-			loggedUsers[k] = c
-			break
-		}
+	token, err := sessions.claim(userName, cookieToken, c)
+	if err != nil {
+		return "", err
 	}
 
-	// TODO Should optimize this and avoid O(2n)
-	for k, v := range cachedUsers {
-		if userName == k {
-			delete(loggedUsers, cookieToken)
-			cookieToken = v
-			loggedUsers[v] = c
-			delete(cachedUsers, k)
-			break
-		}
+	if err := cachedData.storeToken(userName, token, c.currentToken(), c.publicClient); err != nil {
+		return "", err
 	}
 
-	c.valid = true
+	// Any session serving the feed keeps doing so until this one can
+	c.touch()
+	c.setValid(true)
+	sessions.serve(userName, token, cookieToken, c)
 
-	return cookieToken, nil
+	return token, nil
 }
 
-func (c *Calendar) shouldSkip(data map[string]interface{}) bool {
-	rspStatus := data["responseStatus"].(map[string]interface{})
-	if rspStatus["response"].(string) != "accepted" && rspStatus["response"].(string) != "organizer" && rspStatus["response"].(string) != "none" {
+func (c *Calendar) shouldSkip(e *Event) bool {
+	if rsp := e.response(); rsp != "accepted" && rsp != "organizer" && rsp != "none" {
 		return true
 	}
 
-	if data["isAllDay"].(bool) {
+	if e.IsAllDay {
 		return true
 	}
 
-	if data["showAs"].(string) != "busy" {
+	if e.ShowAs != "busy" {
 		return true
 	}
 
 	return false
 }
 
-func (c *Calendar) handleAttachments(baseHost, id string, hasAttachments bool) ([]*Attachment, error) {
-	if !hasAttachments {
-		return nil, nil
+// isWeekend checks if the event happens entirely on a Saturday or Sunday
+func isWeekend(e *Event) bool {
+	start := e.startTime()
+
+	var weekendEnd time.Time
+	switch start.Weekday() {
+	case time.Saturday:
+		weekendEnd = time.Date(start.Year(), start.Month(), start.Day()+2, 0, 0, 0, 0, start.Location())
+	case time.Sunday:
+		weekendEnd = time.Date(start.Year(), start.Month(), start.Day()+1, 0, 0, 0, 0, start.Location())
+	default:
+		return false
 	}
 
-	var attData map[string]interface{}
-	var attachments []*Attachment
-
-	baseUrl := "https://graph.microsoft.com/v1.0/me/events/" + id + "/attachments"
-	body, err := c.getRemoteData(baseUrl)
-	if err != nil {
-		return nil, err
-	}
-
-	if err := json.Unmarshal(body, &attData); err != nil {
-		return nil, err
-	}
+	return !e.endTime().After(weekendEnd)
+}
 
-	if _, ok := attData["value"]; !ok {
-		return attachments, nil
+// skipEvent applies the filters of the feed options to an event
+func (c *Calendar) skipEvent(e *Event, opts *FeedOptions) bool {
+	if !opts.full && c.shouldSkip(e) {
+		return true
 	}
 
-	values := attData["value"].([]interface{})
-	for _, v := range values {
-		data := v.(map[string]interface{})
-
-		attId := data["id"].(string)
-		name := data["name"].(string)
-
-		var contentType string
-		if val, ok := data["contentType"]; ok && val != nil {
-			contentType = val.(string)
-		} else {
-			contentType = "application/octet-stream"
-		}
-
-		if attCache := cachedData.attachmentExists(attId); attCache != nil {
-			attachments = append(attachments, &Attachment{
-				url:      "https://" + baseHost + "/attachment/" + attId + "/" + url.PathEscape(attCache[0]),
-				mimeType: attCache[1],
-			})
-			continue
-		}
-
-		go func() {
-			baseUrl := "https://graph.microsoft.com/v1.0/me/events/" + id + "/attachments/" + attId + "/$value"
-			if err := c.saveURLToFile(baseUrl, attId, name); err != nil {
-				log.Error().
-					Err(err).
-					Str("Attachment ID", attId).
-					Str("File name", name).
-					Msg("Error saving file to disk")
-			}
-		}()
-
-		if err = cachedData.saveAttachment(attId, name, contentType); err != nil {
-			return nil, err
-		}
-
-		attachments = append(attachments, &Attachment{
-			url:      "https://" + baseHost + "/attachment/" + attId + "/" + url.PathEscape(name),
-			mimeType: contentType,
-		})
+	if !opts.weekends && isWeekend(e) {
+		return true
 	}
 
-	return attachments, nil
+	return false
 }
 
-func (c *Calendar) handleBasicEventData(cal *ics.Calendar, data map[string]interface{}) *ics.VEvent {
-	event := cal.AddEvent(data["id"].(string))
+func (c *Calendar) handleBasicEventData(cal *ics.Calendar, e *Event, titles bool) *ics.VEvent {
+	event := cal.AddEvent(e.ID)
 	event.SetDtStampTime(time.Now())
 
-	t, _ := time.Parse(time.RFC3339, data["createdDateTime"].(string))
-	event.SetCreatedTime(t)
+	if t, err := time.Parse(time.RFC3339, e.CreatedDateTime); err == nil {
+		event.SetCreatedTime(t)
+	}
 
-	t, _ = time.Parse(time.RFC3339, data["lastModifiedDateTime"].(string))
-	event.SetModifiedAt(t)
+	if t, err := time.Parse(time.RFC3339, e.LastModifiedDateTime); err == nil {
+		event.SetModifiedAt(t)
+	}
 
-	ts, _ := time.Parse(StartEndTimeParse, data["start"].(map[string]interface{})["dateTime"].(string))
-	te, _ := time.Parse(StartEndTimeParse, data["end"].(map[string]interface{})["dateTime"].(string))
+	setEventTime(event, ics.ComponentPropertyDtStart, e.startTime(), e.IsAllDay)
+	setEventTime(event, ics.ComponentPropertyDtEnd, e.endTime(), e.IsAllDay)
 
-	if data["isAllDay"].(bool) {
-		event.SetAllDayStartAt(ts)
-		event.SetAllDayEndAt(te)
+	if titles {
+		event.SetSummary(e.Subject)
+		event.SetLocation(e.locationName())
 	} else {
-		event.SetStartAt(ts)
-		event.SetEndAt(te)
+		event.SetSummary(busySummary)
 	}
 
-	event.SetSummary(data["subject"].(string))
-	event.SetLocation(data["location"].(map[string]interface{})["displayName"].(string))
-
-	if rsp, ok := data["responseStatus"]; ok {
-		rspValue := rsp.(map[string]interface{})["response"].(string)
-		if rspValue != "accepted" && rspValue != "organizer" {
-			event.SetStatus(ics.ObjectStatusTentative)
-		}
-	} else {
+	if rsp := e.response(); rsp != "accepted" && rsp != "organizer" {
 		event.SetStatus(ics.ObjectStatusTentative)
 	}
 
 	return event
 }
 
-func (c *Calendar) handleDescription(event *ics.VEvent, data map[string]interface{}, atts []*Attachment) {
-	link := strings.TrimSpace(parseTeamsLink(data["body"].(map[string]interface{})["content"].(string), data["onlineMeeting"]))
+func (c *Calendar) handleDescription(event *ics.VEvent, e *Event, atts []*Attachment) {
+	link := strings.TrimSpace(parseTeamsLink(e.bodyContent(), e.joinURL()))
 	if link != "" {
 		event.SetURL(link)
 	}
@@ -296,7 +436,7 @@ func (c *Calendar) handleDescription(event *ics.VEvent, data map[string]interfac
 		attString.WriteString(v.url)
 	}
 
-	description, err := html2text(data["body"].(map[string]interface{})["content"].(string))
+	description, err := html2text(e.bodyContent())
 	if err == nil && description != "" {
 		var dscString strings.Builder
 		dscString.WriteString(description)
@@ -315,34 +455,29 @@ func (c *Calendar) handleDescription(event *ics.VEvent, data map[string]interfac
 	}
 }
 
-func (c *Calendar) handleAttendees(event *ics.VEvent, data map[string]interface{}, google bool) {
-	organizer := data["organizer"].(map[string]interface{})
-	organizerMail := organizer["emailAddress"].(map[string]interface{})["address"].(string)
-	organizerName := organizer["emailAddress"].(map[string]interface{})["name"].(string)
-	event.SetOrganizer(organizerMail, ics.WithCN(organizerName))
-
-	event.AddAttendee(organizerMail, ics.ParticipationRoleChair, ics.ParticipationStatusAccepted, ics.WithCN(organizerName))
+func (c *Calendar) handleAttendees(event *ics.VEvent, e *Event, google bool) {
+	organizer := e.Organizer.emailAddress()
+	if organizer.address() != "" {
+		event.SetOrganizer(organizer.address(), ics.WithCN(organizer.name()))
+		event.AddAttendee(organizer.address(), ics.ParticipationRoleChair, ics.ParticipationStatusAccepted, ics.WithCN(organizer.name()))
+	}
 
 	// Google can't handle big lists of invitees (>5 I guess), and don't display them either way
 	if !google {
-		attendees := data["attendees"].([]interface{})
-		for _, att := range attendees {
+		for _, att := range e.Attendees {
 			var props []ics.PropertyParameter
 
-			castAtt := att.(map[string]interface{})
-
-			typ := castAtt["type"].(string)
-			resp := castAtt["status"].(map[string]interface{})["response"].(string)
-			name := castAtt["emailAddress"].(map[string]interface{})["name"].(string)
-			email := castAtt["emailAddress"].(map[string]interface{})["address"].(string)
+			if att == nil || att.EmailAddress.address() == "" {
+				continue
+			}
 
-			if typ == "required" {
+			if att.Type == "required" {
 				props = append(props, ics.ParticipationRoleReqParticipant)
 			} else {
 				props = append(props, ics.ParticipationRoleOptParticipant)
 			}
 
-			switch resp {
+			switch att.response() {
 			case "accepted":
 				props = append(props, ics.ParticipationStatusAccepted)
 			case "tentative":
@@ -353,90 +488,177 @@ func (c *Calendar) handleAttendees(event *ics.VEvent, data map[string]interface{
 				props = append(props, ics.ParticipationStatusNeedsAction)
 			}
 
-			props = append(props, ics.WithCN(name))
-			event.AddAttendee(email, props...)
+			props = append(props, ics.WithCN(att.EmailAddress.name()))
+			event.AddAttendee(att.EmailAddress.address(), props...)
 		}
 	}
 }
 
-func (c *Calendar) getCalendar(baseHost string, full bool, google bool) (string, error) {
-	var calData map[string]interface{}
-	var cacheRetrieved bool
+// getCalendars lists the calendars of a mailbox the user has access to,
+// following every page
+func (c *Calendar) getCalendars(mailbox string) ([]*GraphCalendar, error) {
+	var calendars []*GraphCalendar
+
+	nextPage := c.mailboxPath(mailbox) + "/calendars?$select=id,name,isDefaultCalendar"
+	for nextPage != "" {
+		var page CalendarPage
 
-	start, end := getStartEndWeekDays()
+		body, err := c.getRemoteData(nextPage)
+		if err != nil {
+			return nil, err
+		}
 
-	url := "https://graph.microsoft.com/v1.0/me/calendarview?startdatetime=" + start.Format(RFC3339Short) + "&enddatetime=" + end.Format(RFC3339Short) + "&top=10&skip=0"
-	body, err := c.getRemoteData(url)
+		if err := decodeGraphResponse(body, &page); err != nil {
+			return nil, err
+		}
+
+		calendars = append(calendars, page.Value...)
+		nextPage = page.NextLink
+	}
+
+	return calendars, nil
+}
+
+// eventPath is the path of an event of the mailbox
+func (c *Calendar) eventPath(mailbox string, id string, withBody bool) string {
+	return c.mailboxPath(mailbox) + "/events/" + id + "?" + selectEventFields(withBody)
+}
+
+func (c *Calendar) getEvent(mailbox string, id string, withBody bool) (*Event, error) {
+	var event Event
+
+	body, err := c.getRemoteData(c.eventPath(mailbox, id, withBody))
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	if err := json.Unmarshal(body, &calData); err != nil {
-		return "", err
+	if err := decodeGraphResponse(body, &event); err != nil {
+		return nil, err
 	}
 
-	cal := ics.NewCalendar()
-	cal.SetMethod(ics.MethodRequest)
-	cal.SetCalscale("GREGORIAN")
-	cal.SetXWRTimezone("UTC")
+	if event.ID == "" {
+		return nil, errors.New("unable to retrieve event " + id)
+	}
 
-	for {
-		values := calData["value"].([]interface{})
-		for _, v := range values {
-			data := v.(map[string]interface{})
+	return &event, nil
+}
 
-			if !full && c.shouldSkip(data) {
-				continue
-			}
+func (c *Calendar) addEvent(cal *ics.Calendar, e *Event, opts *FeedOptions) (*ics.VEvent, error) {
+	event := c.handleBasicEventData(cal, e, opts.titles)
 
-			event := c.handleBasicEventData(cal, data)
+	// Feeds without titles only tell when the user is busy
+	if !opts.titles {
+		return event, nil
+	}
 
-			// Google only supports attachments that are hosted on Drive
-			var atts []*Attachment
-			if !google {
-				atts, err = c.handleAttachments(baseHost, data["id"].(string), data["hasAttachments"].(bool))
-				if err != nil {
-					return "", err
-				}
+	// Google only supports attachments that are hosted on Drive, and they
+	// are part of the description
+	var atts []*Attachment
+	if !opts.google && opts.bodies {
+		var ok bool
 
-				for _, v := range atts {
-					event.AddAttachmentURL(v.url, v.mimeType)
-				}
+		// Prefetched along with the rest of the feed, unless it was not known then
+		atts, ok = opts.attachments[e.ID]
+		if !ok && e.HasAttachments {
+			fetched, err := c.prefetchAttachments(opts.baseHost, opts.mailbox, []*Event{e})
+			if err != nil {
+				return nil, err
 			}
 
-			c.handleDescription(event, data, atts)
-			c.handleAttendees(event, data, google)
+			atts = fetched[e.ID]
+		}
+
+		for _, v := range atts {
+			event.AddAttachmentURL(v.url, v.mimeType)
 		}
+	}
+
+	if opts.bodies {
+		c.handleDescription(event, e, atts)
+	} else if link := e.joinURL(); link != "" {
+		event.SetURL(link)
+	}
+
+	c.handleAttendees(event, e, opts.google)
+
+	return event, nil
+}
 
-		if nextPage, ok := calData["@odata.nextLink"].(string); ok {
-			calData = make(map[string]interface{})
-			body, err := c.getRemoteData(nextPage)
+func (c *Calendar) getCalendar(opts *FeedOptions) (string, error) {
+	var windows []*timeRange
+	var values []*Event
+
+	loc := c.getTimeZone()
+	start, end := getSyncWindow(opts.past, opts.future)
+
+	for _, calendar := range opts.calendars {
+		state, err := c.ensureSynced(calendar, viper.GetDuration("delta_sync_interval"))
+		if err != nil {
+			return "", err
+		}
+
+		// Feeds are served from the local event store only, so ranges outside
+		// of what has been synced on every calendar are left out
+		if start.Before(state.start) {
+			start = state.start
+		}
+
+		if end.After(state.end) {
+			end = state.end
+		}
+	}
+
+	if start.Before(end) {
+		for _, calendar := range opts.calendars {
+			events, err := cachedData.getEvents(c.userName, calendar, start, end)
 			if err != nil {
 				return "", err
 			}
 
-			if err := json.Unmarshal(body, &calData); err != nil {
-				return "", err
+			values = append(values, events...)
+		}
+
+		sort.SliceStable(values, func(i, j int) bool {
+			return values[i].startTime().Before(values[j].startTime())
+		})
+
+		windows = append(windows, &timeRange{start: start, end: end})
+	}
+
+	cal := ics.NewCalendar()
+	cal.SetMethod(ics.MethodRequest)
+	cal.SetCalscale("GREGORIAN")
+	cal.SetXWRTimezone(loc.String())
+
+	if opts.recurring {
+		if err := c.addRecurringEvents(cal, values, windows, opts); err != nil {
+			return "", err
+		}
+	} else {
+		var events []*Event
+
+		for _, e := range values {
+			if !c.skipEvent(e, opts) {
+				events = append(events, e)
 			}
-		} else if !cacheRetrieved {
-			cacheRetrieved = true
+		}
 
-			startMonth, endMonth := getMonthAfterStartEndWeekDays()
-			userCache, err := cachedData.getUserCache(c.userName, startMonth, endMonth)
-			if err != nil {
-				log.Warn().
-					Err(err).
-					Str("user", c.userName).
-					Str("method", "getUserCache").
-					Send()
-				break
+		if !opts.google && opts.bodies {
+			var err error
+
+			if opts.attachments, err = c.prefetchAttachments(opts.baseHost, opts.mailbox, events); err != nil {
+				return "", err
 			}
+		}
 
-			calData["value"] = userCache
-		} else {
-			break
+		for _, e := range events {
+			if _, err := c.addEvent(cal, e, opts); err != nil {
+				return "", err
+			}
 		}
 	}
 
+	addTimezones(cal)
+
 	return string(cal.Serialize()), nil
 }
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestWeekendFilter(t *testing.T) {
+	friday := time.Date(2022, 1, 7, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		start   time.Time
+		length  time.Duration
+		weekend bool
+	}{
+		{"friday", friday.Add(9 * time.Hour), time.Hour, false},
+		{"friday night into saturday", friday.Add(23 * time.Hour), 2 * time.Hour, false},
+		{"saturday", friday.Add(34 * time.Hour), time.Hour, true},
+		{"whole weekend", friday.AddDate(0, 0, 1), 48 * time.Hour, true},
+		{"sunday night into monday", friday.Add(71 * time.Hour), 2 * time.Hour, false},
+	}
+
+	c := newCalendarHandler()
+
+	for _, tt := range tests {
+		e := newTestEvent("event", tt.name, tt.start, tt.length)
+
+		if got := isWeekend(e); got != tt.weekend {
+			t.Errorf("%s: weekend %v", tt.name, got)
+		}
+
+		if c.skipEvent(e, &FeedOptions{full: true, weekends: false}) != tt.weekend {
+			t.Errorf("%s: filtered %v without weekends", tt.name, !tt.weekend)
+		}
+
+		if c.skipEvent(e, &FeedOptions{full: true, weekends: true}) {
+			t.Errorf("%s: filtered with weekends", tt.name)
+		}
+	}
+}
+
+func TestWeekendOption(t *testing.T) {
+	setSyncWindow(t, "0d", "4w", "365d")
+
+	tests := []struct {
+		configured bool
+		params     string
+		want       bool
+	}{
+		{false, "", false},
+		{true, "", true},
+		{true, "weekends=false", false},
+		{false, "weekends=true", true},
+	}
+
+	for _, tt := range tests {
+		viper.Set("weekends", tt.configured)
+
+		params, _ := url.ParseQuery(tt.params)
+
+		opts, err := parseFeedOptions("http://localhost:5000", params)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if opts.weekends != tt.want {
+			t.Errorf("weekends %v with %q: got %v", tt.configured, tt.params, opts.weekends)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	headerETag        = "ETag"
+	headerIfNoneMatch = "If-None-Match"
+)
+
+// feedVersion tells a feed apart from its previous renders
+type feedVersion struct {
+	etag     string
+	modified time.Time
+
+	// user the feed belongs to, and when it was last served
+	user   string
+	served time.Time
+}
+
+// feedETag hashes the feed, leaving out the DTSTAMP of its events, stamped
+// anew on every render. Being weak, it holds whatever the encoding.
+func feedETag(body string) string {
+	h := sha256.New()
+
+	// Folded lines are hashed whole
+	body = strings.NewReplacer("\r\n ", "", "\r\n\t", "").Replace(body)
+
+	for _, line := range strings.Split(body, "\r\n") {
+		if strings.HasPrefix(line, "DTSTAMP") {
+			continue
+		}
+
+		io.WriteString(h, sortParameters(line)+"\r\n")
+	}
+
+	return `W/"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// sortParameters sorts the parameters of a content line, which the
+// properties of the events hold in no particular order
+func sortParameters(line string) string {
+	var parts []string
+
+	quoted := false
+	last := 0
+
+	for i, r := range line {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case quoted:
+		case r == ';':
+			parts = append(parts, line[last:i])
+			last = i + 1
+		case r == ':':
+			if len(parts) == 0 {
+				return line
+			}
+
+			params := append(parts[1:], line[last:i])
+			sort.Strings(params)
+
+			return parts[0] + ";" + strings.Join(params, ";") + line[i:]
+		}
+	}
+
+	return line
+}
+
+// notModified checks the conditional headers of the request against the
+// version of the feed about to be served, If-None-Match taking precedence
+func notModified(r *http.Request, etag string, modified time.Time) bool {
+	if match := r.Header.Get(headerIfNoneMatch); match != "" {
+		for _, candidate := range strings.Split(match, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	since, err := http.ParseTime(r.Header.Get(echo.HeaderIfModifiedSince))
+
+	return err == nil && !modified.After(since)
+}
+
+// acceptedEncoding returns the first of gzip and deflate the client accepts,
+// if any
+func acceptedEncoding(header string) string {
+	accepted := make(map[string]bool)
+
+	for _, item := range strings.Split(header, ",") {
+		params := strings.Split(item, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		accepted[name] = true
+
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if !strings.HasPrefix(param, "q=") {
+				continue
+			}
+
+			if q, err := strconv.ParseFloat(param[2:], 64); err == nil && q == 0 {
+				accepted[name] = false
+			}
+		}
+	}
+
+	for _, encoding := range []string{"gzip", "deflate"} {
+		if ok, listed := accepted[encoding]; ok || (!listed && accepted["*"]) {
+			return encoding
+		}
+	}
+
+	return ""
+}
+
+// compressed writes body with status, compressed the way the client accepts.
+// Callers set Vary on Accept-Encoding, as their 304s need it as well.
+func compressed(c echo.Context, status int, contentType string, body []byte) error {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+
+	switch acceptedEncoding(c.Request().Header.Get(echo.HeaderAcceptEncoding)) {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+		c.Response().Header().Set(echo.HeaderContentEncoding, "gzip")
+	case "deflate":
+		// Deflate in HTTP is the zlib format, not raw deflate
+		w = zlib.NewWriter(&buf)
+		c.Response().Header().Set(echo.HeaderContentEncoding, "deflate")
+	default:
+		return c.Blob(status, contentType, body)
+	}
+
+	if _, err := w.Write(body); err != nil {
+		return err
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return c.Blob(status, contentType, buf.Bytes())
+}
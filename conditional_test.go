@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestFeedETag(t *testing.T) {
+	feed := "BEGIN:VEVENT\r\nUID:busy\r\nDTSTAMP:20220103T090000Z\r\n" +
+		"ATTENDEE;ROLE=CHAIR;CN=\"Doe; Jane\";PARTSTAT=ACCEPTED:mailto:jane.doe@example.com\r\nEND:VEVENT\r\n"
+
+	// Renders only differ by their DTSTAMP, the order of the parameters and
+	// where long lines are folded
+	same := "BEGIN:VEVENT\r\nUID:busy\r\nDTSTAMP:20220103T091500Z\r\n" +
+		"ATTENDEE;PARTSTAT=ACCEPTED;CN=\"Doe; Jane\";ROLE=CHAIR:mailto:jane.d\r\n oe@example.com\r\nEND:VEVENT\r\n"
+
+	other := "BEGIN:VEVENT\r\nUID:busy\r\nDTSTAMP:20220103T090000Z\r\n" +
+		"ATTENDEE;ROLE=CHAIR;CN=\"Doe; Jane\";PARTSTAT=DECLINED:mailto:jane.doe@example.com\r\nEND:VEVENT\r\n"
+
+	if feedETag(feed) != feedETag(same) {
+		t.Error("ETag changed between renders")
+	}
+
+	if feedETag(feed) == feedETag(other) {
+		t.Error("ETag kept for another feed")
+	}
+}
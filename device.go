@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	deviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+	// Azure AD asks clients polling too often to wait this much longer
+	deviceSlowDown = 5 * time.Second
+)
+
+var errAuthorizationPending = errors.New("waiting for the user to enter the code")
+
+// devicePollInterval is how often to poll when Azure AD doesn't say
+var devicePollInterval = 5 * time.Second
+
+// deviceHTTPClient talks to the Azure AD device code endpoints
+var deviceHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// DeviceCode is the answer of Azure AD to a device authorization request
+type DeviceCode struct {
+	DeviceCode      string `json:"device_code"`
+	UserCode        string `json:"user_code"`
+	VerificationURI string `json:"verification_uri"`
+	ExpiresIn       int    `json:"expires_in"`
+	Interval        int    `json:"interval"`
+}
+
+// deviceTokenResponse is either a token or the reason there's none yet
+type deviceTokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	RefreshToken     string `json:"refresh_token"`
+	TokenType        string `json:"token_type"`
+	ExpiresIn        int    `json:"expires_in"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// deviceLogin is a device code login waiting for the user to enter the code
+type deviceLogin struct {
+	code     *DeviceCode
+	expiry   time.Time
+	interval time.Duration
+	lastPoll time.Time
+}
+
+// deviceCodeURL is the device authorization endpoint of the tenant, next to
+// its token endpoint
+func deviceCodeURL() string {
+	return strings.TrimSuffix(oauthEndpoint().TokenURL, "/token") + "/devicecode"
+}
+
+// postDeviceForm posts form to an Azure AD endpoint, decoding its JSON answer
+// into v, errors included
+func postDeviceForm(endpoint string, form url.Values, v interface{}) (int, error) {
+	resp, err := deviceHTTPClient.PostForm(endpoint, form)
+	if err != nil {
+		return 0, err
+	}
+
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return resp.StatusCode, fmt.Errorf("unexpected answer from %s: %w", endpoint, err)
+	}
+
+	return resp.StatusCode, nil
+}
+
+// usePublicClient makes the session refresh its tokens without the client
+// secret, as tokens obtained with a device code are issued to a public client
+func (c *Calendar) usePublicClient() {
+	c.publicClient = true
+	c.conf.ClientSecret = ""
+}
+
+// deviceCode returns the code of the device code login in progress, starting
+// a new one if there's none or the last one expired
+func (c *Calendar) deviceCode() (*DeviceCode, error) {
+	c.touch()
+
+	c.deviceMu.Lock()
+	defer c.deviceMu.Unlock()
+
+	if c.device != nil && time.Now().Before(c.device.expiry) {
+		return c.device.code, nil
+	}
+
+	var result struct {
+		DeviceCode
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+
+	status, err := postDeviceForm(deviceCodeURL(), url.Values{
+		"client_id": {c.conf.ClientID},
+		"scope":     {strings.Join(c.conf.Scopes, " ")},
+	}, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	if status != http.StatusOK || result.DeviceCode.DeviceCode == "" {
+		return nil, fmt.Errorf("device code request failed with %d: %s: %s", status, result.Error, result.ErrorDescription)
+	}
+
+	code := result.DeviceCode
+
+	interval := devicePollInterval
+	if code.Interval > 0 {
+		interval = time.Duration(code.Interval) * time.Second
+	}
+
+	// The user needs some time to enter the code anyway
+	c.device = &deviceLogin{
+		code:     &code,
+		expiry:   time.Now().Add(time.Duration(code.ExpiresIn) * time.Second),
+		interval: interval,
+		lastPoll: time.Now(),
+	}
+
+	return &code, nil
+}
+
+// pollDeviceLogin asks Azure AD whether the user entered the code yet, at most
+// once per interval, returning errAuthorizationPending until they do. The
+// login is over once it returns anything else.
+func (c *Calendar) pollDeviceLogin() (*oauth2.Token, error) {
+	var result deviceTokenResponse
+
+	c.deviceMu.Lock()
+	defer c.deviceMu.Unlock()
+
+	d := c.device
+	if d == nil {
+		return nil, errors.New("no device code login in progress")
+	}
+
+	if time.Now().After(d.expiry) {
+		c.device = nil
+		return nil, errors.New("the code expired before being entered")
+	}
+
+	if time.Since(d.lastPoll) < d.interval {
+		return nil, errAuthorizationPending
+	}
+
+	d.lastPoll = time.Now()
+
+	// Tokens of public clients are requested without the client secret
+	status, err := postDeviceForm(oauthEndpoint().TokenURL, url.Values{
+		"grant_type":  {deviceCodeGrantType},
+		"client_id":   {c.conf.ClientID},
+		"device_code": {d.code.DeviceCode},
+	}, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	switch result.Error {
+	case "":
+		c.device = nil
+
+		if status < 200 || status >= 300 || result.AccessToken == "" {
+			return nil, fmt.Errorf("device token request failed with %d, without a token", status)
+		}
+
+		return &oauth2.Token{
+			AccessToken:  result.AccessToken,
+			RefreshToken: result.RefreshToken,
+			TokenType:    result.TokenType,
+			Expiry:       time.Now().Add(time.Duration(result.ExpiresIn) * time.Second),
+		}, nil
+	case "authorization_pending":
+		return nil, errAuthorizationPending
+	case "slow_down":
+		d.interval += deviceSlowDown
+		return nil, errAuthorizationPending
+	default:
+		c.device = nil
+		return nil, fmt.Errorf("%s: %s", result.Error, result.ErrorDescription)
+	}
+}
+
+// pollInterval is how often the page of the device code login should reload
+func (c *Calendar) pollInterval() time.Duration {
+	c.deviceMu.Lock()
+	defer c.deviceMu.Unlock()
+
+	if c.device == nil {
+		return devicePollInterval
+	}
+
+	return c.device.interval
+}
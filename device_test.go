@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestPollDeviceLogin(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		pending bool
+		ok      bool
+	}{
+		{name: "token", status: http.StatusOK, body: `{"access_token":"access","refresh_token":"refresh","token_type":"Bearer","expires_in":3600}`, ok: true},
+		{name: "pending", status: http.StatusBadRequest, body: `{"error":"authorization_pending"}`, pending: true},
+		{name: "declined", status: http.StatusBadRequest, body: `{"error":"authorization_declined"}`},
+		{name: "failure without an error", status: http.StatusBadGateway, body: `{}`},
+		{name: "success without a token", status: http.StatusOK, body: `{"token_type":"Bearer"}`},
+	}
+
+	t.Cleanup(viper.Reset)
+
+	for _, tt := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(tt.status)
+			w.Write([]byte(tt.body))
+		}))
+
+		viper.Reset()
+		viper.Set("login_url", server.URL)
+
+		c := newCalendarHandler()
+		c.device = &deviceLogin{
+			code:   &DeviceCode{DeviceCode: "device"},
+			expiry: time.Now().Add(time.Minute),
+		}
+
+		tok, err := c.pollDeviceLogin()
+		server.Close()
+
+		switch {
+		case tt.ok:
+			if err != nil || tok.AccessToken != "access" {
+				t.Errorf("%s: got %v, %v", tt.name, tok, err)
+			}
+		case tt.pending:
+			if !errors.Is(err, errAuthorizationPending) || c.device == nil {
+				t.Errorf("%s: got %v, login over %v", tt.name, err, c.device == nil)
+			}
+		default:
+			if err == nil || errors.Is(err, errAuthorizationPending) || c.device != nil {
+				t.Errorf("%s: got %v, %v, login over %v", tt.name, tok, err, c.device == nil)
+			}
+		}
+	}
+}
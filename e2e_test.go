@@ -0,0 +1,1696 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"golang.org/x/oauth2"
+)
+
+var attachmentURL = regexp.MustCompile(`(?m)^ATTACH[^:]*:https://[^/]+(/attachment/\S+)`)
+
+// newTestEnv points the configuration and the global state of the service to
+// a fresh fake Graph and an in memory cache
+func newTestEnv(t *testing.T) *fakeGraph {
+	graph := newFakeGraph(t)
+
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+
+	viper.Set("client_id", fakeClientID)
+	viper.Set("secret", fakeClientSecret)
+	viper.Set("tenant", fakeTenant)
+	viper.Set("redirect_url", "http://localhost:5000/token")
+	viper.Set("graph_url", graph.graphURL())
+	viper.Set("login_url", graph.loginURL())
+	viper.Set("attachments_dir", t.TempDir())
+	viper.Set("week_start", "monday")
+	viper.Set("bodies", true)
+	viper.Set("sync_window.past", "0d")
+	viper.Set("sync_window.future", "2w")
+	viper.Set("sync_window.max", "4w")
+	viper.Set("delta_sync_interval", "1m")
+	viper.Set("feed_cache_ttl", "0s")
+	viper.Set("session_ttl", "1h")
+	viper.Set("inactive_after", "90d")
+
+	cachedData = newMemoryCache()
+	sessions = newSessionRegistry()
+	feedTokens = make(map[string]*FeedToken)
+
+	return graph
+}
+
+// anonymous is a client without cookies trusting every test server, these
+// being served over HTTPS
+var anonymous = &http.Client{
+	Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+}
+
+// newTestClient returns a client for the echo routes keeping the session
+// cookie and leaving redirects to the test. They're served over HTTPS, the
+// only way the cookie is sent back.
+func newTestClient(t *testing.T) (*httptest.Server, *http.Client) {
+	server := httptest.NewTLSServer(newServer())
+	t.Cleanup(server.Close)
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return server, &http.Client{
+		Transport: anonymous.Transport,
+		Jar:       jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func get(t *testing.T, client *http.Client, url string) (*http.Response, string) {
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp, string(body)
+}
+
+// signIn starts a login on "/" and signs in on the fake, returning the query
+// the browser is sent back to redirect_url with
+func signIn(t *testing.T, graph *fakeGraph, server *httptest.Server, client *http.Client) string {
+	resp, _ := get(t, client, server.URL+"/")
+	if resp.StatusCode != http.StatusTemporaryRedirect {
+		t.Fatalf("GET / answered %d", resp.StatusCode)
+	}
+
+	// Out of reach of scripts and of other sites' forms
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == cookieName && (!cookie.HttpOnly || !cookie.Secure || cookie.SameSite != http.SameSiteLaxMode) {
+			t.Errorf("session cookie %q", cookie.String())
+		}
+	}
+
+	location := resp.Header.Get("Location")
+	if !strings.HasPrefix(location, graph.loginURL()+"/"+fakeTenant+"/oauth2/v2.0/authorize?") {
+		t.Fatalf("redirected to %q", location)
+	}
+
+	resp, _ = get(t, client, location)
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("sign in answered %d", resp.StatusCode)
+	}
+
+	callback, err := neturl.Parse(resp.Header.Get("Location"))
+	if err != nil || callback.Path != "/token" {
+		t.Fatalf("sent back to %q", resp.Header.Get("Location"))
+	}
+
+	return callback.RawQuery
+}
+
+func login(t *testing.T, graph *fakeGraph, server *httptest.Server, client *http.Client) string {
+	resp, _ := get(t, client, server.URL+"/token?"+signIn(t, graph, server, client))
+	if resp.StatusCode != http.StatusTemporaryRedirect || resp.Header.Get("Location") != "/success" {
+		t.Fatalf("GET /token answered %d to %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+
+	resp, body := get(t, client, server.URL+"/success")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /success answered %d", resp.StatusCode)
+	}
+
+	feed := regexp.MustCompile(`https://\S+/calendar\?token=[\w-]+`).FindString(body)
+	if feed == "" {
+		t.Fatalf("no feed URL on %q", body)
+	}
+
+	return server.URL + feed[strings.Index(feed, "/calendar"):]
+}
+
+func feedToken(feed string) string {
+	return feed[strings.Index(feed, "token=")+len("token="):]
+}
+
+// getFeed returns the feed, unfolded
+func getFeed(t *testing.T, client *http.Client, url string) string {
+	resp, body := get(t, client, url)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s answered %d: %s", url, resp.StatusCode, body)
+	}
+
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/calendar") {
+		t.Errorf("feed served as %q", ct)
+	}
+
+	return strings.ReplaceAll(body, "\r\n ", "")
+}
+
+// waitForAttachment returns the contents of an attachment once downloaded in
+// the background
+func waitForAttachment(t *testing.T, client *http.Client, url string) string {
+	var body string
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		var resp *http.Response
+
+		resp, body = get(t, client, url)
+		if resp.StatusCode == http.StatusOK && body != "" {
+			break
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return body
+}
+
+func newTestEvent(id string, subject string, start time.Time, duration time.Duration) *Event {
+	return &Event{
+		ID:                   id,
+		Type:                 "singleInstance",
+		Subject:              subject,
+		CreatedDateTime:      "2022-01-03T09:00:00Z",
+		LastModifiedDateTime: "2022-01-03T09:00:00Z",
+		Start:                &DateTimeTimeZone{DateTime: start.UTC().Format(StartEndTimeParse), TimeZone: "UTC"},
+		End:                  &DateTimeTimeZone{DateTime: start.Add(duration).UTC().Format(StartEndTimeParse), TimeZone: "UTC"},
+		ShowAs:               "busy",
+		ResponseStatus:       &ResponseStatus{Response: "organizer"},
+		Organizer:            &Recipient{EmailAddress: &EmailAddress{Name: "Jane Doe", Address: "jane.doe@example.com"}},
+		Body:                 &ItemBody{ContentType: "html", Content: "<html><body><p>Agenda</p></body></html>"},
+		Location:             &Location{DisplayName: "Room 1"},
+	}
+}
+
+func assertEvents(t *testing.T, feed string, present []string, absent []string) {
+	t.Helper()
+
+	for _, id := range present {
+		if !strings.Contains(feed, "UID:"+id+"\r\n") {
+			t.Errorf("event %s missing from the feed", id)
+		}
+	}
+
+	for _, id := range absent {
+		if strings.Contains(feed, "UID:"+id+"\r\n") {
+			t.Errorf("event %s should not be on the feed", id)
+		}
+	}
+}
+
+func TestE2ELogin(t *testing.T) {
+	graph := newTestEnv(t)
+	server, client := newTestClient(t)
+
+	feed := login(t, graph, server, client)
+
+	token := feedToken(feed)
+	cal := sessions.get(token)
+	if cal == nil || !cal.isValid() || cal.userName != "jane.doe" || cal.displayName != "Jane Doe" {
+		t.Fatalf("unexpected session %+v", cal)
+	}
+
+	// Once logged in, the root only returns the feed URL
+	resp, body := get(t, client, server.URL+"/")
+	if resp.StatusCode != http.StatusOK || !strings.HasSuffix(body, "/calendar?token="+token) {
+		t.Errorf("GET / answered %d: %q", resp.StatusCode, body)
+	}
+}
+
+func TestE2ELoginState(t *testing.T) {
+	graph := newTestEnv(t)
+	server, victim := newTestClient(t)
+	_, attacker := newTestClient(t)
+
+	// A login completed in another browser doesn't log the victim in
+	stolen := signIn(t, graph, server, attacker)
+	signIn(t, graph, server, victim)
+
+	resp, body := get(t, victim, server.URL+"/token?"+stolen)
+	if resp.StatusCode != http.StatusBadRequest || !strings.Contains(body, "Start again") {
+		t.Errorf("GET /token with the state of another session answered %d: %q", resp.StatusCode, body)
+	}
+
+	// Neither does the code of another login with the session's own state
+	query := signIn(t, graph, server, victim)
+	callback, _ := neturl.ParseQuery(query)
+	forged, _ := neturl.ParseQuery(stolen)
+	forged.Set("state", callback.Get("state"))
+
+	resp, body = get(t, victim, server.URL+"/token?"+forged.Encode())
+	if resp.StatusCode != http.StatusBadRequest || !strings.Contains(body, "didn't accept") {
+		t.Errorf("GET /token with the code of another login answered %d: %q", resp.StatusCode, body)
+	}
+
+	for _, cal := range sessions.loggedIn() {
+		if cal.isValid() {
+			t.Fatalf("session of %s logged in", cal.userName)
+		}
+	}
+
+	// A login is only completed once
+	query = signIn(t, graph, server, victim)
+	if resp, _ = get(t, victim, server.URL+"/token?"+query); resp.StatusCode != http.StatusTemporaryRedirect {
+		t.Fatalf("GET /token answered %d", resp.StatusCode)
+	}
+
+	if resp, _ = get(t, victim, server.URL+"/token?"+query); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("GET /token replayed answered %d", resp.StatusCode)
+	}
+
+	// Redirects without a session, or refused by the user, get an explanation
+	resp, body = get(t, anonymous, server.URL+"/token?"+query)
+	if resp.StatusCode != http.StatusBadRequest || !strings.Contains(body, "wasn't started from this browser") {
+		t.Errorf("GET /token without a session answered %d: %q", resp.StatusCode, body)
+	}
+
+	resp, body = get(t, victim, server.URL+"/token?error=access_denied&error_description=The+user+declined&state=x")
+	if resp.StatusCode != http.StatusBadRequest || !strings.Contains(body, "The user declined") {
+		t.Errorf("GET /token refused answered %d: %q", resp.StatusCode, body)
+	}
+}
+
+func TestE2EUnknownToken(t *testing.T) {
+	newTestEnv(t)
+	server, client := newTestClient(t)
+
+	resp, _ := get(t, client, server.URL+"/calendar?token=unknown")
+	if resp.StatusCode != http.StatusTemporaryRedirect || resp.Header.Get("Location") != "/" {
+		t.Errorf("unknown token answered %d to %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+
+	resp, _ = get(t, client, server.URL+"/calendar?token=unknown&past=forever")
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid range answered %d", resp.StatusCode)
+	}
+}
+
+func TestE2EFeedPaging(t *testing.T) {
+	graph := newTestEnv(t)
+	server, client := newTestClient(t)
+
+	monday, _ := getCurrentWeek()
+	ids := []string{"mon", "tue", "wed", "thu", "fri"}
+	for i, id := range ids {
+		graph.putEvent(newTestEvent(id, "Meeting "+id, monday.AddDate(0, 0, i).Add(10*time.Hour), time.Hour))
+	}
+
+	feed := getFeed(t, client, login(t, graph, server, client))
+
+	assertEvents(t, feed, ids, nil)
+
+	if n := graph.countRequests("/me/calendarView/delta"); n != 3 {
+		t.Errorf("%d delta pages requested, expected 3", n)
+	}
+
+	for _, expected := range []string{"SUMMARY:Meeting wed", "LOCATION:Room 1", "DESCRIPTION:Agenda", "ORGANIZER;CN=Jane Doe:jane.doe@example.com"} {
+		if !strings.Contains(feed, expected) {
+			t.Errorf("%q missing from the feed", expected)
+		}
+	}
+}
+
+func TestE2EFiltering(t *testing.T) {
+	graph := newTestEnv(t)
+	server, client := newTestClient(t)
+
+	monday, _ := getCurrentWeek()
+
+	declined := newTestEvent("declined", "Declined", monday.Add(9*time.Hour), time.Hour)
+	declined.ResponseStatus = &ResponseStatus{Response: "declined"}
+
+	free := newTestEvent("free", "Free", monday.Add(11*time.Hour), time.Hour)
+	free.ShowAs = "free"
+
+	allDay := newTestEvent("allday", "Holiday", monday.AddDate(0, 0, 1), 24*time.Hour)
+	allDay.IsAllDay = true
+
+	// Nothing but the id, start and end
+	sparse := &Event{
+		ID:    "sparse",
+		Start: &DateTimeTimeZone{DateTime: monday.Add(14 * time.Hour).Format(StartEndTimeParse), TimeZone: "UTC"},
+		End:   &DateTimeTimeZone{DateTime: monday.Add(15 * time.Hour).Format(StartEndTimeParse), TimeZone: "UTC"},
+	}
+
+	graph.putEvent(newTestEvent("busy", "Busy", monday.Add(10*time.Hour), time.Hour))
+	graph.putEvent(newTestEvent("saturday", "Weekend", monday.AddDate(0, 0, 5).Add(10*time.Hour), time.Hour))
+	graph.putEvent(declined)
+	graph.putEvent(free)
+	graph.putEvent(allDay)
+	graph.putEvent(sparse)
+
+	url := login(t, graph, server, client)
+
+	assertEvents(t, getFeed(t, client, url), []string{"busy"}, []string{"saturday", "declined", "free", "allday", "sparse"})
+	assertEvents(t, getFeed(t, client, url+"&weekends=true"), []string{"busy", "saturday"}, []string{"declined", "free", "allday"})
+	assertEvents(t, getFeed(t, client, url+"&full=true"), []string{"busy", "declined", "free", "allday", "sparse"}, []string{"saturday"})
+}
+
+func TestE2EAttachments(t *testing.T) {
+	graph := newTestEnv(t)
+	server, client := newTestClient(t)
+
+	monday, _ := getCurrentWeek()
+
+	event := newTestEvent("withatts", "Review", monday.Add(10*time.Hour), time.Hour)
+	event.HasAttachments = true
+	graph.putEvent(event)
+
+	contents := map[string]string{
+		"Agenda notes.pdf": "agenda",
+		"slides.pptx":      "slides",
+		"budget.xlsx":      "budget",
+	}
+
+	for name, content := range contents {
+		graph.putAttachment(event.ID, name, "application/octet-stream", []byte(content))
+	}
+
+	url := login(t, graph, server, client)
+
+	if feed := getFeed(t, client, url+"&google=true"); strings.Contains(feed, "ATTACH") {
+		t.Errorf("attachments on a Google feed")
+	}
+
+	feed := getFeed(t, client, url)
+
+	links := attachmentURL.FindAllStringSubmatch(feed, -1)
+	if len(links) != len(contents) {
+		t.Fatalf("%d attachments on the feed, expected %d", len(links), len(contents))
+	}
+
+	for _, link := range links {
+		body := waitForAttachment(t, client, server.URL+link[1])
+
+		found := false
+		for _, content := range contents {
+			found = found || body == content
+		}
+
+		if !found {
+			t.Errorf("unexpected contents %q for %s", body, link[1])
+		}
+	}
+
+	if n := graph.countRequests("/me/events/withatts/attachments?"); n != 1 {
+		t.Errorf("%d follow up attachment pages requested, expected 1", n)
+	}
+
+	if n := graph.countRequests("/$batch"); n != 2 {
+		t.Errorf("%d batches sent, expected one for the list and one for the contents", n)
+	}
+}
+
+func TestE2EAttachmentNames(t *testing.T) {
+	graph := newTestEnv(t)
+	server, client := newTestClient(t)
+
+	monday, _ := getCurrentWeek()
+
+	event := newTestEvent("withatts", "Review", monday.Add(10*time.Hour), time.Hour)
+	event.HasAttachments = true
+	graph.putEvent(event)
+
+	// Names are chosen by whoever sent the event
+	graph.putAttachment(event.ID, "../../escaped.txt", "text/plain", []byte("escaped"))
+	graph.putAttachment(event.ID, `..\..\windows.txt`, "text/plain", []byte("windows"))
+
+	url := login(t, graph, server, client)
+
+	links := attachmentURL.FindAllStringSubmatch(getFeed(t, client, url), -1)
+	if len(links) != 2 {
+		t.Fatalf("%d attachments on the feed, expected 2", len(links))
+	}
+
+	for i, want := range []string{"escaped", "windows"} {
+		if !strings.HasSuffix(links[i][1], "/"+want+".txt") {
+			t.Errorf("attachment served from %s", links[i][1])
+		}
+
+		if body := waitForAttachment(t, client, server.URL+links[i][1]); body != want {
+			t.Errorf("%s served %q", links[i][1], body)
+		}
+	}
+
+	entries, err := os.ReadDir(viper.GetString("attachments_dir"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), event.ID+"-att-") {
+			t.Errorf("%s written to attachments_dir", entry.Name())
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(viper.GetString("attachments_dir"), "..", "escaped.txt")); err == nil {
+		t.Error("attachment written outside of attachments_dir")
+	}
+}
+
+func TestE2EAttachmentBatches(t *testing.T) {
+	graph := newTestEnv(t)
+	server, client := newTestClient(t)
+
+	monday, _ := getCurrentWeek()
+
+	for i := 0; i < 25; i++ {
+		id := fmt.Sprintf("event-%d", i)
+
+		event := newTestEvent(id, "Review", monday.AddDate(0, 0, i%5).Add(time.Duration(8+i/5)*time.Hour), 30*time.Minute)
+		event.HasAttachments = true
+		graph.putEvent(event)
+		graph.putAttachment(id, id+".txt", "text/plain", []byte(id))
+	}
+
+	url := login(t, graph, server, client)
+
+	// Two of the lists fail within the first batch
+	graph.failBatches(2)
+
+	links := attachmentURL.FindAllStringSubmatch(getFeed(t, client, url), -1)
+	if len(links) != 25 {
+		t.Fatalf("%d attachments on the feed, expected 25", len(links))
+	}
+
+	for _, link := range links {
+		id := strings.TrimSuffix(link[1][strings.LastIndex(link[1], "/")+1:], ".txt")
+		if body := waitForAttachment(t, client, server.URL+link[1]); body != id {
+			t.Errorf("unexpected contents %q for %s", body, link[1])
+		}
+	}
+
+	if n := graph.countRequests("/$batch"); n != 4 {
+		t.Errorf("%d batches sent, expected two for the lists and two for the contents", n)
+	}
+
+	if n := graph.countRequests("/me/events/"); n != 2 {
+		t.Errorf("%d attachment lists requested alone, expected 2", n)
+	}
+}
+
+func TestE2EIncrementalSync(t *testing.T) {
+	graph := newTestEnv(t)
+	server, client := newTestClient(t)
+
+	viper.Set("delta_sync_interval", "0s")
+
+	monday, _ := getCurrentWeek()
+	graph.putEvent(newTestEvent("moved", "Standup", monday.Add(9*time.Hour), time.Hour))
+	graph.putEvent(newTestEvent("cancelled", "Retro", monday.Add(15*time.Hour), time.Hour))
+
+	url := login(t, graph, server, client)
+	assertEvents(t, getFeed(t, client, url), []string{"moved", "cancelled"}, nil)
+
+	graph.putEvent(newTestEvent("moved", "Standup (moved)", monday.AddDate(0, 0, 1).Add(9*time.Hour), time.Hour))
+	graph.removeEvent("cancelled")
+	graph.putEvent(newTestEvent("added", "Planning", monday.AddDate(0, 0, 2).Add(9*time.Hour), time.Hour))
+
+	feed := getFeed(t, client, url)
+	assertEvents(t, feed, []string{"moved", "added"}, []string{"cancelled"})
+
+	if !strings.Contains(feed, "SUMMARY:Standup (moved)") {
+		t.Error("updated event not refreshed")
+	}
+
+	if n := graph.countRequests("/me/calendarView/delta?$deltatoken="); n == 0 {
+		t.Error("changes not fetched through the deltaLink")
+	}
+}
+
+func TestE2EMailboxTimeZone(t *testing.T) {
+	graph := newTestEnv(t)
+	server, client := newTestClient(t)
+
+	graph.timeZone = "W. Europe Standard Time"
+
+	if feed := getFeed(t, client, login(t, graph, server, client)); !strings.Contains(feed, "X-WR-TIMEZONE:Europe/Berlin") {
+		t.Error("mailbox time zone not used for the feed")
+	}
+}
+
+func TestE2EThrottling(t *testing.T) {
+	graph := newTestEnv(t)
+	server, client := newTestClient(t)
+
+	monday, _ := getCurrentWeek()
+	graph.putEvent(newTestEvent("busy", "Busy", monday.Add(10*time.Hour), time.Hour))
+
+	url := login(t, graph, server, client)
+
+	graph.throttle(3)
+
+	assertEvents(t, getFeed(t, client, url), []string{"busy"}, nil)
+
+	if n := graph.countRequests("/me/mailboxSettings/timeZone"); n != 4 {
+		t.Errorf("%d time zone requests, expected 3 throttled and 1 served", n)
+	}
+}
+
+func TestE2ESessionRevoked(t *testing.T) {
+	graph := newTestEnv(t)
+	server, client := newTestClient(t)
+
+	viper.Set("delta_sync_interval", "0s")
+
+	monday, _ := getCurrentWeek()
+	graph.putEvent(newTestEvent("busy", "Busy", monday.Add(10*time.Hour), time.Hour))
+
+	url := login(t, graph, server, client)
+	assertEvents(t, getFeed(t, client, url), []string{"busy"}, nil)
+
+	graph.revokeTokens()
+
+	resp, body := get(t, client, url)
+	if resp.StatusCode != http.StatusUnauthorized || !strings.Contains(body, "Log in again") {
+		t.Fatalf("feed with revoked credentials answered %d: %q", resp.StatusCode, body)
+	}
+
+	if sessions.get(feedToken(url)).isValid() {
+		t.Error("session still valid after its credentials were rejected")
+	}
+
+	// Logging in again brings the same feed back
+	if relogin := login(t, graph, server, client); relogin != url {
+		t.Errorf("feed moved from %s to %s", url, relogin)
+	}
+
+	assertEvents(t, getFeed(t, client, url), []string{"busy"}, nil)
+}
+
+func TestE2ERefreshRejected(t *testing.T) {
+	graph := newTestEnv(t)
+	server, client := newTestClient(t)
+
+	cal := newCalendarHandlerFromToken("jane.doe", &oauth2.Token{
+		AccessToken:  "fake-access-0",
+		RefreshToken: "fake-refresh-0",
+		TokenType:    "Bearer",
+		Expiry:       time.Now().Add(-time.Minute),
+	}, false)
+	sessions.register("jane.doe", "token", cal)
+
+	graph.revokeTokens()
+
+	resp, _ := get(t, client, server.URL+"/calendar?token=token")
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("feed with a rejected refresh token answered %d", resp.StatusCode)
+	}
+
+	if cal.isValid() {
+		t.Error("session still valid after its refresh token was rejected")
+	}
+
+	if n := graph.countRequests("/"); n != 0 {
+		t.Errorf("%d requests made to Graph without a valid access token", n)
+	}
+}
+
+func TestE2ETokenEndpointUnavailable(t *testing.T) {
+	graph := newTestEnv(t)
+	server, client := newTestClient(t)
+
+	backoff := graphRetryBackoff
+	graphRetryBackoff = time.Millisecond
+	t.Cleanup(func() { graphRetryBackoff = backoff })
+
+	monday, _ := getCurrentWeek()
+	graph.putEvent(newTestEvent("busy", "Busy", monday.Add(10*time.Hour), time.Hour))
+
+	expired := &oauth2.Token{
+		AccessToken:  "fake-access-0",
+		RefreshToken: "fake-refresh-0",
+		TokenType:    "Bearer",
+		Expiry:       time.Now().Add(-time.Minute),
+	}
+
+	cal := newCalendarHandlerFromToken("jane.doe", expired, false)
+	cachedData.storeToken("jane.doe", "token", expired, false)
+	sessions.register("jane.doe", "token", cal)
+
+	// An outage outlasting the retries fails the feed, without logging out
+	graph.failTokens(100)
+
+	resp, _ := get(t, client, server.URL+"/calendar?token=token")
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("feed answered %d while Azure AD was down", resp.StatusCode)
+	}
+
+	if !cal.isValid() {
+		t.Fatal("session invalidated by an unavailable token endpoint")
+	}
+
+	// Shorter ones are retried, and the next sync recovers the feed
+	graph.failTokens(2)
+	refreshSessions()
+
+	if !cal.isValid() || sessions.get("token") != cal {
+		t.Fatal("session dropped by a sync during an outage")
+	}
+
+	assertEvents(t, getFeed(t, client, server.URL+"/calendar?token=token"), []string{"busy"}, nil)
+}
+
+// loginWithDevice logs in through /device, entering the code shown on the way
+func loginWithDevice(t *testing.T, graph *fakeGraph, server *httptest.Server, client *http.Client) string {
+	resp, body := get(t, client, server.URL+"/device")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Refresh") == "" {
+		t.Fatalf("GET /device answered %d: %q", resp.StatusCode, body)
+	}
+
+	code := regexp.MustCompile(`enter the code (\w+)`).FindStringSubmatch(body)
+	if code == nil || !strings.Contains(body, "https://microsoft.com/devicelogin") {
+		t.Fatalf("no code on %q", body)
+	}
+
+	// Reloading before the code is entered shows the same one
+	if resp, body = get(t, client, server.URL+"/device"); resp.StatusCode != http.StatusOK || !strings.Contains(body, code[1]) {
+		t.Fatalf("GET /device answered %d: %q", resp.StatusCode, body)
+	}
+
+	graph.approveDevice(code[1])
+
+	resp, _ = get(t, client, server.URL+"/device")
+	if resp.StatusCode != http.StatusTemporaryRedirect || resp.Header.Get("Location") != "/success" {
+		t.Fatalf("GET /device answered %d to %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+
+	resp, body = get(t, client, server.URL+"/success")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /success answered %d", resp.StatusCode)
+	}
+
+	feed := regexp.MustCompile(`https://\S+/calendar\?token=[\w-]+`).FindString(body)
+	if feed == "" {
+		t.Fatalf("no feed URL on %q", body)
+	}
+
+	return server.URL + feed[strings.Index(feed, "/calendar"):]
+}
+
+func TestE2EDeviceLogin(t *testing.T) {
+	graph := newTestEnv(t)
+	server, client := newTestClient(t)
+
+	interval := devicePollInterval
+	devicePollInterval = 0
+	t.Cleanup(func() { devicePollInterval = interval })
+
+	monday, _ := getCurrentWeek()
+	graph.putEvent(newTestEvent("busy", "Busy", monday.Add(10*time.Hour), time.Hour))
+
+	url := loginWithDevice(t, graph, server, client)
+	assertEvents(t, getFeed(t, client, url), []string{"busy"}, nil)
+
+	stored, err := cachedData.loadUserTokens()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := stored["jane.doe"]
+	if user == nil || !user.publicClient || user.oauthToken == nil {
+		t.Fatalf("stored %+v", user)
+	}
+
+	// After a restart, the session refreshes its tokens as a public client
+	sessions = newSessionRegistry()
+	sessions.register("jane.doe", user.token, newCalendarHandlerFromToken("jane.doe", &oauth2.Token{
+		AccessToken:  user.oauthToken.AccessToken,
+		RefreshToken: user.oauthToken.RefreshToken,
+		TokenType:    "Bearer",
+		Expiry:       time.Now().Add(-time.Minute),
+	}, user.publicClient))
+
+	// Syncing again makes the refresh happen
+	viper.Set("delta_sync_interval", "0s")
+	graph.putEvent(newTestEvent("later", "Later", monday.Add(14*time.Hour), time.Hour))
+
+	assertEvents(t, getFeed(t, client, url), []string{"busy", "later"}, nil)
+
+	// Logging in again from elsewhere brings the same feed back
+	_, other := newTestClient(t)
+	if relogin := loginWithDevice(t, graph, server, other); relogin != url {
+		t.Errorf("feed moved from %s to %s", url, relogin)
+	}
+}
+
+func TestE2ELogout(t *testing.T) {
+	graph := newTestEnv(t)
+	server, client := newTestClient(t)
+
+	url := login(t, graph, server, client)
+
+	// Links and other sites' forms can't log anyone out
+	if resp, _ := get(t, client, server.URL+"/logout"); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET /logout answered %d", resp.StatusCode)
+	}
+
+	resp, err := client.PostForm(server.URL+"/logout", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("POST /logout without a token answered %d", resp.StatusCode)
+	}
+
+	resp, err = client.PostForm(server.URL+"/logout", neturl.Values{"token": {feedToken(url)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "Logged out") {
+		t.Fatalf("POST /logout answered %d: %q", resp.StatusCode, body)
+	}
+
+	if resp, _ = get(t, client, url); resp.StatusCode == http.StatusOK {
+		t.Error("feed still served after logging out")
+	}
+
+	stored, _ := cachedData.loadUserTokens()
+	if user := stored["jane.doe"]; user == nil || user.oauthToken != nil || user.token != feedToken(url) {
+		t.Errorf("stored %+v after logging out", user)
+	}
+
+	// The cookie is gone, and logging in again brings the same feed back
+	if relogin := login(t, graph, server, client); relogin != url {
+		t.Errorf("feed moved from %s to %s", url, relogin)
+	}
+}
+
+func TestE2ERevoke(t *testing.T) {
+	graph := newTestEnv(t)
+	server, client := newTestClient(t)
+
+	viper.Set("notification_url", "https://example.com/notifications")
+
+	monday, _ := getCurrentWeek()
+
+	event := newTestEvent("withatts", "Review", monday.Add(10*time.Hour), time.Hour)
+	event.HasAttachments = true
+	graph.putEvent(event)
+	graph.putAttachment(event.ID, "notes.txt", "text/plain", []byte("notes"))
+
+	url := login(t, graph, server, client)
+
+	links := attachmentURL.FindAllStringSubmatch(getFeed(t, client, url), -1)
+	if len(links) != 1 || waitForAttachment(t, client, server.URL+links[0][1]) != "notes" {
+		t.Fatalf("attachments %v", links)
+	}
+
+	if err := sessions.get(feedToken(url)).ensureSubscription(); err != nil || graph.countSubscriptions() != 1 {
+		t.Fatalf("not subscribed: %v", err)
+	}
+
+	// The session cookie alone, as other sites' forms would send it, isn't
+	// enough
+	resp, err := client.PostForm(server.URL+"/revoke", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound || sessions.get(feedToken(url)) == nil {
+		t.Fatalf("POST /revoke without a token answered %d", resp.StatusCode)
+	}
+
+	// Whoever has the feed URL can revoke it
+	revoke := neturl.Values{"token": {feedToken(url)}, "attachments": {"true"}}
+
+	if status, _ := postForm(t, server.URL+"/revoke", revoke); status != http.StatusOK {
+		t.Fatalf("POST /revoke answered %d", status)
+	}
+
+	if status, _ := postForm(t, server.URL+"/revoke", revoke); status != http.StatusNotFound {
+		t.Errorf("POST /revoke again answered %d", status)
+	}
+
+	if resp, _ := get(t, client, url); resp.StatusCode == http.StatusOK {
+		t.Error("feed still served after being revoked")
+	}
+
+	renderedFeeds.mu.Lock()
+	for key, v := range renderedFeeds.versions {
+		if v.user == "jane.doe" {
+			t.Errorf("version of %q kept", key)
+		}
+	}
+	renderedFeeds.mu.Unlock()
+
+	stored, _ := cachedData.loadUserTokens()
+	calendars, _ := cachedData.getSyncedCalendars("jane.doe")
+	if stored["jane.doe"] != nil || len(calendars) != 0 {
+		t.Errorf("kept %+v and calendars %v", stored["jane.doe"], calendars)
+	}
+
+	if n := graph.countSubscriptions(); n != 0 {
+		t.Errorf("%d subscriptions left", n)
+	}
+
+	if entries, _ := os.ReadDir(viper.GetString("attachments_dir")); len(entries) != 0 {
+		t.Errorf("%d attachments left", len(entries))
+	}
+
+	// Logging in again gets a new feed
+	if relogin := login(t, graph, server, client); relogin == url {
+		t.Error("revoked feed URL handed out again")
+	}
+}
+
+func TestE2ERevokedElsewhere(t *testing.T) {
+	graph := newTestEnv(t)
+	server, client := newTestClient(t)
+
+	url := login(t, graph, server, client)
+
+	// As done by the revoke command, from another process
+	if err := cachedData.removeUser("jane.doe"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dropRevokedSessions(); err != nil {
+		t.Fatal(err)
+	}
+
+	if resp, _ := get(t, client, url); resp.StatusCode == http.StatusOK {
+		t.Error("feed still served after being revoked")
+	}
+}
+
+func TestE2EConcurrentSessions(t *testing.T) {
+	graph := newTestEnv(t)
+	server, client := newTestClient(t)
+
+	viper.Set("delta_sync_interval", "0s")
+
+	monday, _ := getCurrentWeek()
+	graph.putEvent(newTestEvent("busy", "Busy", monday.Add(10*time.Hour), time.Hour))
+
+	url := login(t, graph, server, client)
+
+	var others []*http.Client
+	for i := 0; i < 4; i++ {
+		_, other := newTestClient(t)
+		others = append(others, other)
+	}
+
+	var wg sync.WaitGroup
+	relogins := make(chan string, len(others))
+
+	// Logging in again from other browsers while the feed is fetched and
+	// refreshed keeps serving it, from a single session
+	for _, other := range others {
+		wg.Add(1)
+		go func(other *http.Client) {
+			defer wg.Done()
+			relogins <- login(t, graph, server, other)
+		}(other)
+	}
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 5; j++ {
+				resp, body := get(t, client, url)
+				if resp.StatusCode != http.StatusOK || !strings.Contains(body, "UID:busy\r\n") {
+					t.Errorf("feed answered %d: %q", resp.StatusCode, body)
+				}
+			}
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for j := 0; j < 5; j++ {
+			refreshSessions()
+		}
+	}()
+
+	wg.Wait()
+	close(relogins)
+
+	for relogin := range relogins {
+		if relogin != url {
+			t.Errorf("feed moved from %s to %s", url, relogin)
+		}
+	}
+
+	if n := len(sessions.loggedIn()); n != 1 {
+		t.Errorf("%d sessions for a single user", n)
+	}
+}
+
+func TestE2EExpiredSessions(t *testing.T) {
+	graph := newTestEnv(t)
+	server, client := newTestClient(t)
+	_, abandoned := newTestClient(t)
+
+	viper.Set("session_ttl", "1ms")
+	viper.Set("delta_sync_interval", "0s")
+
+	url := login(t, graph, server, client)
+
+	// A login abandoned on the sign in page, and a session whose credentials
+	// were rejected
+	query := signIn(t, graph, server, abandoned)
+
+	graph.revokeTokens()
+
+	if resp, _ := get(t, client, url); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("feed with revoked credentials answered %d", resp.StatusCode)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	if err := expireSessions(); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, body := get(t, abandoned, server.URL+"/token?"+query)
+	if resp.StatusCode != http.StatusBadRequest || !strings.Contains(body, "wasn't started") {
+		t.Errorf("GET /token of an expired login answered %d: %q", resp.StatusCode, body)
+	}
+
+	if sessions.get(feedToken(url)) != nil {
+		t.Error("session with rejected credentials kept")
+	}
+
+	// Only the session goes, the stored credentials are left to logging in
+	// again
+	stored, _ := cachedData.loadUserTokens()
+	if user := stored["jane.doe"]; user == nil || user.oauthToken == nil || user.token != feedToken(url) {
+		t.Errorf("stored %+v after expiring", user)
+	}
+
+	// Logging in again brings the same feed back
+	if relogin := login(t, graph, server, client); relogin != url {
+		t.Errorf("feed moved from %s to %s", url, relogin)
+	}
+}
+
+func TestE2EInactiveUsers(t *testing.T) {
+	graph := newTestEnv(t)
+	server, client := newTestClient(t)
+
+	viper.Set("inactive_after", "30d")
+
+	url := login(t, graph, server, client)
+	getFeed(t, client, url)
+
+	// The last fetch is stored, and restored after a restart
+	lastFetch := time.Now().AddDate(0, 0, -31).UTC()
+	if err := cachedData.touchUser("jane.doe", lastFetch); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, _ := cachedData.loadUserTokens()
+	user := stored["jane.doe"]
+	if user == nil || !user.lastUpdated.Equal(lastFetch) {
+		t.Fatalf("stored %+v", user)
+	}
+
+	cal := newCalendarHandlerFromToken("jane.doe", user.oauthToken, user.publicClient)
+	cal.restoreActivity(user.lastUpdated)
+
+	sessions = newSessionRegistry()
+	sessions.register("jane.doe", user.token, cal)
+
+	// Inactive users are only reported by default, once
+	for i := 0; i < 2; i++ {
+		if err := expireSessions(); err != nil {
+			t.Fatal(err)
+		}
+
+		cal.activityMu.Lock()
+		reported := cal.reported
+		cal.activityMu.Unlock()
+
+		if !reported {
+			t.Errorf("pass %d: inactive user not reported", i)
+		}
+	}
+
+	if sessions.get(feedToken(url)) != cal || !cal.isValid() {
+		t.Fatal("inactive user logged out")
+	}
+
+	viper.Set("prune_inactive", true)
+
+	if err := expireSessions(); err != nil {
+		t.Fatal(err)
+	}
+
+	if resp, _ := get(t, client, url); resp.StatusCode == http.StatusOK {
+		t.Error("feed of an inactive user still served")
+	}
+
+	stored, _ = cachedData.loadUserTokens()
+	if user := stored["jane.doe"]; user == nil || user.oauthToken != nil {
+		t.Errorf("stored %+v after pruning", user)
+	}
+
+	// Fetching the feed keeps users active, as stored
+	relogin := login(t, graph, server, client)
+	getFeed(t, client, relogin)
+
+	stored, _ = cachedData.loadUserTokens()
+	if user := stored["jane.doe"]; user == nil || time.Since(user.lastUpdated) > time.Minute {
+		t.Errorf("stored %+v after fetching the feed", user)
+	}
+
+	if err := expireSessions(); err != nil {
+		t.Fatal(err)
+	}
+
+	if relogin != url || sessions.get(feedToken(url)) == nil {
+		t.Errorf("feed moved from %s to %s, or pruned", url, relogin)
+	}
+}
+
+func TestE2EFeedCache(t *testing.T) {
+	graph := newTestEnv(t)
+	server, client := newTestClient(t)
+
+	viper.Set("delta_sync_interval", "0s")
+	viper.Set("feed_cache_ttl", "1h")
+
+	monday, _ := getCurrentWeek()
+	graph.putEvent(newTestEvent("busy", "Busy", monday.Add(10*time.Hour), time.Hour))
+
+	url := login(t, graph, server, client)
+	assertEvents(t, getFeed(t, client, url), []string{"busy"}, nil)
+
+	// Polls within the TTL are served the same render
+	graph.putEvent(newTestEvent("later", "Later", monday.Add(14*time.Hour), time.Hour))
+	requests := graph.countRequests("/")
+
+	assertEvents(t, getFeed(t, client, url), []string{"busy"}, []string{"later"})
+
+	if n := graph.countRequests("/"); n != requests {
+		t.Errorf("%d requests made to Graph for a cached feed", n-requests)
+	}
+
+	// Unless they ask for other options
+	assertEvents(t, getFeed(t, client, url+"&bodies=false"), []string{"busy", "later"}, nil)
+
+	// Or the events of the user changed since
+	renderedFeeds.forget("jane.doe")
+	assertEvents(t, getFeed(t, client, url), []string{"busy", "later"}, nil)
+}
+
+// getWithHeaders is get, sending headers along
+func getWithHeaders(t *testing.T, client *http.Client, url string, headers map[string]string) (*http.Response, []byte) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp, body
+}
+
+func TestE2EConditionalFeed(t *testing.T) {
+	graph := newTestEnv(t)
+	server, client := newTestClient(t)
+
+	viper.Set("delta_sync_interval", "0s")
+
+	monday, _ := getCurrentWeek()
+	graph.putEvent(newTestEvent("busy", "Busy", monday.Add(10*time.Hour), time.Hour))
+
+	url := login(t, graph, server, client)
+
+	resp, _ := get(t, client, url)
+	etag, modified := resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	if etag == "" || modified == "" {
+		t.Fatalf("served without validators: %v", resp.Header)
+	}
+
+	for _, headers := range []map[string]string{
+		{"If-None-Match": etag},
+		{"If-None-Match": `"other", ` + etag},
+		{"If-Modified-Since": modified},
+	} {
+		resp, body := getWithHeaders(t, client, url, headers)
+		if resp.StatusCode != http.StatusNotModified || len(body) != 0 || resp.Header.Get("ETag") != etag {
+			t.Errorf("GET with %v answered %d with %d bytes", headers, resp.StatusCode, len(body))
+		}
+
+		// Caches keep a single entry whatever the encoding otherwise
+		if vary := resp.Header.Get("Vary"); vary != "Accept-Encoding" {
+			t.Errorf("GET with %v answered Vary %q", headers, vary)
+		}
+	}
+
+	for _, headers := range []map[string]string{
+		{"If-None-Match": `W/"other"`},
+		{"If-Modified-Since": "Mon, 03 Jan 2022 09:00:00 GMT"},
+	} {
+		if resp, _ := getWithHeaders(t, client, url, headers); resp.StatusCode != http.StatusOK {
+			t.Errorf("GET with %v answered %d", headers, resp.StatusCode)
+		}
+	}
+
+	// A new event makes a new version
+	graph.putEvent(newTestEvent("later", "Later", monday.Add(14*time.Hour), time.Hour))
+
+	resp, _ = getWithHeaders(t, client, url, map[string]string{"If-None-Match": etag})
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") == etag {
+		t.Errorf("changed feed answered %d with ETag %s", resp.StatusCode, resp.Header.Get("ETag"))
+	}
+}
+
+func TestE2ECompressedFeed(t *testing.T) {
+	graph := newTestEnv(t)
+	server, client := newTestClient(t)
+
+	url := login(t, graph, server, client)
+
+	for accept, encoding := range map[string]string{
+		"gzip":                  "gzip",
+		"deflate, gzip;q=0":     "deflate",
+		"br, *":                 "gzip",
+		"gzip;q=0, deflate;q=0": "",
+		"":                      "",
+	} {
+		resp, body := getWithHeaders(t, client, url, map[string]string{"Accept-Encoding": accept})
+		if got := resp.Header.Get("Content-Encoding"); got != encoding {
+			t.Errorf("served %q for %q", got, accept)
+			continue
+		}
+
+		if vary := resp.Header.Values("Vary"); len(vary) != 1 || vary[0] != "Accept-Encoding" {
+			t.Errorf("served Vary %q for %q", vary, accept)
+		}
+
+		var r io.Reader = bytes.NewReader(body)
+
+		switch encoding {
+		case "gzip":
+			gz, err := gzip.NewReader(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r = gz
+		case "deflate":
+			zr, err := zlib.NewReader(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r = zr
+		}
+
+		feed, err := io.ReadAll(r)
+		if err != nil || !strings.HasPrefix(string(feed), "BEGIN:VCALENDAR") {
+			t.Errorf("feed served for %q: %v %q", accept, err, feed)
+		}
+	}
+}
+
+// postForm posts values to url, returning the status and the body
+func postForm(t *testing.T, url string, values neturl.Values) (int, string) {
+	resp, err := anonymous.PostForm(url, values)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp.StatusCode, string(body)
+}
+
+func TestE2ENamedFeeds(t *testing.T) {
+	graph := newTestEnv(t)
+	server, client := newTestClient(t)
+
+	monday, _ := getCurrentWeek()
+	graph.putEvent(newTestEvent("review", "Salary review", monday.Add(10*time.Hour), time.Hour))
+
+	free := newTestEvent("free", "Gym", monday.Add(12*time.Hour), time.Hour)
+	free.ShowAs = "free"
+	graph.putEvent(free)
+
+	url := login(t, graph, server, client)
+
+	status, body := postForm(t, server.URL+"/feeds", neturl.Values{"token": {feedToken(url)}, "name": {"Partner"}, "titles": {"false"}})
+	named := regexp.MustCompile(`https://\S+/calendar\?token=[\w-]+`).FindString(body)
+	if status != http.StatusCreated || named == "" {
+		t.Fatalf("POST /feeds answered %d: %q", status, body)
+	}
+
+	named = server.URL + named[strings.Index(named, "/calendar"):]
+
+	// The options stored with the feed win over the ones on its URL
+	feed := getFeed(t, client, named+"&titles=true&full=true")
+	assertEvents(t, feed, []string{"review"}, []string{"free"})
+
+	if strings.Contains(feed, "Salary") || strings.Contains(feed, "Room 1") || strings.Contains(feed, "Agenda") || !strings.Contains(feed, "SUMMARY:"+busySummary) {
+		t.Errorf("details on a feed without titles: %q", feed)
+	}
+
+	// The feed of the user still takes the options on its URL
+	assertEvents(t, getFeed(t, client, url+"&full=true"), []string{"review", "free"}, nil)
+
+	feeds, _ := cachedData.loadFeedTokens()
+	if len(feeds) != 1 || feeds[0].name != "Partner" || feeds[0].lastUsed.IsZero() {
+		t.Errorf("stored %+v", feeds)
+	}
+
+	resp, body := get(t, client, server.URL+"/feeds")
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, "Partner (titles=false, last used") || !strings.Contains(body, feedToken(named)) {
+		t.Errorf("GET /feeds answered %d: %q", resp.StatusCode, body)
+	}
+
+	// Named feeds can't mint others, and options are checked upfront
+	if status, _ := postForm(t, server.URL+"/feeds", neturl.Values{"token": {feedToken(named)}, "name": {"Other"}}); status != http.StatusNotFound {
+		t.Errorf("POST /feeds with a named feed token answered %d", status)
+	}
+
+	for _, values := range []neturl.Values{
+		{"name": {"Other"}, "private": {"true"}},
+		{"name": {"Other"}, "past": {"forever"}},
+		{"name": {" "}},
+	} {
+		values.Set("token", feedToken(url))
+		if status, body := postForm(t, server.URL+"/feeds", values); status != http.StatusBadRequest {
+			t.Errorf("POST /feeds with %v answered %d: %q", values, status, body)
+		}
+	}
+
+	// Options that can't be read back fail the feed, not falling back on the
+	// ones on its URL
+	feedTokensMu.Lock()
+	stored := feedTokens[feedToken(named)].options
+	feedTokens[feedToken(named)].options = "titles=%zz"
+	feedTokensMu.Unlock()
+
+	if resp, _ := get(t, client, named+"&titles=true"); resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("feed with unreadable options answered %d", resp.StatusCode)
+	}
+
+	feedTokensMu.Lock()
+	feedTokens[feedToken(named)].options = stored
+	feedTokensMu.Unlock()
+
+	// Revoking a named feed leaves the others alone
+	if status, _ := postForm(t, server.URL+"/revoke", neturl.Values{"token": {feedToken(named)}}); status != http.StatusOK {
+		t.Fatalf("POST /revoke answered %d", status)
+	}
+
+	if resp, _ := get(t, client, named); resp.StatusCode == http.StatusOK {
+		t.Error("named feed still served after being revoked")
+	}
+
+	assertEvents(t, getFeed(t, client, url), []string{"review"}, nil)
+
+	// Revoking the user takes their named feeds along
+	status, body = postForm(t, server.URL+"/feeds", neturl.Values{"token": {feedToken(url)}, "name": {"Phone"}})
+	if status != http.StatusCreated {
+		t.Fatalf("POST /feeds answered %d: %q", status, body)
+	}
+
+	if status, _ := postForm(t, server.URL+"/revoke", neturl.Values{"token": {feedToken(url)}}); status != http.StatusOK {
+		t.Fatalf("POST /revoke answered %d", status)
+	}
+
+	if feeds, _ := cachedData.loadFeedTokens(); len(feeds) != 0 || len(feedTokens) != 0 {
+		t.Errorf("named feeds %+v left", feeds)
+	}
+}
+
+func TestE2ERecurring(t *testing.T) {
+	graph := newTestEnv(t)
+	server, client := newTestClient(t)
+
+	monday, _ := getCurrentWeek()
+
+	master := newTestEvent("standup", "Standup", monday.Add(9*time.Hour), 15*time.Minute)
+	master.Type = "seriesMaster"
+	master.HasAttachments = true
+	master.Recurrence = &PatternedRecurrence{
+		Pattern: &RecurrencePattern{
+			Type:           "weekly",
+			Interval:       1,
+			DaysOfWeek:     []string{"monday", "tuesday", "wednesday", "thursday", "friday"},
+			FirstDayOfWeek: "monday",
+		},
+		Range: &RecurrenceRange{Type: "noEnd", StartDate: monday.Format("2006-01-02")},
+	}
+	graph.putEvent(master)
+	graph.putAttachment("standup", "board.png", "image/png", []byte("board"))
+
+	// Every weekday of the two weeks on the feed, but for a cancelled Wednesday
+	// and a Thursday moved to later on
+	for day := 0; day < 14; day++ {
+		start := monday.AddDate(0, 0, day).Add(9 * time.Hour)
+		if day == 2 || start.Weekday() == time.Saturday || start.Weekday() == time.Sunday {
+			continue
+		}
+
+		instance := newTestEvent(fmt.Sprintf("standup-%d", day), "Standup", start, 15*time.Minute)
+		instance.Type = "occurrence"
+		instance.SeriesMasterID = "standup"
+		instance.OriginalStart = start.Format(time.RFC3339)
+
+		if day == 3 {
+			instance.Type = "exception"
+			instance.Subject = "Standup (later)"
+			instance.Start.DateTime = start.Add(2 * time.Hour).Format(StartEndTimeParse)
+			instance.End.DateTime = start.Add(2*time.Hour + 15*time.Minute).Format(StartEndTimeParse)
+		}
+
+		graph.putEvent(instance)
+	}
+
+	feed := getFeed(t, client, login(t, graph, server, client)+"&recurring=true")
+
+	for _, expected := range []string{
+		"RRULE:FREQ=WEEKLY;",
+		"EXDATE:" + monday.AddDate(0, 0, 2).Add(9*time.Hour).Format("20060102T150405Z"),
+		"RECURRENCE-ID:" + monday.AddDate(0, 0, 3).Add(9*time.Hour).Format("20060102T150405Z"),
+		"SUMMARY:Standup (later)",
+	} {
+		if !strings.Contains(feed, expected) {
+			t.Errorf("%q missing from the feed", expected)
+		}
+	}
+
+	if n := strings.Count(feed, "BEGIN:VEVENT"); n != 2 {
+		t.Errorf("%d events on the feed, expected the series and its exception", n)
+	}
+
+	links := attachmentURL.FindAllStringSubmatch(feed, -1)
+	if len(links) != 1 {
+		t.Fatalf("%d attachments on the feed, expected the one of the series", len(links))
+	}
+
+	if body := waitForAttachment(t, client, server.URL+links[0][1]); body != "board" {
+		t.Errorf("unexpected contents %q for %s", body, links[0][1])
+	}
+}
+
+func TestE2EWithoutBodies(t *testing.T) {
+	graph := newTestEnv(t)
+	server, client := newTestClient(t)
+
+	monday, _ := getCurrentWeek()
+
+	meeting := newTestEvent("meeting", "Review", monday.Add(10*time.Hour), time.Hour)
+	meeting.HasAttachments = true
+	meeting.OnlineMeeting = &OnlineMeeting{JoinURL: "https://teams.microsoft.com/l/meetup-join/review"}
+	graph.putEvent(meeting)
+	graph.putAttachment("meeting", "slides.pptx", "application/octet-stream", []byte("slides"))
+
+	url := login(t, graph, server, client)
+
+	for _, feed := range []string{getFeed(t, client, url+"&bodies=false"), getFeed(t, client, url+"&bodies=false&recurring=true")} {
+		assertEvents(t, feed, []string{"meeting"}, nil)
+
+		if strings.Contains(feed, "DESCRIPTION") || strings.Contains(feed, "ATTACH") {
+			t.Error("description or attachments on a feed without bodies")
+		}
+
+		if !strings.Contains(feed, "URL:https://teams.microsoft.com/l/meetup-join/review") {
+			t.Error("online meeting link missing from the feed")
+		}
+	}
+
+	if n := graph.countRequests("/$batch"); n != 0 {
+		t.Errorf("%d batches sent for a feed without attachments", n)
+	}
+}
+
+func TestE2EBodiesNotStored(t *testing.T) {
+	graph := newTestEnv(t)
+	server, client := newTestClient(t)
+
+	viper.Set("bodies", false)
+
+	monday, _ := getCurrentWeek()
+	graph.putEvent(newTestEvent("meeting", "Review", monday.Add(10*time.Hour), time.Hour))
+
+	url := login(t, graph, server, client)
+
+	feed := getFeed(t, client, url+"&bodies=true")
+	assertEvents(t, feed, []string{"meeting"}, nil)
+
+	if strings.Contains(feed, "DESCRIPTION") {
+		t.Error("description on a feed asking for bodies, though they aren't configured")
+	}
+
+	start, end, _ := getDeltaRange()
+
+	events, err := cachedData.getEvents("jane.doe", "", start, end)
+	if err != nil || len(events) != 1 {
+		t.Fatalf("got %v, %v", events, err)
+	}
+
+	if events[0].Body != nil {
+		t.Error("body stored though bodies aren't configured")
+	}
+}
+
+func TestE2ESeriesMasterSelect(t *testing.T) {
+	graph := newTestEnv(t)
+	server, client := newTestClient(t)
+
+	monday, _ := getCurrentWeek()
+
+	master := newTestEvent("standup", "Standup", monday.Add(9*time.Hour), 15*time.Minute)
+	master.Type = "seriesMaster"
+	master.Recurrence = &PatternedRecurrence{
+		Pattern: &RecurrencePattern{Type: "daily", Interval: 1},
+		Range:   &RecurrenceRange{Type: "numbered", StartDate: monday.Format("2006-01-02"), NumberOfOccurrences: 1},
+	}
+	graph.putEvent(master)
+
+	instance := newTestEvent("standup-0", "Standup", monday.Add(9*time.Hour), 15*time.Minute)
+	instance.Type = "occurrence"
+	instance.SeriesMasterID = "standup"
+	instance.OriginalStart = monday.Add(9 * time.Hour).Format(time.RFC3339)
+	graph.putEvent(instance)
+
+	url := login(t, graph, server, client) + "&recurring=true"
+
+	if feed := getFeed(t, client, url); !strings.Contains(feed, "DESCRIPTION:Agenda") {
+		t.Error("description of the series missing")
+	}
+
+	if feed := getFeed(t, client, url+"&bodies=false"); strings.Contains(feed, "DESCRIPTION") {
+		t.Error("description of the series on a feed without bodies")
+	}
+
+	// Rendering again asks Graph for nothing until a sync brings changes
+	getFeed(t, client, url)
+
+	if n := graph.countRequests("batched:/me/events/standup?$select=" + strings.Join(eventFields, ",") + ",body"); n != 1 {
+		t.Errorf("%d series masters requested with their body, expected 1", n)
+	}
+
+	if n := graph.countRequests("batched:/me/events/standup?$select=" + strings.Join(eventFields, ",")); n != 2 {
+		t.Errorf("%d series masters requested, expected 2", n)
+	}
+
+	if n := graph.countRequests("/me/events/standup"); n != 0 {
+		t.Errorf("%d series masters requested on their own", n)
+	}
+
+	master.Subject = "Daily standup"
+	graph.putEvent(master)
+	graph.putEvent(instance)
+
+	viper.Set("delta_sync_interval", "0s")
+
+	if feed := getFeed(t, client, url); !strings.Contains(feed, "SUMMARY:Daily standup") {
+		t.Error("series master not fetched again once changed")
+	}
+}
+
+func TestE2ECalendars(t *testing.T) {
+	graph := newTestEnv(t)
+	server, client := newTestClient(t)
+
+	viper.Set("delta_sync_interval", "0s")
+
+	graph.addCalendar("calendar-team", "Team")
+	graph.addCalendar("calendar-holidays", "Holidays")
+
+	monday, _ := getCurrentWeek()
+	graph.putEvent(newTestEvent("own", "Standup", monday.Add(9*time.Hour), time.Hour))
+	graph.putCalendarEvent("calendar-team", newTestEvent("team", "Offsite", monday.Add(11*time.Hour), time.Hour))
+	graph.putCalendarEvent("calendar-holidays", newTestEvent("holiday", "Day off", monday.AddDate(0, 0, 1), 8*time.Hour))
+
+	url := login(t, graph, server, client)
+
+	resp, body := get(t, client, server.URL+"/calendars?token="+feedToken(url))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("calendars answered %d: %s", resp.StatusCode, body)
+	}
+
+	listed := url
+	for _, line := range []string{
+		"Calendar (default):\n" + listed + "\n",
+		"Team:\n" + listed + "&calendars=calendar-team\n",
+		"All of them, in a single feed:\n" + listed + "&calendars=default,calendar-team,calendar-holidays",
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("calendars missing %q in:\n%s", line, body)
+		}
+	}
+
+	assertEvents(t, getFeed(t, client, url), []string{"own"}, []string{"team", "holiday"})
+	assertEvents(t, getFeed(t, client, url+"&calendars=calendar-team"), []string{"team"}, []string{"own", "holiday"})
+	assertEvents(t, getFeed(t, client, url+"&calendars=default,calendar-holidays"), []string{"own", "holiday"}, []string{"team"})
+
+	graph.putCalendarEvent("calendar-team", newTestEvent("team-added", "Review", monday.AddDate(0, 0, 2).Add(9*time.Hour), time.Hour))
+
+	feed := getFeed(t, client, url+"&calendars=calendar-team,calendar-holidays")
+	assertEvents(t, feed, []string{"team", "team-added", "holiday"}, []string{"own"})
+
+	if n := graph.countRequests("/me/calendars/calendar-team/calendarView/delta?$deltatoken="); n == 0 {
+		t.Error("team calendar changes not fetched through its deltaLink")
+	}
+
+	resp, _ = get(t, client, url+"&calendars=calendar-unknown")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown calendar answered %d", resp.StatusCode)
+	}
+}
+
+func TestE2ESharedCalendars(t *testing.T) {
+	graph := newTestEnv(t)
+	server, client := newTestClient(t)
+
+	viper.Set("delta_sync_interval", "0s")
+
+	const boss = "boss@example.com"
+
+	graph.shareCalendar(boss, "boss-default", "Calendar", true)
+	graph.shareCalendar(boss, "boss-travel", "Travel", false)
+
+	monday, _ := getCurrentWeek()
+	graph.putEvent(newTestEvent("own", "Standup", monday.Add(9*time.Hour), time.Hour))
+
+	shared := newTestEvent("board", "Board meeting", monday.Add(14*time.Hour), 2*time.Hour)
+	shared.HasAttachments = true
+	graph.putCalendarEvent("boss-default", shared)
+	graph.putAttachment(shared.ID, "minutes.txt", "text/plain", []byte("minutes"))
+	graph.putCalendarEvent("boss-travel", newTestEvent("flight", "Flight", monday.AddDate(0, 0, 2).Add(7*time.Hour), 3*time.Hour))
+
+	stranger := &http.Client{Transport: anonymous.Transport, CheckRedirect: client.CheckRedirect}
+	if resp, _ := get(t, stranger, server.URL+"/"); !strings.Contains(resp.Header.Get("Location"), "calendars.read.shared") {
+		t.Errorf("shared calendars not requested on %q", resp.Header.Get("Location"))
+	}
+
+	url := login(t, graph, server, client)
+
+	resp, body := get(t, client, server.URL+"/calendars?token="+feedToken(url)+"&mailbox="+boss)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("shared calendars answered %d: %s", resp.StatusCode, body)
+	}
+
+	listed := url + "&mailbox=boss%40example.com"
+	for _, line := range []string{
+		"Calendar (default):\n" + listed + "\n",
+		"Travel:\n" + listed + "&calendars=boss-travel\n",
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("shared calendars missing %q in:\n%s", line, body)
+		}
+	}
+
+	assertEvents(t, getFeed(t, client, url), []string{"own"}, []string{"board", "flight"})
+	assertEvents(t, getFeed(t, client, url+"&mailbox="+boss+"&calendars=boss-travel"), []string{"flight"}, []string{"own", "board"})
+
+	feed := getFeed(t, client, url+"&mailbox="+boss)
+	assertEvents(t, feed, []string{"board"}, []string{"own", "flight"})
+
+	links := attachmentURL.FindAllStringSubmatch(feed, -1)
+	if len(links) != 1 {
+		t.Fatalf("%d attachments on the shared feed, expected 1", len(links))
+	}
+
+	if body := waitForAttachment(t, client, server.URL+links[0][1]); body != "minutes" {
+		t.Errorf("shared attachment downloaded as %q", body)
+	}
+
+	if n := graph.countRequests("batched:/users/" + boss + "/events/board/attachments"); n != 2 {
+		t.Errorf("%d attachment requests sent to the shared mailbox, expected the list and the download", n)
+	}
+
+	graph.unshareMailbox(boss)
+
+	resp, body = get(t, client, url+"&mailbox="+boss)
+	if resp.StatusCode != http.StatusForbidden || !strings.Contains(body, "no longer be shared") {
+		t.Errorf("feed of an unshared mailbox answered %d: %q", resp.StatusCode, body)
+	}
+
+	if state, _ := cachedData.getDeltaState(sessions.get(feedToken(url)).userName, boss+":"); state != nil {
+		t.Error("events of the unshared mailbox still stored")
+	}
+
+	assertEvents(t, getFeed(t, client, url), []string{"own"}, nil)
+
+	resp, _ = get(t, client, url+"&mailbox=nobody@example.com")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown mailbox answered %d", resp.StatusCode)
+	}
+
+	// Mailboxes are only picked through mailbox, whose checks calendars can't
+	// get around
+	for _, query := range []string{"&mailbox=boss:x", "&calendars=" + boss + ":", "&mailbox=" + boss + "&calendars=boss-travel:x"} {
+		if resp, _ := get(t, client, url+query); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("feed with %q answered %d", query, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,1040 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	fakeTenant          = "tenant"
+	fakeClientID        = "client"
+	fakeClientSecret    = "secret"
+	fakeDefaultCalendar = "calendar-default"
+)
+
+var maxPageSize = regexp.MustCompile(`odata\.maxpagesize=(\d+)`)
+
+type fakeEvent struct {
+	calendar string
+	event    *Event
+	version  int
+	removed  bool
+}
+
+// fakeCalendar is a calendar of the user, or of the mailbox sharing it
+type fakeCalendar struct {
+	mailbox  string
+	calendar *GraphCalendar
+}
+
+// fakeDevice is a device code login, until the code is redeemed for a token
+type fakeDevice struct {
+	userCode string
+	approved bool
+	redeemed bool
+}
+
+type fakeAttachment struct {
+	meta    *EventAttachment
+	content []byte
+}
+
+// fakeGraph is an in process stand-in for Microsoft Graph and the Azure AD
+// token endpoint, serving the calendars of a single user and the ones other
+// mailboxes share with them, or all of them to the app itself. Collections
+// are paged by pageSize items unless the client asks for less.
+type fakeGraph struct {
+	mu sync.Mutex
+
+	server   *httptest.Server
+	router   *echo.Echo
+	user     User
+	timeZone string
+	pageSize int
+
+	calendars     []*fakeCalendar
+	mailboxes     map[string]bool
+	groups        map[string][]string
+	appTokens     map[string]bool
+	certificate   *rsa.PublicKey
+	authCodes     map[string]string
+	devices       map[string]*fakeDevice
+	publicTokens  map[string]bool
+	events        []*fakeEvent
+	attachments   map[string][]*fakeAttachment
+	subscriptions map[string]*GraphSubscription
+	subscribed    int
+	version       int
+	tokens        int
+	revokedBelow  int
+	throttled     int
+	failBatched   int
+	tokenOutage   int
+	requests      []string
+}
+
+func newFakeGraph(t *testing.T) *fakeGraph {
+	f := &fakeGraph{
+		user: User{
+			DisplayName:       "Jane Doe",
+			UserPrincipalName: "jane.doe@example.com",
+			Mail:              "jane.doe@example.com",
+		},
+		timeZone: "UTC",
+		pageSize: 2,
+		calendars: []*fakeCalendar{
+			{calendar: &GraphCalendar{ID: fakeDefaultCalendar, Name: "Calendar", IsDefaultCalendar: true}},
+		},
+		mailboxes:     make(map[string]bool),
+		groups:        make(map[string][]string),
+		appTokens:     make(map[string]bool),
+		authCodes:     make(map[string]string),
+		devices:       make(map[string]*fakeDevice),
+		publicTokens:  make(map[string]bool),
+		attachments:   make(map[string][]*fakeAttachment),
+		subscriptions: make(map[string]*GraphSubscription),
+	}
+
+	e := echo.New()
+	e.GET("/:tenant/oauth2/v2.0/authorize", f.signIn)
+	e.POST("/:tenant/oauth2/v2.0/token", f.token)
+	e.POST("/:tenant/oauth2/v2.0/devicecode", f.deviceCode)
+
+	g := e.Group("/v1.0", f.authorize)
+	g.GET("/me", f.me)
+	g.GET("/me/mailboxSettings/timeZone", f.mailboxTimeZone)
+	g.GET("/me/calendarView", f.calendarView)
+	g.GET("/me/calendarView/delta", f.delta)
+	g.GET("/me/calendars", f.listCalendars)
+	g.GET("/me/calendars/:calendarId/calendarView", f.calendarView)
+	g.GET("/me/calendars/:calendarId/calendarView/delta", f.delta)
+	g.GET("/me/events/:id", f.getEvent)
+	g.GET("/me/events/:id/attachments", f.listAttachments)
+	g.GET("/me/events/:id/attachments/:attId/$value", f.attachmentValue)
+
+	g.GET("/groups/:id/transitiveMembers/microsoft.graph.user", f.groupMembers)
+
+	u := g.Group("/users/:mailbox", f.mailboxAccess)
+	u.GET("", f.getUser)
+	u.GET("/mailboxSettings/timeZone", f.mailboxTimeZone)
+	u.GET("/calendarView", f.calendarView)
+	u.GET("/calendarView/delta", f.delta)
+	u.GET("/calendars", f.listCalendars)
+	u.GET("/calendars/:calendarId/calendarView", f.calendarView)
+	u.GET("/calendars/:calendarId/calendarView/delta", f.delta)
+	u.GET("/events/:id", f.getEvent)
+	u.GET("/events/:id/attachments", f.listAttachments)
+	u.GET("/events/:id/attachments/:attId/$value", f.attachmentValue)
+
+	g.POST("/subscriptions", f.subscribe)
+	g.PATCH("/subscriptions/:id", f.renew)
+	g.DELETE("/subscriptions/:id", f.unsubscribe)
+	g.POST("/$batch", f.batch)
+
+	f.router = e
+	f.server = httptest.NewServer(e)
+	t.Cleanup(f.server.Close)
+
+	return f
+}
+
+func (f *fakeGraph) graphURL() string {
+	return f.server.URL + "/v1.0"
+}
+
+func (f *fakeGraph) loginURL() string {
+	return f.server.URL
+}
+
+// putEvent adds or replaces an event of the default calendar, making it part
+// of the next delta
+func (f *fakeGraph) putEvent(e *Event) {
+	f.putCalendarEvent(fakeDefaultCalendar, e)
+}
+
+// putCalendarEvent adds or replaces an event of the given calendar
+func (f *fakeGraph) putCalendarEvent(calendarID string, e *Event) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.version++
+
+	for _, fe := range f.events {
+		if fe.event.ID == e.ID {
+			fe.calendar, fe.event, fe.version, fe.removed = calendarID, e, f.version, false
+			return
+		}
+	}
+
+	f.events = append(f.events, &fakeEvent{calendar: calendarID, event: e, version: f.version})
+}
+
+func (f *fakeGraph) addCalendar(id string, name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.calendars = append(f.calendars, &fakeCalendar{calendar: &GraphCalendar{ID: id, Name: name}})
+}
+
+// shareCalendar adds a calendar of another mailbox, sharing the mailbox
+func (f *fakeGraph) shareCalendar(mailbox string, id string, name string, isDefault bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.mailboxes[mailbox] = true
+	f.calendars = append(f.calendars, &fakeCalendar{
+		mailbox:  mailbox,
+		calendar: &GraphCalendar{ID: id, Name: name, IsDefaultCalendar: isDefault},
+	})
+}
+
+// addGroup creates a group with the given mailboxes as members
+func (f *fakeGraph) addGroup(id string, members ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, member := range members {
+		if _, ok := f.mailboxes[member]; !ok && member != f.user.UserPrincipalName {
+			f.mailboxes[member] = false
+		}
+	}
+
+	f.groups[id] = members
+}
+
+// trustCertificate accepts app tokens requested with assertions signed by key
+func (f *fakeGraph) trustCertificate(key *rsa.PublicKey) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.certificate = key
+}
+
+// approveDevice enters the user code of a device code login, as the user does
+// on the verification page
+func (f *fakeGraph) approveDevice(userCode string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, d := range f.devices {
+		if d.userCode == userCode {
+			d.approved = true
+		}
+	}
+}
+
+// unshareMailbox denies the user access to the calendars of the mailbox
+func (f *fakeGraph) unshareMailbox(mailbox string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.mailboxes[mailbox] = false
+}
+
+func (f *fakeGraph) removeEvent(id string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.version++
+
+	for _, fe := range f.events {
+		if fe.event.ID == id {
+			fe.version, fe.removed = f.version, true
+		}
+	}
+}
+
+func (f *fakeGraph) putAttachment(eventID string, name string, contentType string, content []byte) *EventAttachment {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	meta := &EventAttachment{
+		ID:          fmt.Sprintf("%s-att-%d", eventID, len(f.attachments[eventID])),
+		Name:        name,
+		ContentType: contentType,
+		Size:        len(content),
+	}
+
+	f.attachments[eventID] = append(f.attachments[eventID], &fakeAttachment{meta: meta, content: content})
+
+	return meta
+}
+
+// throttle answers the next n Graph requests with a 429
+func (f *fakeGraph) throttle(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.throttled = n
+}
+
+// failBatches answers the next n requests within a batch with a 503
+func (f *fakeGraph) failBatches(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.failBatched = n
+}
+
+// failTokens answers the next n token requests with a 503, as Azure AD does
+// during an outage
+func (f *fakeGraph) failTokens(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.tokenOutage = n
+}
+
+// revokeTokens rejects every access and refresh token issued so far, as
+// happens when the user changes their password or an admin revokes sessions
+func (f *fakeGraph) revokeTokens() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.revokedBelow = f.tokens + 1
+}
+
+// isRevoked reports whether the token is not one issued by the fake after
+// the last revocation
+func (f *fakeGraph) isRevoked(token string, prefix string) bool {
+	n, err := strconv.Atoi(strings.TrimPrefix(token, prefix))
+
+	return err != nil || n < f.revokedBelow
+}
+
+// countSubscriptions returns how many change notification subscriptions exist
+func (f *fakeGraph) countSubscriptions() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return len(f.subscriptions)
+}
+
+// countRequests returns how many requests were made to paths starting with
+// prefix, the ones within a batch being recorded as "batched:" and their path
+func (f *fakeGraph) countRequests(prefix string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n := 0
+	for _, r := range f.requests {
+		if strings.HasPrefix(r, prefix) {
+			n++
+		}
+	}
+
+	return n
+}
+
+func graphError(c echo.Context, status int, code string, message string) error {
+	return c.JSON(status, map[string]interface{}{
+		"error": &GraphError{Code: code, Message: message},
+	})
+}
+
+// clientSecret returns the secret the client authenticated with, either in
+// the form or as the password of basic authentication
+func clientSecret(c echo.Context) string {
+	if _, secret, ok := c.Request().BasicAuth(); ok {
+		return secret
+	}
+
+	return c.FormValue("client_secret")
+}
+
+// signIn logs the user in right away, sending them back to the redirect URL
+// with a code only redeemable with the verifier of the code challenge
+func (f *fakeGraph) signIn(c echo.Context) error {
+	if c.Param("tenant") != fakeTenant || c.QueryParam("client_id") != fakeClientID || c.QueryParam("response_type") != "code" {
+		return c.String(http.StatusBadRequest, "invalid_request")
+	}
+
+	challenge := c.QueryParam("code_challenge")
+	if challenge == "" || c.QueryParam("code_challenge_method") != "S256" {
+		return c.String(http.StatusBadRequest, "invalid_request: PKCE required")
+	}
+
+	redirect, err := url.Parse(c.QueryParam("redirect_uri"))
+	if err != nil || redirect.Host == "" {
+		return c.String(http.StatusBadRequest, "invalid_request: redirect_uri")
+	}
+
+	f.mu.Lock()
+	code := fmt.Sprintf("fake-code-%d", len(f.authCodes)+1)
+	f.authCodes[code] = challenge
+	f.mu.Unlock()
+
+	redirect.RawQuery = url.Values{
+		"code":  {code},
+		"state": {c.QueryParam("state")},
+	}.Encode()
+
+	return c.Redirect(http.StatusFound, redirect.String())
+}
+
+func (f *fakeGraph) deviceCode(c echo.Context) error {
+	if c.Param("tenant") != fakeTenant || c.FormValue("client_id") != fakeClientID {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid_client"})
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n := len(f.devices) + 1
+	device := &fakeDevice{userCode: fmt.Sprintf("CODE%d", n)}
+	f.devices[fmt.Sprintf("fake-device-%d", n)] = device
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"device_code":      fmt.Sprintf("fake-device-%d", n),
+		"user_code":        device.userCode,
+		"verification_uri": "https://microsoft.com/devicelogin",
+		"expires_in":       900,
+	})
+}
+
+func (f *fakeGraph) token(c echo.Context) error {
+	if c.Param("tenant") != fakeTenant {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid_tenant"})
+	}
+
+	f.mu.Lock()
+	unavailable := f.tokenOutage > 0
+	if unavailable {
+		f.tokenOutage--
+	}
+	f.mu.Unlock()
+
+	if unavailable {
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "temporarily_unavailable"})
+	}
+
+	// Like Azure AD, tokens issued to the app as a public client are only
+	// refreshed by a public client, and the other way around
+	public := false
+
+	switch c.FormValue("grant_type") {
+	case "client_credentials":
+		if err := f.authenticateApp(c); err != nil {
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "invalid_client", "error_description": err.Error()})
+		}
+
+		f.mu.Lock()
+		f.tokens++
+		token := fmt.Sprintf("fake-access-%d", f.tokens)
+		f.appTokens[token] = true
+		f.mu.Unlock()
+
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"token_type":   "Bearer",
+			"access_token": token,
+			"expires_in":   3600,
+		})
+	case "authorization_code":
+		// Codes are redeemed once, by whoever knows the code verifier
+		f.mu.Lock()
+		challenge, ok := f.authCodes[c.FormValue("code")]
+		if ok {
+			f.authCodes[c.FormValue("code")] = ""
+		}
+		f.mu.Unlock()
+
+		if !ok || challenge == "" || codeChallenge(c.FormValue("code_verifier")) != challenge {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		}
+	case deviceCodeGrantType:
+		public = true
+
+		f.mu.Lock()
+		device := f.devices[c.FormValue("device_code")]
+		f.mu.Unlock()
+
+		if clientSecret(c) != "" {
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		}
+
+		if device == nil || device.redeemed {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "expired_token"})
+		}
+
+		f.mu.Lock()
+		approved := device.approved
+		device.redeemed = approved
+		f.mu.Unlock()
+
+		if !approved {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "authorization_pending"})
+		}
+	case "refresh_token":
+		f.mu.Lock()
+		revoked := f.isRevoked(c.FormValue("refresh_token"), "fake-refresh-")
+		public = f.publicTokens[c.FormValue("refresh_token")]
+		f.mu.Unlock()
+
+		if public != (clientSecret(c) == "") {
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		}
+
+		if revoked {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		}
+	default:
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "unsupported_grant_type"})
+	}
+
+	f.mu.Lock()
+	f.tokens++
+	n := f.tokens
+	f.publicTokens[fmt.Sprintf("fake-refresh-%d", n)] = public
+	f.mu.Unlock()
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"token_type":    "Bearer",
+		"access_token":  fmt.Sprintf("fake-access-%d", n),
+		"refresh_token": fmt.Sprintf("fake-refresh-%d", n),
+		"expires_in":    3600,
+	})
+}
+
+// authenticateApp checks the client secret or the signed assertion of a
+// client credentials grant
+func (f *fakeGraph) authenticateApp(c echo.Context) error {
+	if c.FormValue("client_id") != fakeClientID || !strings.HasSuffix(c.FormValue("scope"), "/.default") {
+		return errors.New("unknown client or scope")
+	}
+
+	if c.FormValue("client_assertion_type") == "" {
+		if c.FormValue("client_secret") != fakeClientSecret {
+			return errors.New("invalid client secret")
+		}
+
+		return nil
+	}
+
+	parts := strings.Split(c.FormValue("client_assertion"), ".")
+	if len(parts) != 3 || c.FormValue("client_secret") != "" {
+		return errors.New("malformed assertion")
+	}
+
+	signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+
+	f.mu.Lock()
+	key := f.certificate
+	f.mu.Unlock()
+
+	if key == nil || rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], signature) != nil {
+		return errors.New("assertion not signed by a trusted certificate")
+	}
+
+	var claims struct {
+		Audience string `json:"aud"`
+		Issuer   string `json:"iss"`
+		Expiry   int64  `json:"exp"`
+	}
+
+	payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return err
+	}
+
+	if claims.Audience != "http://"+c.Request().Host+c.Request().URL.Path || claims.Issuer != fakeClientID || claims.Expiry < time.Now().Unix() {
+		return fmt.Errorf("unexpected assertion claims %+v", claims)
+	}
+
+	return nil
+}
+
+func (f *fakeGraph) isAppToken(c echo.Context) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.appTokens[strings.TrimPrefix(c.Request().Header.Get("Authorization"), "Bearer ")]
+}
+
+func (f *fakeGraph) authorize(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		uri := strings.TrimPrefix(c.Request().URL.RequestURI(), "/v1.0")
+		if c.Request().Header.Get("X-Fake-Batched") != "" {
+			uri = "batched:" + uri
+		}
+
+		f.mu.Lock()
+		f.requests = append(f.requests, uri)
+		revoked := f.isRevoked(strings.TrimPrefix(c.Request().Header.Get("Authorization"), "Bearer "), "fake-access-")
+
+		throttled := f.throttled > 0
+		if throttled {
+			f.throttled--
+		}
+		f.mu.Unlock()
+
+		if throttled {
+			c.Response().Header().Set("Retry-After", "0")
+			return graphError(c, http.StatusTooManyRequests, "TooManyRequests", "Please retry again later.")
+		}
+
+		if revoked {
+			return graphError(c, http.StatusUnauthorized, "InvalidAuthenticationToken", "Access token validation failure.")
+		}
+
+		if strings.HasPrefix(c.Path(), "/v1.0/me") && f.isAppToken(c) {
+			return graphError(c, http.StatusBadRequest, "BadRequest", "/me request is only valid with delegated authentication flow.")
+		}
+
+		return next(c)
+	}
+}
+
+// mailboxOf returns the mailbox of a request, empty for the user's own one
+func (f *fakeGraph) mailboxOf(c echo.Context) string {
+	if mailbox := c.Param("mailbox"); mailbox != f.user.UserPrincipalName {
+		return mailbox
+	}
+
+	return ""
+}
+
+// mailboxAccess lets through requests for the user's own mailbox and the ones
+// shared with them, or for any mailbox when made by the app
+func (f *fakeGraph) mailboxAccess(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		mailbox := f.mailboxOf(c)
+		if mailbox == "" {
+			return next(c)
+		}
+
+		f.mu.Lock()
+		shared, ok := f.mailboxes[mailbox]
+		f.mu.Unlock()
+
+		if !ok {
+			return graphError(c, http.StatusNotFound, "ErrorInvalidUser", "The requested user is invalid.")
+		}
+
+		if !shared && !f.isAppToken(c) {
+			return graphError(c, http.StatusForbidden, "ErrorAccessDenied", "Access is denied. Check credentials and try again.")
+		}
+
+		return next(c)
+	}
+}
+
+func (f *fakeGraph) me(c echo.Context) error {
+	return c.JSON(http.StatusOK, f.user)
+}
+
+func (f *fakeGraph) userOf(mailbox string) User {
+	if mailbox == "" || mailbox == f.user.UserPrincipalName {
+		return f.user
+	}
+
+	return User{
+		DisplayName:       mailbox[:strings.Index(mailbox, "@")],
+		UserPrincipalName: mailbox,
+		Mail:              mailbox,
+	}
+}
+
+func (f *fakeGraph) getUser(c echo.Context) error {
+	return c.JSON(http.StatusOK, selectFields(c, f.userOf(f.mailboxOf(c))))
+}
+
+func (f *fakeGraph) groupMembers(c echo.Context) error {
+	var users []*User
+
+	f.mu.Lock()
+	members, ok := f.groups[c.Param("id")]
+	for _, member := range members {
+		user := f.userOf(member)
+		users = append(users, &user)
+	}
+	f.mu.Unlock()
+
+	if !ok {
+		return graphError(c, http.StatusNotFound, "Request_ResourceNotFound", "Resource does not exist.")
+	}
+
+	from, to, next := page(c, f.requestPageSize(c), len(users))
+
+	return c.JSON(http.StatusOK, &UserPage{Value: users[from:to], NextLink: next})
+}
+
+func (f *fakeGraph) mailboxTimeZone(c echo.Context) error {
+	return c.JSON(http.StatusOK, MailboxTimeZone{Value: f.timeZone})
+}
+
+func (f *fakeGraph) requestPageSize(c echo.Context) int {
+	size := f.pageSize
+	if m := maxPageSize.FindStringSubmatch(c.Request().Header.Get("Prefer")); m != nil {
+		if n, _ := strconv.Atoi(m[1]); n > 0 && n < size {
+			size = n
+		}
+	}
+
+	if n, err := strconv.Atoi(c.QueryParam("$top")); err == nil && n > 0 && n < size {
+		size = n
+	}
+
+	return size
+}
+
+// page returns the items of the page starting at $skip, along with the
+// link to the next one, if any
+func page(c echo.Context, size int, total int) (int, int, string) {
+	skip, _ := strconv.Atoi(c.QueryParam("$skip"))
+	if skip > total {
+		skip = total
+	}
+
+	end := skip + size
+	if end >= total {
+		return skip, total, ""
+	}
+
+	query := c.Request().URL.Query()
+	query.Set("$skip", strconv.Itoa(end))
+
+	next := url.URL{
+		Scheme:   "http",
+		Host:     c.Request().Host,
+		Path:     c.Request().URL.Path,
+		RawQuery: query.Encode(),
+	}
+
+	return skip, end, next.String()
+}
+
+func parseRange(c echo.Context) (time.Time, time.Time, error) {
+	start, err := time.Parse(RFC3339Short, strings.TrimSuffix(c.QueryParam("startDateTime"), "Z"))
+	if err != nil {
+		return start, start, err
+	}
+
+	end, err := time.Parse(RFC3339Short, strings.TrimSuffix(c.QueryParam("endDateTime"), "Z"))
+
+	return start, end, err
+}
+
+// calendarOf returns the calendar a request is for, the default one of the
+// mailbox when the path names none
+func (f *fakeGraph) calendarOf(c echo.Context) (string, bool) {
+	id := c.Param("calendarId")
+
+	for _, fc := range f.calendars {
+		if fc.mailbox != f.mailboxOf(c) {
+			continue
+		}
+
+		if fc.calendar.ID == id || (id == "" && fc.calendar.IsDefaultCalendar) {
+			return fc.calendar.ID, true
+		}
+	}
+
+	return "", false
+}
+
+// inRange returns the live events of the calendar overlapping [start, end), in
+// order. Series masters are left out, calendar views returning their
+// instances instead.
+func (f *fakeGraph) inRange(calendar string, start time.Time, end time.Time) []*Event {
+	var events []*Event
+
+	for _, fe := range f.events {
+		if fe.calendar != calendar || fe.event.Type == "seriesMaster" {
+			continue
+		}
+
+		if !fe.removed && fe.event.startTime().Before(end) && fe.event.endTime().After(start) {
+			events = append(events, fe.event)
+		}
+	}
+
+	return events
+}
+
+func (f *fakeGraph) listCalendars(c echo.Context) error {
+	var calendars []*GraphCalendar
+
+	f.mu.Lock()
+	for _, fc := range f.calendars {
+		if fc.mailbox == f.mailboxOf(c) {
+			calendars = append(calendars, fc.calendar)
+		}
+	}
+	f.mu.Unlock()
+
+	from, to, next := page(c, f.requestPageSize(c), len(calendars))
+
+	return c.JSON(http.StatusOK, &CalendarPage{Value: calendars[from:to], NextLink: next})
+}
+
+func (f *fakeGraph) calendarView(c echo.Context) error {
+	start, end, err := parseRange(c)
+	if err != nil {
+		return graphError(c, http.StatusBadRequest, "ErrorInvalidParameter", err.Error())
+	}
+
+	f.mu.Lock()
+	calendar, ok := f.calendarOf(c)
+	events := f.inRange(calendar, start, end)
+	f.mu.Unlock()
+
+	if !ok {
+		return graphError(c, http.StatusNotFound, "ErrorItemNotFound", "The specified object was not found in the store.")
+	}
+
+	from, to, next := page(c, f.requestPageSize(c), len(events))
+
+	return c.JSON(http.StatusOK, &EventPage{Value: events[from:to], NextLink: next})
+}
+
+// delta serves the events in range on the initial round, and the ones changed
+// since $deltatoken afterwards, the token being the version it was issued at
+func (f *fakeGraph) delta(c echo.Context) error {
+	var events []*Event
+
+	f.mu.Lock()
+
+	calendar, ok := f.calendarOf(c)
+	if !ok {
+		f.mu.Unlock()
+		return graphError(c, http.StatusNotFound, "ErrorItemNotFound", "The specified object was not found in the store.")
+	}
+
+	if token := c.QueryParam("$deltatoken"); token != "" {
+		since, err := strconv.Atoi(token)
+		if err != nil || since > f.version {
+			f.mu.Unlock()
+			return graphError(c, http.StatusGone, "SyncStateNotFound", "The sync state generation is not found.")
+		}
+
+		// Series masters are left out here too, their changes showing up on
+		// their instances
+		for _, fe := range f.events {
+			if fe.calendar != calendar || fe.version <= since || fe.event.Type == "seriesMaster" {
+				continue
+			}
+
+			if fe.removed {
+				events = append(events, &Event{ID: fe.event.ID, Removed: &Removed{Reason: "deleted"}})
+			} else {
+				events = append(events, fe.event)
+			}
+		}
+	} else {
+		start, end, err := parseRange(c)
+		if err != nil {
+			f.mu.Unlock()
+			return graphError(c, http.StatusBadRequest, "ErrorInvalidParameter", err.Error())
+		}
+
+		events = f.inRange(calendar, start, end)
+	}
+
+	version := f.version
+	f.mu.Unlock()
+
+	from, to, next := page(c, f.requestPageSize(c), len(events))
+	result := &EventPage{Value: events[from:to], NextLink: next}
+
+	if next == "" {
+		result.DeltaLink = fmt.Sprintf("http://%s%s?$deltatoken=%d", c.Request().Host, c.Request().URL.Path, version)
+	}
+
+	return c.JSON(http.StatusOK, result)
+}
+
+// selectFields keeps the id and the properties listed on $select, if any
+func selectFields(c echo.Context, v interface{}) interface{} {
+	var all map[string]json.RawMessage
+
+	fields := c.QueryParam("$select")
+	if fields == "" {
+		return v
+	}
+
+	data, _ := json.Marshal(v)
+	json.Unmarshal(data, &all)
+
+	selected := map[string]json.RawMessage{"id": all["id"]}
+	for _, field := range strings.Split(fields, ",") {
+		if value, ok := all[field]; ok {
+			selected[field] = value
+		}
+	}
+
+	return selected
+}
+
+func (f *fakeGraph) getEvent(c echo.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, fe := range f.events {
+		if fe.event.ID == c.Param("id") && !fe.removed {
+			return c.JSON(http.StatusOK, selectFields(c, fe.event))
+		}
+	}
+
+	return graphError(c, http.StatusNotFound, "ErrorItemNotFound", "The specified object was not found in the store.")
+}
+
+func (f *fakeGraph) listAttachments(c echo.Context) error {
+	var metas []*EventAttachment
+
+	f.mu.Lock()
+	for _, att := range f.attachments[c.Param("id")] {
+		metas = append(metas, att.meta)
+	}
+	f.mu.Unlock()
+
+	from, to, next := page(c, f.requestPageSize(c), len(metas))
+
+	return c.JSON(http.StatusOK, &AttachmentPage{Value: metas[from:to], NextLink: next})
+}
+
+func (f *fakeGraph) attachmentValue(c echo.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, att := range f.attachments[c.Param("id")] {
+		if att.meta.ID == c.Param("attId") {
+			return c.Blob(http.StatusOK, att.meta.ContentType, att.content)
+		}
+	}
+
+	return graphError(c, http.StatusNotFound, "ErrorItemNotFound", "The specified object was not found in the store.")
+}
+
+func (f *fakeGraph) subscribe(c echo.Context) error {
+	var req map[string]string
+
+	if err := c.Bind(&req); err != nil {
+		return graphError(c, http.StatusBadRequest, "InvalidRequest", err.Error())
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.subscribed++
+
+	sub := &GraphSubscription{
+		ID:                 fmt.Sprintf("subscription-%d", f.subscribed),
+		ExpirationDateTime: req["expirationDateTime"],
+	}
+
+	f.subscriptions[sub.ID] = sub
+
+	return c.JSON(http.StatusCreated, sub)
+}
+
+func (f *fakeGraph) unsubscribe(c echo.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.subscriptions[c.Param("id")]; !ok {
+		return graphError(c, http.StatusNotFound, "ResourceNotFound", "The object was not found.")
+	}
+
+	delete(f.subscriptions, c.Param("id"))
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (f *fakeGraph) renew(c echo.Context) error {
+	var req map[string]string
+
+	if err := c.Bind(&req); err != nil {
+		return graphError(c, http.StatusBadRequest, "InvalidRequest", err.Error())
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	sub, ok := f.subscriptions[c.Param("id")]
+	if !ok {
+		return graphError(c, http.StatusNotFound, "ResourceNotFound", "The object was not found.")
+	}
+
+	sub.ExpirationDateTime = req["expirationDateTime"]
+
+	return c.JSON(http.StatusOK, sub)
+}
+
+// batch runs every request of a JSON batch through the fake itself
+func (f *fakeGraph) batch(c echo.Context) error {
+	var payload BatchPayload
+
+	if err := c.Bind(&payload); err != nil {
+		return graphError(c, http.StatusBadRequest, "BadRequest", err.Error())
+	}
+
+	if len(payload.Requests) > graphBatchSize {
+		return graphError(c, http.StatusBadRequest, "BadRequest", "Number of requests in a batch exceeds 20.")
+	}
+
+	result := &BatchResult{}
+
+	for _, r := range payload.Requests {
+		f.mu.Lock()
+		failed := f.failBatched > 0
+		if failed {
+			f.failBatched--
+		}
+		f.mu.Unlock()
+
+		if failed {
+			result.Responses = append(result.Responses, &BatchResponse{
+				ID:     r.ID,
+				Status: http.StatusServiceUnavailable,
+				Body:   json.RawMessage(`{"error":{"code":"ServiceUnavailable","message":"Service unavailable."}}`),
+			})
+			continue
+		}
+
+		req := httptest.NewRequest(r.Method, "/v1.0"+r.URL, nil)
+		req.Host = c.Request().Host
+		req.Header.Set("Authorization", c.Request().Header.Get("Authorization"))
+		req.Header.Set("X-Fake-Batched", "true")
+
+		rec := httptest.NewRecorder()
+		f.router.ServeHTTP(rec, req)
+
+		// Anything but JSON is sent as a base64 string
+		body := rec.Body.Bytes()
+		contentType := rec.Header().Get(echo.HeaderContentType)
+		if !strings.HasPrefix(contentType, echo.MIMEApplicationJSON) {
+			body, _ = json.Marshal(body)
+		}
+
+		result.Responses = append(result.Responses, &BatchResponse{
+			ID:      r.ID,
+			Status:  rec.Code,
+			Headers: map[string]string{"Content-Type": contentType},
+			Body:    body,
+		})
+	}
+
+	// Graph does not keep the order of the requests
+	for i, j := 0, len(result.Responses)-1; i < j; i, j = i+1, j-1 {
+		result.Responses[i], result.Responses[j] = result.Responses[j], result.Responses[i]
+	}
+
+	return c.JSON(http.StatusOK, result)
+}
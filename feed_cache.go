@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// feedVersionTTL is how long the version of a feed no longer served is kept
+const feedVersionTTL = 24 * time.Hour
+
+// feedCache keeps the feeds rendered for feed_cache_ttl, so the calendar apps
+// of a user polling their feed at the same time are served a single render
+type feedCache struct {
+	mu      sync.Mutex
+	entries map[string]*renderedFeed
+
+	// versions are the latest versions served, by token and options
+	versions map[string]*feedVersion
+}
+
+// renderedFeed is a feed rendered, or being rendered, for a token and options
+type renderedFeed struct {
+	user string
+
+	// done is closed once body and err are set
+	done    chan struct{}
+	body    string
+	err     error
+	expires time.Time
+}
+
+// renderedFeeds are the feeds served lately, by token and options
+var renderedFeeds = newFeedCache()
+
+func newFeedCache() *feedCache {
+	return &feedCache{
+		entries:  make(map[string]*renderedFeed),
+		versions: make(map[string]*feedVersion),
+	}
+}
+
+// feedKey identifies the feed served under token with opts, as parsed, so
+// the order of the parameters on its URL, or those it doesn't know about,
+// don't get it rendered again
+func feedKey(token string, opts *FeedOptions) string {
+	return fmt.Sprintf("%s %s full=%t google=%t recurring=%t weekends=%t bodies=%t titles=%t past=%d future=%d mailbox=%s calendars=%q",
+		token, opts.baseHost, opts.full, opts.google, opts.recurring, opts.weekends, opts.bodies, opts.titles, opts.past, opts.future, opts.mailbox, opts.calendars)
+}
+
+// get returns the feed of user rendered under key within ttl, rendering it
+// with render otherwise. Requests coming while it's being rendered wait for
+// it, errors included, which aren't kept any longer.
+func (fc *feedCache) get(key string, user string, ttl time.Duration, render func() (string, error)) (string, error) {
+	now := time.Now()
+
+	fc.mu.Lock()
+
+	if feed, ok := fc.entries[key]; ok {
+		select {
+		case <-feed.done:
+			if now.Before(feed.expires) {
+				fc.mu.Unlock()
+				return feed.body, nil
+			}
+		default:
+			fc.mu.Unlock()
+			<-feed.done
+			return feed.body, feed.err
+		}
+	}
+
+	fc.dropExpired(now)
+
+	feed := &renderedFeed{user: user, done: make(chan struct{})}
+	fc.entries[key] = feed
+
+	fc.mu.Unlock()
+
+	feed.render(ttl, render)
+
+	return feed.body, feed.err
+}
+
+// render sets the body of the feed, or the error rendering it, panics
+// included, so the requests waiting for it are always let go
+func (feed *renderedFeed) render(ttl time.Duration, render func() (string, error)) {
+	defer close(feed.done)
+	defer func() {
+		if r := recover(); r != nil {
+			feed.body, feed.err = "", fmt.Errorf("rendering the feed panicked: %v", r)
+		}
+	}()
+
+	feed.body, feed.err = render()
+	if feed.err == nil {
+		feed.expires = time.Now().Add(ttl)
+	}
+}
+
+// forget drops the feeds rendered for user, once their events changed
+func (fc *feedCache) forget(user string) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	for key, feed := range fc.entries {
+		if feed.user == user {
+			delete(fc.entries, key)
+		}
+	}
+}
+
+// sweep drops the feeds expired by now, for those polled no more, and the
+// versions of those not served for feedVersionTTL
+func (fc *feedCache) sweep(now time.Time) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	fc.dropExpired(now)
+
+	for key, v := range fc.versions {
+		if now.Sub(v.served) >= feedVersionTTL {
+			delete(fc.versions, key)
+		}
+	}
+}
+
+// forgetUser drops everything kept for the feeds of user, once logged out or
+// revoked
+func (fc *feedCache) forgetUser(user string) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	for key, feed := range fc.entries {
+		if feed.user == user {
+			delete(fc.entries, key)
+		}
+	}
+
+	for key, v := range fc.versions {
+		if v.user == user {
+			delete(fc.versions, key)
+		}
+	}
+}
+
+// forgetToken drops everything kept for the feeds served under token, once
+// revoked
+func (fc *feedCache) forgetToken(token string) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	for key := range fc.entries {
+		if strings.HasPrefix(key, token+" ") {
+			delete(fc.entries, key)
+		}
+	}
+
+	for key := range fc.versions {
+		if strings.HasPrefix(key, token+" ") {
+			delete(fc.versions, key)
+		}
+	}
+}
+
+// dropExpired drops the feeds rendered which expired by now, with fc.mu held
+func (fc *feedCache) dropExpired(now time.Time) {
+	for key, feed := range fc.entries {
+		if isDone(feed.done) && !now.Before(feed.expires) {
+			delete(fc.entries, key)
+		}
+	}
+}
+
+// version returns the ETag of the feed of user rendered under key, and when
+// it last changed, as far as this instance knows
+func (fc *feedCache) version(key string, user string, body string) (string, time.Time) {
+	etag := feedETag(body)
+	now := time.Now().UTC()
+
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	v, ok := fc.versions[key]
+	if !ok || v.etag != etag {
+		// HTTP dates only go down to the second
+		v = &feedVersion{etag: etag, modified: now.Truncate(time.Second), user: user}
+		fc.versions[key] = v
+	}
+
+	v.served = now
+
+	return v.etag, v.modified
+}
+
+func isDone(done chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFeedCacheCoalesces(t *testing.T) {
+	fc := newFeedCache()
+
+	var renders int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	render := func() (string, error) {
+		if atomic.AddInt32(&renders, 1) == 1 {
+			close(started)
+		}
+
+		<-release
+
+		return "feed", nil
+	}
+
+	var wg sync.WaitGroup
+	bodies := make(chan string, 8)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		body, _ := fc.get("token", "jane.doe", time.Hour, render)
+		bodies <- body
+	}()
+
+	<-started
+
+	for i := 0; i < 7; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			body, _ := fc.get("token", "jane.doe", time.Hour, render)
+			bodies <- body
+		}()
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+
+	wg.Wait()
+	close(bodies)
+
+	for body := range bodies {
+		if body != "feed" {
+			t.Errorf("served %q", body)
+		}
+	}
+
+	if renders != 1 {
+		t.Errorf("rendered %d times", renders)
+	}
+
+	// Other options are rendered on their own
+	if body, _ := fc.get("token full", "jane.doe", time.Hour, func() (string, error) { return "full", nil }); body != "full" {
+		t.Errorf("served %q", body)
+	}
+}
+
+func TestFeedCacheExpiry(t *testing.T) {
+	fc := newFeedCache()
+
+	var renders int
+	render := func() (string, error) {
+		renders++
+		return "feed", nil
+	}
+
+	// Errors aren't kept
+	if _, err := fc.get("token", "jane.doe", time.Hour, func() (string, error) { return "", errors.New("down") }); err == nil {
+		t.Fatal("error not returned")
+	}
+
+	fc.get("token", "jane.doe", time.Hour, render)
+	fc.get("token", "jane.doe", time.Hour, render)
+
+	if renders != 1 {
+		t.Errorf("rendered %d times within the TTL", renders)
+	}
+
+	// Nor are the feeds of users whose events changed
+	fc.forget("jane.doe")
+	fc.get("token", "jane.doe", time.Hour, render)
+
+	// Nor any feed without a TTL
+	fc.get("other", "john.doe", 0, render)
+	fc.get("other", "john.doe", 0, render)
+
+	if renders != 4 {
+		t.Errorf("rendered %d times", renders)
+	}
+}
+
+func TestFeedCachePanics(t *testing.T) {
+	fc := newFeedCache()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	errs := make(chan error, 2)
+	go func() {
+		_, err := fc.get("token", "jane.doe", time.Hour, func() (string, error) {
+			close(started)
+			<-release
+			panic("boom")
+		})
+		errs <- err
+	}()
+
+	<-started
+
+	// Polls waiting for the render are let go with its error
+	go func() {
+		_, err := fc.get("token", "jane.doe", time.Hour, func() (string, error) { return "feed", nil })
+		errs <- err
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errs:
+			if err == nil {
+				t.Error("panic not returned as an error")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("poll blocked after a render panicked")
+		}
+	}
+
+	// And the next one renders it again
+	if body, err := fc.get("token", "jane.doe", time.Hour, func() (string, error) { return "feed", nil }); err != nil || body != "feed" {
+		t.Errorf("served %q, %v", body, err)
+	}
+}
+
+func TestFeedCacheSweep(t *testing.T) {
+	fc := newFeedCache()
+
+	render := func() (string, error) { return "feed", nil }
+
+	fc.get("short", "jane.doe", time.Minute, render)
+	fc.get("long", "jane.doe", time.Hour, render)
+
+	// Feeds polled no more go once expired
+	fc.sweep(time.Now().Add(2 * time.Minute))
+
+	if _, ok := fc.entries["short"]; ok {
+		t.Error("expired feed kept")
+	}
+
+	if _, ok := fc.entries["long"]; !ok {
+		t.Error("feed dropped within its TTL")
+	}
+}
+
+func TestFeedKey(t *testing.T) {
+	setSyncWindow(t, "0d", "4w", "365d")
+
+	key := func(query string) string {
+		params, err := url.ParseQuery(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		opts, err := parseFeedOptions("localhost:5000", params)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return feedKey("token", opts)
+	}
+
+	tests := []struct {
+		a    string
+		b    string
+		same bool
+	}{
+		{"full=true&google=true", "google=true&full=true", true},
+		{"full=true", "full=true&nocache=1234", true},
+		{"", "future=4w&titles=true", true},
+		{"calendars=default,work", "calendars=,work,work", true},
+		{"full=true", "full=false", false},
+		{"calendars=work,home", "calendars=home,work", false},
+		{"past=1w", "past=2w", false},
+	}
+
+	for _, tt := range tests {
+		if same := key(tt.a) == key(tt.b); same != tt.same {
+			t.Errorf("%q and %q: same key %v", tt.a, tt.b, same)
+		}
+	}
+}
+
+func TestFeedCacheVersions(t *testing.T) {
+	fc := newFeedCache()
+
+	etag, modified := fc.version("jane", "jane.doe", "feed")
+	fc.version("jane full", "jane.doe", "feed")
+	fc.version("named full", "jane.doe", "feed")
+	fc.version("john", "john.doe", "feed")
+
+	// The same body keeps its version, another one gets a new one
+	if again, since := fc.version("jane", "jane.doe", "feed"); again != etag || !since.Equal(modified) {
+		t.Errorf("version moved from %s, %v to %s, %v", etag, modified, again, since)
+	}
+
+	if other, _ := fc.version("jane", "jane.doe", "changed"); other == etag {
+		t.Error("same version for another body")
+	}
+
+	// Revoked feeds and logged out users are forgotten
+	fc.forgetToken("named")
+	fc.forgetUser("john.doe")
+
+	if len(fc.versions) != 2 || fc.versions["jane"] == nil || fc.versions["jane full"] == nil {
+		t.Errorf("versions %v left", fc.versions)
+	}
+
+	// As are the feeds no longer served
+	fc.versions["jane full"].served = time.Now().Add(-feedVersionTTL)
+	fc.sweep(time.Now())
+
+	if len(fc.versions) != 1 || fc.versions["jane"] == nil {
+		t.Errorf("versions %v left", fc.versions)
+	}
+}
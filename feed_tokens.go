@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	feedNameMaxLength = 100
+
+	// The last use of a named feed is written back at most this often
+	feedTouchInterval = time.Minute
+)
+
+var errInvalidFeed = errors.New("invalid named feed")
+
+// feedOptionNames are the feed options a named feed can store
+var feedOptionNames = map[string]bool{
+	"full":      true,
+	"google":    true,
+	"recurring": true,
+	"weekends":  true,
+	"bodies":    true,
+	"titles":    true,
+	"past":      true,
+	"future":    true,
+	"calendars": true,
+	"mailbox":   true,
+}
+
+// feedTokens are the named feeds of every user, by token
+var feedTokens map[string]*FeedToken
+var feedTokensMu sync.Mutex
+
+// reloadFeedTokens replaces the named feeds known to the service with the
+// stored ones, keeping the latest use of each
+func reloadFeedTokens() error {
+	stored, err := cachedData.loadFeedTokens()
+	if err != nil {
+		return err
+	}
+
+	feedTokensMu.Lock()
+	defer feedTokensMu.Unlock()
+
+	loaded := make(map[string]*FeedToken, len(stored))
+	for _, feed := range stored {
+		if known, ok := feedTokens[feed.token]; ok && known.lastUsed.After(feed.lastUsed) {
+			feed.lastUsed = known.lastUsed
+		}
+
+		loaded[feed.token] = feed
+	}
+
+	feedTokens = loaded
+
+	return nil
+}
+
+// newFeedToken mints a named feed for user, serving the given options, which
+// are checked the way feeds check them
+func newFeedToken(user string, name string, options url.Values) (*FeedToken, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > feedNameMaxLength {
+		return nil, fmt.Errorf("%w: it needs a name of up to %d characters", errInvalidFeed, feedNameMaxLength)
+	}
+
+	for option := range options {
+		if !feedOptionNames[option] {
+			return nil, fmt.Errorf("%w: unknown option %s", errInvalidFeed, option)
+		}
+	}
+
+	if _, err := parseFeedOptions("", options); err != nil {
+		return nil, fmt.Errorf("%w: %s", errInvalidFeed, err)
+	}
+
+	token, err := secureRandomString(45)
+	if err != nil {
+		return nil, err
+	}
+
+	feed := &FeedToken{
+		token:   token,
+		user:    user,
+		name:    name,
+		options: options.Encode(),
+		created: time.Now().UTC(),
+	}
+
+	if err := cachedData.saveFeedToken(feed); err != nil {
+		return nil, err
+	}
+
+	copied := *feed
+
+	feedTokensMu.Lock()
+	feedTokens[feed.token] = &copied
+	feedTokensMu.Unlock()
+
+	return feed, nil
+}
+
+// findFeedToken returns the named feed behind token, if any
+func findFeedToken(token string) *FeedToken {
+	feedTokensMu.Lock()
+	defer feedTokensMu.Unlock()
+
+	feed, ok := feedTokens[token]
+	if !ok {
+		return nil
+	}
+
+	copied := *feed
+
+	return &copied
+}
+
+// useFeedToken is findFeedToken, recording the use of the named feed
+func useFeedToken(token string) *FeedToken {
+	now := time.Now().UTC()
+
+	feedTokensMu.Lock()
+
+	feed, ok := feedTokens[token]
+	if !ok {
+		feedTokensMu.Unlock()
+		return nil
+	}
+
+	touch := now.Sub(feed.lastUsed) >= feedTouchInterval
+	if touch {
+		feed.lastUsed = now
+	}
+
+	copied := *feed
+
+	feedTokensMu.Unlock()
+
+	if touch {
+		if err := cachedData.touchFeedToken(token, now); err != nil {
+			log.Warn().
+				Err(err).
+				Str("user", copied.user).
+				Str("method", "useFeedToken").
+				Msg("Unable to record the use of a named feed")
+		}
+	}
+
+	return &copied
+}
+
+// userFeedTokens returns the named feeds of user, oldest first
+func userFeedTokens(user string) []*FeedToken {
+	var feeds []*FeedToken
+
+	feedTokensMu.Lock()
+	defer feedTokensMu.Unlock()
+
+	for _, feed := range feedTokens {
+		if feed.user == user {
+			copied := *feed
+			feeds = append(feeds, &copied)
+		}
+	}
+
+	sort.Slice(feeds, func(i, j int) bool {
+		return feeds[i].created.Before(feeds[j].created)
+	})
+
+	return feeds
+}
+
+// removeFeedToken revokes a single named feed
+func removeFeedToken(token string) error {
+	if err := cachedData.removeFeedToken(token); err != nil {
+		return err
+	}
+
+	feedTokensMu.Lock()
+	delete(feedTokens, token)
+	feedTokensMu.Unlock()
+
+	renderedFeeds.forgetToken(token)
+
+	return nil
+}
+
+// forgetFeedTokens drops the named feeds of a revoked user, already removed
+// from the storage along with the rest of their data
+func forgetFeedTokens(user string) {
+	feedTokensMu.Lock()
+	defer feedTokensMu.Unlock()
+
+	for token, feed := range feedTokens {
+		if feed.user == user {
+			delete(feedTokens, token)
+		}
+	}
+}
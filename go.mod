@@ -6,6 +6,7 @@ require (
 	github.com/arran4/golang-ical v0.0.0-20220220103556-c519bf07e7e6
 	github.com/labstack/echo/v4 v4.7.0
 	github.com/lib/pq v1.10.4
+	github.com/mattn/go-sqlite3 v1.14.12
 	github.com/rs/zerolog v1.26.1
 	github.com/spf13/viper v1.10.1
 	golang.org/x/net v0.0.0-20211015210444-4f30a5c0130f
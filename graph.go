@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// GraphError is the error object returned by Graph along with non 2xx
+// responses, and the HTTP status they came with
+type GraphError struct {
+	StatusCode int    `json:"-"`
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+}
+
+func (e *GraphError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// User is the signed in user, as returned by /me
+type User struct {
+	DisplayName       string `json:"displayName"`
+	UserPrincipalName string `json:"userPrincipalName"`
+	Mail              string `json:"mail"`
+}
+
+type UserPage struct {
+	Value    []*User `json:"value"`
+	NextLink string  `json:"@odata.nextLink"`
+}
+
+// DateTimeTimeZone is a wall clock time along with the zone it is in
+type DateTimeTimeZone struct {
+	DateTime string `json:"dateTime"`
+	TimeZone string `json:"timeZone"`
+}
+
+type EmailAddress struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+}
+
+type Recipient struct {
+	EmailAddress *EmailAddress `json:"emailAddress"`
+}
+
+type ResponseStatus struct {
+	Response string `json:"response"`
+	Time     string `json:"time"`
+}
+
+type Attendee struct {
+	Type         string          `json:"type"`
+	Status       *ResponseStatus `json:"status"`
+	EmailAddress *EmailAddress   `json:"emailAddress"`
+}
+
+type Location struct {
+	DisplayName string `json:"displayName"`
+}
+
+type ItemBody struct {
+	ContentType string `json:"contentType"`
+	Content     string `json:"content"`
+}
+
+type OnlineMeeting struct {
+	JoinURL string `json:"joinUrl"`
+}
+
+type RecurrencePattern struct {
+	Type           string   `json:"type"`
+	Interval       int      `json:"interval"`
+	Month          int      `json:"month"`
+	DayOfMonth     int      `json:"dayOfMonth"`
+	DaysOfWeek     []string `json:"daysOfWeek"`
+	FirstDayOfWeek string   `json:"firstDayOfWeek"`
+	Index          string   `json:"index"`
+}
+
+type RecurrenceRange struct {
+	Type                string `json:"type"`
+	StartDate           string `json:"startDate"`
+	EndDate             string `json:"endDate"`
+	NumberOfOccurrences int    `json:"numberOfOccurrences"`
+}
+
+type PatternedRecurrence struct {
+	Pattern *RecurrencePattern `json:"pattern"`
+	Range   *RecurrenceRange   `json:"range"`
+}
+
+// Removed flags the events deleted since the previous delta query
+type Removed struct {
+	Reason string `json:"reason"`
+}
+
+// Event is a Graph event. Every nested object may be missing, so they are
+// meant to be read through the nil safe accessors below.
+type Event struct {
+	ID                   string               `json:"id"`
+	Type                 string               `json:"type,omitempty"`
+	SeriesMasterID       string               `json:"seriesMasterId,omitempty"`
+	OriginalStart        string               `json:"originalStart,omitempty"`
+	CreatedDateTime      string               `json:"createdDateTime,omitempty"`
+	LastModifiedDateTime string               `json:"lastModifiedDateTime,omitempty"`
+	Subject              string               `json:"subject,omitempty"`
+	Body                 *ItemBody            `json:"body,omitempty"`
+	Start                *DateTimeTimeZone    `json:"start,omitempty"`
+	End                  *DateTimeTimeZone    `json:"end,omitempty"`
+	IsAllDay             bool                 `json:"isAllDay,omitempty"`
+	ShowAs               string               `json:"showAs,omitempty"`
+	Location             *Location            `json:"location,omitempty"`
+	ResponseStatus       *ResponseStatus      `json:"responseStatus,omitempty"`
+	Organizer            *Recipient           `json:"organizer,omitempty"`
+	Attendees            []*Attendee          `json:"attendees,omitempty"`
+	HasAttachments       bool                 `json:"hasAttachments,omitempty"`
+	OnlineMeeting        *OnlineMeeting       `json:"onlineMeeting,omitempty"`
+	Recurrence           *PatternedRecurrence `json:"recurrence,omitempty"`
+	Removed              *Removed             `json:"@removed,omitempty"`
+}
+
+// eventFields are the properties of an event the feeds are built from
+var eventFields = []string{
+	"id", "type", "seriesMasterId", "originalStart", "createdDateTime", "lastModifiedDateTime",
+	"subject", "start", "end", "isAllDay", "showAs", "location", "responseStatus", "organizer",
+	"attendees", "hasAttachments", "onlineMeeting", "recurrence",
+}
+
+// selectEventFields returns the $select query option for events, leaving
+// their body, usually the largest property by far, out unless needed
+func selectEventFields(withBody bool) string {
+	fields := eventFields
+	if withBody {
+		fields = append(fields[:len(fields):len(fields)], "body")
+	}
+
+	return "$select=" + strings.Join(fields, ",")
+}
+
+// GraphCalendar is one of the calendars of the user
+type GraphCalendar struct {
+	ID                string `json:"id"`
+	Name              string `json:"name"`
+	IsDefaultCalendar bool   `json:"isDefaultCalendar"`
+}
+
+type CalendarPage struct {
+	Value    []*GraphCalendar `json:"value"`
+	NextLink string           `json:"@odata.nextLink"`
+}
+
+// EventAttachment is an attachment of an event, without its contents
+type EventAttachment struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	ContentType string `json:"contentType"`
+	Size        int    `json:"size"`
+}
+
+// EventPage is a page of a calendar view or delta query
+type EventPage struct {
+	Value     []*Event `json:"value"`
+	NextLink  string   `json:"@odata.nextLink"`
+	DeltaLink string   `json:"@odata.deltaLink"`
+}
+
+type AttachmentPage struct {
+	Value    []*EventAttachment `json:"value"`
+	NextLink string             `json:"@odata.nextLink"`
+}
+
+// BatchRequest is one of the requests of a JSON batch, its url being relative
+// to the API version
+type BatchRequest struct {
+	ID     string `json:"id"`
+	Method string `json:"method"`
+	URL    string `json:"url"`
+}
+
+// BatchResponse answers one of the requests of a JSON batch. Its body holds
+// the JSON returned, or a base64 string for any other content.
+type BatchResponse struct {
+	ID      string            `json:"id"`
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    json.RawMessage   `json:"body,omitempty"`
+}
+
+type BatchPayload struct {
+	Requests []*BatchRequest `json:"requests"`
+}
+
+type BatchResult struct {
+	Responses []*BatchResponse `json:"responses"`
+}
+
+type GraphSubscription struct {
+	ID                 string `json:"id"`
+	ExpirationDateTime string `json:"expirationDateTime"`
+}
+
+type MailboxTimeZone struct {
+	Value string `json:"value"`
+}
+
+// decodeGraphResponse decodes body into v, unless it holds a Graph error,
+// which is returned as a *GraphError
+func decodeGraphResponse(body []byte, v interface{}) error {
+	var errResponse struct {
+		Error *GraphError `json:"error"`
+	}
+
+	if err := json.Unmarshal(body, &errResponse); err != nil {
+		return err
+	}
+
+	if errResponse.Error != nil {
+		return errResponse.Error
+	}
+
+	return json.Unmarshal(body, v)
+}
+
+// parse reads the date in its own time zone, returning the zero time if missing
+func (d *DateTimeTimeZone) parse() time.Time {
+	if d == nil {
+		return time.Time{}
+	}
+
+	t, _ := time.ParseInLocation(StartEndTimeParse, d.DateTime, resolveTimeZone(d.TimeZone))
+
+	return t
+}
+
+func (a *EmailAddress) name() string {
+	if a == nil {
+		return ""
+	}
+
+	return a.Name
+}
+
+func (a *EmailAddress) address() string {
+	if a == nil {
+		return ""
+	}
+
+	return a.Address
+}
+
+func (r *Recipient) emailAddress() *EmailAddress {
+	if r == nil {
+		return nil
+	}
+
+	return r.EmailAddress
+}
+
+// response defaults to "none", as Graph does when nobody answered
+func (s *ResponseStatus) response() string {
+	if s == nil || s.Response == "" {
+		return "none"
+	}
+
+	return s.Response
+}
+
+func (a *Attendee) response() string {
+	if a == nil {
+		return "none"
+	}
+
+	return a.Status.response()
+}
+
+func (e *Event) startTime() time.Time {
+	return e.Start.parse()
+}
+
+func (e *Event) endTime() time.Time {
+	return e.End.parse()
+}
+
+// originalStartTime is the start the instance had on its series, before
+// being moved
+func (e *Event) originalStartTime() time.Time {
+	if t, err := time.Parse(time.RFC3339, e.OriginalStart); err == nil {
+		return t
+	}
+
+	return e.startTime()
+}
+
+func (e *Event) response() string {
+	return e.ResponseStatus.response()
+}
+
+func (e *Event) locationName() string {
+	if e.Location == nil {
+		return ""
+	}
+
+	return e.Location.DisplayName
+}
+
+func (e *Event) bodyContent() string {
+	if e.Body == nil {
+		return ""
+	}
+
+	return e.Body.Content
+}
+
+func (e *Event) joinURL() string {
+	if e.OnlineMeeting == nil {
+		return ""
+	}
+
+	return e.OnlineMeeting.JoinURL
+}
+
+func (e *Event) isSeriesInstance() bool {
+	return (e.Type == "occurrence" || e.Type == "exception") && e.SeriesMasterID != ""
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+	"golang.org/x/oauth2"
+)
+
+const (
+	defaultGraphURL = "https://graph.microsoft.com/v1.0"
+	defaultLoginURL = "https://login.microsoftonline.com"
+
+	graphMaxAttempts   = 5
+	graphMaxRetryDelay = 30 * time.Second
+
+	defaultGraphPageSize = 250
+	graphMaxPageSize     = 1000
+)
+
+// graphRetryBackoff is the first delay between retries when Graph does not
+// send a Retry-After, doubling on every attempt
+var graphRetryBackoff = time.Second
+
+// GraphClient performs the requests to Microsoft Graph on behalf of a user.
+// Paths are relative to graph_url, unless they are absolute URLs such as the
+// nextLink and deltaLink returned by Graph.
+type GraphClient interface {
+	get(path string, prefer ...string) ([]byte, error)
+	send(method string, path string, payload interface{}) ([]byte, error)
+	download(path string, w io.Writer) error
+}
+
+// httpGraphClient is the GraphClient talking to graph_url through an
+// authenticated HTTP client
+type httpGraphClient struct {
+	baseURL string
+	client  *http.Client
+}
+
+func graphURL() string {
+	if url := viper.GetString("graph_url"); url != "" {
+		return strings.TrimRight(url, "/")
+	}
+
+	return defaultGraphURL
+}
+
+// graphPageSize is how many events to ask Graph for on every page, up to the
+// maximum it accepts
+func graphPageSize() int {
+	size := viper.GetInt("graph_page_size")
+	if size <= 0 {
+		return defaultGraphPageSize
+	}
+
+	if size > graphMaxPageSize {
+		return graphMaxPageSize
+	}
+
+	return size
+}
+
+// oauthEndpoint is the Azure AD endpoint of the tenant, served from login_url
+func oauthEndpoint() oauth2.Endpoint {
+	base := defaultLoginURL
+	if url := viper.GetString("login_url"); url != "" {
+		base = strings.TrimRight(url, "/")
+	}
+
+	tenant := viper.GetString("tenant")
+	if tenant == "" {
+		tenant = "common"
+	}
+
+	return oauth2.Endpoint{
+		AuthURL:  base + "/" + tenant + "/oauth2/v2.0/authorize",
+		TokenURL: base + "/" + tenant + "/oauth2/v2.0/token",
+	}
+}
+
+func newGraphClient(client *http.Client) *httpGraphClient {
+	return &httpGraphClient{
+		baseURL: graphURL(),
+		client:  client,
+	}
+}
+
+func (g *httpGraphClient) url(path string) string {
+	if strings.HasPrefix(path, "https://") || strings.HasPrefix(path, "http://") {
+		return path
+	}
+
+	return g.baseURL + path
+}
+
+// isAuthError reports whether err comes from Graph rejecting the access token
+// or from Azure AD refusing to refresh it, meaning the user has to log in again.
+// Azure AD being unavailable says nothing about the credentials.
+func isAuthError(err error) bool {
+	var graphErr *GraphError
+	if errors.As(err, &graphErr) {
+		return graphErr.StatusCode == http.StatusUnauthorized
+	}
+
+	var retrieveErr *oauth2.RetrieveError
+	if !errors.As(err, &retrieveErr) || retrieveErr.Response == nil {
+		return false
+	}
+
+	if retrieveErr.Response.StatusCode != http.StatusBadRequest && retrieveErr.Response.StatusCode != http.StatusUnauthorized {
+		return false
+	}
+
+	switch tokenErrorCode(retrieveErr) {
+	case "invalid_grant", "interaction_required", "invalid_client":
+		return true
+	}
+
+	return false
+}
+
+// tokenErrorCode returns the OAuth error code Azure AD answered a token
+// request with
+func tokenErrorCode(err *oauth2.RetrieveError) string {
+	var body struct {
+		Error string `json:"error"`
+	}
+
+	if json.Unmarshal(err.Body, &body) != nil {
+		return ""
+	}
+
+	return body.Error
+}
+
+// tokenRetryDelay returns how long to wait before retrying a request whose
+// access token couldn't be refreshed on its given attempt, and false if it
+// should not be retried. Only Azure AD being throttled or unavailable is.
+func tokenRetryDelay(err error, attempt int) (time.Duration, bool) {
+	var retrieveErr *oauth2.RetrieveError
+	if !errors.As(err, &retrieveErr) || retrieveErr.Response == nil {
+		return 0, false
+	}
+
+	if retrieveErr.Response.StatusCode != http.StatusTooManyRequests && retrieveErr.Response.StatusCode < http.StatusInternalServerError {
+		return 0, false
+	}
+
+	if attempt+1 >= graphMaxAttempts {
+		return 0, false
+	}
+
+	return graphRetryBackoff << attempt, true
+}
+
+// isAccessLost reports whether Graph denied access to a resource or couldn't
+// find it, as happens once a calendar is deleted or no longer shared
+func isAccessLost(err error) bool {
+	var graphErr *GraphError
+	if errors.As(err, &graphErr) {
+		return graphErr.StatusCode == http.StatusForbidden || graphErr.StatusCode == http.StatusNotFound
+	}
+
+	return false
+}
+
+// readGraphError consumes the body of a non 2xx response, which should hold a
+// Graph error object
+func readGraphError(resp *http.Response) *GraphError {
+	var errResponse struct {
+		Error *GraphError `json:"error"`
+	}
+
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	graphErr := &GraphError{Code: http.StatusText(resp.StatusCode), Message: strings.TrimSpace(string(body))}
+	if err := json.Unmarshal(body, &errResponse); err == nil && errResponse.Error != nil {
+		graphErr = errResponse.Error
+	}
+
+	graphErr.StatusCode = resp.StatusCode
+
+	return graphErr
+}
+
+// retryDelay returns how long to wait before retrying a request that got resp
+// on its given attempt, and false if it should not be retried at all. Graph
+// asks to back off with a 429 or a 503, usually stating for how long.
+func retryDelay(resp *http.Response, attempt int) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return 0, false
+	}
+
+	if attempt+1 >= graphMaxAttempts {
+		return 0, false
+	}
+
+	delay := graphRetryBackoff << attempt
+
+	if retryAfter := resp.Header.Get("Retry-After"); retryAfter != "" {
+		if seconds, err := strconv.Atoi(retryAfter); err == nil {
+			delay = time.Duration(seconds) * time.Second
+		} else if t, err := http.ParseTime(retryAfter); err == nil {
+			delay = time.Until(t)
+		}
+	}
+
+	if delay < 0 {
+		delay = 0
+	}
+
+	// Better to fail now and serve what was synced than to hold the feed
+	return delay, delay <= graphMaxRetryDelay
+}
+
+// roundTrip sends req, retrying it while Graph or Azure AD are throttling or
+// unavailable, and turns the responses other than 2xx into a *GraphError
+func (g *httpGraphClient) roundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		r := req.Clone(req.Context())
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+
+			r.Body = body
+		}
+
+		resp, err := g.client.Do(r)
+		if err != nil {
+			delay, retry := tokenRetryDelay(err, attempt)
+			if !retry {
+				return nil, err
+			}
+
+			log.Warn().
+				Err(err).
+				Str("path", req.URL.Path).
+				Int("attempt", attempt+1).
+				Dur("delay", delay).
+				Str("method", "roundTrip").
+				Msg("Unable to refresh the access token, retrying")
+
+			time.Sleep(delay)
+
+			continue
+		}
+
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return resp, nil
+		}
+
+		graphErr := readGraphError(resp)
+
+		delay, retry := retryDelay(resp, attempt)
+		if !retry {
+			return nil, graphErr
+		}
+
+		log.Warn().
+			Err(graphErr).
+			Str("path", req.URL.Path).
+			Int("attempt", attempt+1).
+			Dur("delay", delay).
+			Str("method", "roundTrip").
+			Msg("Graph is throttling, retrying")
+
+		time.Sleep(delay)
+	}
+}
+
+func (g *httpGraphClient) do(req *http.Request) ([]byte, error) {
+	resp, err := g.roundTrip(req)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	return body, nil
+}
+
+func (g *httpGraphClient) get(path string, prefer ...string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, g.url(path), nil)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	if len(prefer) > 0 {
+		req.Header.Set("Prefer", strings.Join(prefer, ", "))
+	}
+
+	return g.do(req)
+}
+
+// send sends payload, encoded as JSON, to path with the given method. A nil
+// payload sends no body, as for deletions.
+func (g *httpGraphClient) send(method string, path string, payload interface{}) ([]byte, error) {
+	if payload == nil {
+		req, err := http.NewRequest(method, g.url(path), nil)
+		if err != nil {
+			return []byte{}, err
+		}
+
+		return g.do(req)
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	req, err := http.NewRequest(method, g.url(path), bytes.NewReader(data))
+	if err != nil {
+		return []byte{}, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	return g.do(req)
+}
+
+// download copies the raw contents at path, such as an attachment $value, to w
+func (g *httpGraphClient) download(path string, w io.Writer) error {
+	req, err := http.NewRequest(http.MethodGet, g.url(path), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := g.roundTrip(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	_, err = io.Copy(w, resp.Body)
+
+	return err
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"golang.org/x/oauth2"
+)
+
+// newTestGraphClient returns a client for a Graph answering every request
+// with handler, counting them on calls
+func newTestGraphClient(t *testing.T, calls *int32, handler http.HandlerFunc) *httpGraphClient {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(calls, 1)
+		handler(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	viper.Set("graph_url", server.URL)
+	t.Cleanup(viper.Reset)
+
+	backoff := graphRetryBackoff
+	graphRetryBackoff = time.Millisecond
+	t.Cleanup(func() { graphRetryBackoff = backoff })
+
+	return newGraphClient(server.Client())
+}
+
+func TestGraphClientRetriesThrottled(t *testing.T) {
+	var calls int32
+
+	graph := newTestGraphClient(t, &calls, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if string(body) != `{"subject":"Retried"}` {
+			t.Errorf("attempt %d sent %q", atomic.LoadInt32(&calls), body)
+		}
+
+		if atomic.LoadInt32(&calls) < 3 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Write([]byte(`{"id":"created"}`))
+	})
+
+	body, err := graph.send(http.MethodPost, "/me/events", map[string]string{"subject": "Retried"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(body) != `{"id":"created"}` || calls != 3 {
+		t.Errorf("got %q after %d attempts", body, calls)
+	}
+}
+
+func TestGraphClientGivesUp(t *testing.T) {
+	var calls int32
+
+	graph := newTestGraphClient(t, &calls, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"error":{"code":"TooManyRequests","message":"Please retry again later."}}`))
+	})
+
+	_, err := graph.get("/me")
+
+	var graphErr *GraphError
+	if !errors.As(err, &graphErr) || graphErr.StatusCode != http.StatusTooManyRequests || graphErr.Code != "TooManyRequests" {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if calls != graphMaxAttempts {
+		t.Errorf("gave up after %d attempts, expected %d", calls, graphMaxAttempts)
+	}
+}
+
+func TestGraphClientErrors(t *testing.T) {
+	var calls int32
+
+	graph := newTestGraphClient(t, &calls, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":{"code":"ErrorItemNotFound","message":"The specified object was not found in the store."}}`))
+		default:
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte("<html>Bad Gateway</html>\n"))
+		}
+	})
+
+	tests := []struct {
+		path    string
+		code    string
+		message string
+		status  int
+	}{
+		{"/missing", "ErrorItemNotFound", "The specified object was not found in the store.", http.StatusNotFound},
+		{"/proxy", "Bad Gateway", "<html>Bad Gateway</html>", http.StatusBadGateway},
+	}
+
+	for _, tt := range tests {
+		atomic.StoreInt32(&calls, 0)
+
+		var graphErr *GraphError
+
+		err := graph.download(tt.path, io.Discard)
+		if !errors.As(err, &graphErr) {
+			t.Fatalf("%s: unexpected error %v", tt.path, err)
+		}
+
+		if graphErr.StatusCode != tt.status || graphErr.Code != tt.code || graphErr.Message != tt.message {
+			t.Errorf("%s: got %+v", tt.path, graphErr)
+		}
+
+		if calls != 1 {
+			t.Errorf("%s: retried %d times", tt.path, calls-1)
+		}
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		retryAfter string
+		attempt    int
+		delay      time.Duration
+		retry      bool
+	}{
+		{"seconds", http.StatusTooManyRequests, "2", 0, 2 * time.Second, true},
+		{"http date", http.StatusServiceUnavailable, time.Now().Add(time.Hour).UTC().Format(http.TimeFormat), 0, 0, false},
+		{"too long", http.StatusTooManyRequests, "120", 0, 0, false},
+		{"backoff", http.StatusTooManyRequests, "", 2, 4 * graphRetryBackoff, true},
+		{"last attempt", http.StatusTooManyRequests, "1", graphMaxAttempts - 1, 0, false},
+		{"not throttled", http.StatusInternalServerError, "1", 0, 0, false},
+	}
+
+	for _, tt := range tests {
+		resp := &http.Response{StatusCode: tt.status, Header: http.Header{}}
+		if tt.retryAfter != "" {
+			resp.Header.Set("Retry-After", tt.retryAfter)
+		}
+
+		delay, retry := retryDelay(resp, tt.attempt)
+		if retry != tt.retry || (retry && delay != tt.delay) {
+			t.Errorf("%s: got %v, %v", tt.name, delay, retry)
+		}
+	}
+}
+
+// refreshError is the error of a request whose access token couldn't be
+// refreshed, Azure AD answering with status and body
+func refreshError(status int, body string) error {
+	return &url.Error{Op: "Get", URL: "https://graph.microsoft.com/v1.0/me", Err: &oauth2.RetrieveError{
+		Response: &http.Response{StatusCode: status, Status: http.StatusText(status)},
+		Body:     []byte(body),
+	}}
+}
+
+func TestIsAuthError(t *testing.T) {
+	tests := []struct {
+		err  error
+		auth bool
+	}{
+		{&GraphError{StatusCode: http.StatusUnauthorized, Code: "InvalidAuthenticationToken"}, true},
+		{fmt.Errorf("delta query failed: %w", &GraphError{StatusCode: http.StatusUnauthorized}), true},
+		{fmt.Errorf("delta query failed: %w", refreshError(http.StatusBadRequest, `{"error":"invalid_grant"}`)), true},
+		{refreshError(http.StatusBadRequest, `{"error":"interaction_required"}`), true},
+		{refreshError(http.StatusUnauthorized, `{"error":"invalid_client"}`), true},
+		{refreshError(http.StatusBadRequest, `{"error":"temporarily_unavailable"}`), false},
+		{refreshError(http.StatusServiceUnavailable, `{"error":"invalid_grant"}`), false},
+		{refreshError(http.StatusInternalServerError, "<html>Server Error</html>"), false},
+		{&GraphError{StatusCode: http.StatusForbidden, Code: "ErrorAccessDenied"}, false},
+		{&url.Error{Op: "Get", URL: "https://graph.microsoft.com/v1.0/me", Err: errors.New("connection refused")}, false},
+		{nil, false},
+	}
+
+	for _, tt := range tests {
+		if got := isAuthError(tt.err); got != tt.auth {
+			t.Errorf("isAuthError(%v) = %v", tt.err, got)
+		}
+	}
+}
+
+func TestGraphPageSize(t *testing.T) {
+	t.Cleanup(viper.Reset)
+
+	tests := []struct {
+		configured int
+		size       int
+	}{
+		{0, defaultGraphPageSize},
+		{-1, defaultGraphPageSize},
+		{50, 50},
+		{5000, graphMaxPageSize},
+	}
+
+	for _, tt := range tests {
+		viper.Set("graph_page_size", tt.configured)
+
+		if size := graphPageSize(); size != tt.size {
+			t.Errorf("graph_page_size %d gave %d", tt.configured, size)
+		}
+	}
+}
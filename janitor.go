@@ -0,0 +1,104 @@
+package main
+
+import (
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// janitorInterval is how often the janitor looks for sessions to clean up
+var janitorInterval = 5 * time.Minute
+
+// cleanSessions runs the janitor of the sessions, and of the feeds rendered
+// for them
+func cleanSessions() {
+	for {
+		time.Sleep(janitorInterval)
+
+		renderedFeeds.sweep(time.Now())
+
+		if err := expireSessions(); err != nil {
+			log.Error().
+				Err(err).
+				Str("method", "expireSessions").
+				Send()
+		}
+	}
+}
+
+// expireSessions drops the logins abandoned for session_ttl, and the sessions
+// whose credentials were rejected as long ago, whose users get the same feed
+// back by logging in again. Their stored credentials are kept until then.
+// Users whose feed wasn't fetched for inactive_after are reported once, or
+// logged out with prune_inactive.
+func expireSessions() error {
+	now := time.Now()
+
+	abandoned := 0
+	for _, user := range sessions.expire(now.Add(-viper.GetDuration("session_ttl"))) {
+		if user == "" {
+			abandoned++
+			continue
+		}
+
+		log.Info().
+			Str("user", user).
+			Str("method", "expireSessions").
+			Msg("Dropped session needing to log in again")
+	}
+
+	if abandoned > 0 {
+		log.Info().
+			Int("sessions", abandoned).
+			Str("method", "expireSessions").
+			Msg("Dropped abandoned logins")
+	}
+
+	days, err := parseDays(viper.GetString("inactive_after"))
+	if err != nil || days == 0 {
+		return err
+	}
+
+	inactiveSince := now.AddDate(0, 0, -days)
+	prune := viper.GetBool("prune_inactive")
+
+	for token, cal := range sessions.loggedIn() {
+		// Provisioned feeds have nobody to log in again
+		if !cal.isValid() || cal.appMailbox != "" {
+			continue
+		}
+
+		last := cal.lastActivity()
+		if !last.Before(inactiveSince) {
+			continue
+		}
+
+		if prune {
+			log.Info().
+				Str("user", cal.userName).
+				Time("last_fetch", last).
+				Str("method", "expireSessions").
+				Msg("Logging out inactive user")
+
+			if err := logout(token); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		// Reported when they become inactive, not on every pass
+		if !cal.reportInactive() {
+			continue
+		}
+
+		log.Warn().
+			Str("user", cal.userName).
+			Time("last_fetch", last).
+			Str("method", "expireSessions").
+			Msg("Inactive user")
+	}
+
+	return nil
+}
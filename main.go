@@ -2,24 +2,16 @@ package main
 
 import (
 	"fmt"
-	"math/rand"
 	"os"
-	"time"
 
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/viper"
 )
 
-var loggedUsers map[string]*Calendar
-var cachedUsers map[string]string
-
 var BuildDate string
 
 func main() {
-	// TODO Add logout to clear user
-
 	var err error
-	var sqlConfs map[string]string
 
 	fmt.Printf("O365 to iCal build from %s\n", BuildDate)
 
@@ -30,30 +22,86 @@ func main() {
 		os.Exit(-1)
 	}
 
-	loggedUsers = make(map[string]*Calendar)
-	rand.Seed(time.Now().UnixNano())
+	viper.SetDefault("auto_migrate", true)
+	viper.SetDefault("week_start", "monday")
+	viper.SetDefault("bodies", true)
+	viper.SetDefault("sync_window.past", "0d")
+	viper.SetDefault("sync_window.future", "4w")
+	viper.SetDefault("sync_window.max", "365d")
+	viper.SetDefault("delta_sync_interval", "1m")
+	viper.SetDefault("feed_cache_ttl", "1m")
+	viper.SetDefault("session_ttl", "1h")
+	viper.SetDefault("inactive_after", "90d")
+
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrateCommand(os.Args[2:]); err != nil {
+			log.Fatal().Err(err).Send()
+			os.Exit(-1)
+		}
+
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "feeds" {
+		if err := runFeedsCommand(); err != nil {
+			log.Fatal().Err(err).Send()
+			os.Exit(-1)
+		}
 
-	sqlConfs = viper.GetStringMapString("psql")
+		return
+	}
 
-	err = initCache(&DBConfs{
-		user:     sqlConfs["user"],
-		password: sqlConfs["password"],
-		host:     sqlConfs["host"],
-		schema:   sqlConfs["schema"],
-	})
+	if len(os.Args) > 1 && os.Args[1] == "revoke" {
+		if err := runRevokeCommand(os.Args[2:]); err != nil {
+			log.Fatal().Err(err).Send()
+			os.Exit(-1)
+		}
 
+		return
+	}
+
+	err = initCache()
 	if err != nil {
 		log.Fatal().Err(err).Send()
 		os.Exit(-1)
 	}
 
-	cachedUsers, err = cachedData.loadUserTokens()
+	storedUsers, err := cachedData.loadUserTokens()
 	if err != nil {
 		log.Fatal().Err(err).Send()
 		os.Exit(-1)
 	}
 
+	if err := reloadFeedTokens(); err != nil {
+		log.Fatal().Err(err).Send()
+		os.Exit(-1)
+	}
+
+	if viper.GetString("token_key") == "" {
+		log.Warn().Msg("No token_key configured, OAuth tokens will not be persisted")
+	}
+
+	if appOnly() {
+		if err := provisionAppOnlyFeeds(storedUsers); err != nil {
+			log.Fatal().Err(err).Send()
+			os.Exit(-1)
+		}
+	} else {
+		for user, stored := range storedUsers {
+			if stored.oauthToken != nil {
+				cal := newCalendarHandlerFromToken(user, stored.oauthToken, stored.publicClient)
+				cal.restoreActivity(stored.lastUpdated)
+
+				sessions.register(user, stored.token, cal)
+				continue
+			}
+
+			sessions.remember(user, stored.token)
+		}
+	}
+
 	go refreshCache()
+	go cleanSessions()
 
 	web()
 }
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// MemoryCache keeps everything in the process memory, meaning it is all lost
+// on restart. Useful for small deployments and tests.
+type MemoryCache struct {
+	mu          sync.RWMutex
+	users       map[string]*StoredUser
+	attachments map[string][]string
+	owners      map[string]string
+	events      map[calendarKey]map[string]*StoredEvent
+	deltaStates map[calendarKey]*DeltaState
+	subs        map[string]*Subscription
+	feeds       map[string]*FeedToken
+}
+
+// calendarKey identifies a calendar of a user
+type calendarKey struct {
+	user     string
+	calendar string
+}
+
+func newMemoryCache() *MemoryCache {
+	return &MemoryCache{
+		users:       make(map[string]*StoredUser),
+		attachments: make(map[string][]string),
+		owners:      make(map[string]string),
+		events:      make(map[calendarKey]map[string]*StoredEvent),
+		deltaStates: make(map[calendarKey]*DeltaState),
+		subs:        make(map[string]*Subscription),
+		feeds:       make(map[string]*FeedToken),
+	}
+}
+
+func (mc *MemoryCache) storeToken(user string, token string, oauthToken *oauth2.Token, publicClient bool) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	mc.users[user] = &StoredUser{
+		token:        token,
+		oauthToken:   oauthToken,
+		publicClient: publicClient,
+		lastUpdated:  time.Now().UTC(),
+	}
+
+	return nil
+}
+
+func (mc *MemoryCache) updateOAuthToken(user string, oauthToken *oauth2.Token) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	if stored, ok := mc.users[user]; ok {
+		stored.oauthToken = oauthToken
+	}
+
+	return nil
+}
+
+func (mc *MemoryCache) loadUserTokens() (map[string]*StoredUser, error) {
+	mc.mu.RLock()
+	defer mc.mu.RUnlock()
+
+	users := make(map[string]*StoredUser, len(mc.users))
+	for k, v := range mc.users {
+		users[k] = &StoredUser{
+			token:        v.token,
+			oauthToken:   v.oauthToken,
+			publicClient: v.publicClient,
+			lastUpdated:  v.lastUpdated,
+		}
+	}
+
+	return users, nil
+}
+
+func (mc *MemoryCache) touchUser(user string, lastUpdated time.Time) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	if stored, ok := mc.users[user]; ok {
+		stored.lastUpdated = lastUpdated
+	}
+
+	return nil
+}
+
+func (mc *MemoryCache) attachmentExists(id string) []string {
+	mc.mu.RLock()
+	defer mc.mu.RUnlock()
+
+	return mc.attachments[id]
+}
+
+func (mc *MemoryCache) saveAttachment(user string, id string, name string, contentType string) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	mc.attachments[id] = []string{name, contentType}
+	mc.owners[id] = user
+
+	return nil
+}
+
+func (mc *MemoryCache) removeAttachments(user string) ([]string, error) {
+	var ids []string
+
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	for id, owner := range mc.owners {
+		if owner == user {
+			ids = append(ids, id)
+			delete(mc.attachments, id)
+			delete(mc.owners, id)
+		}
+	}
+
+	sort.Strings(ids)
+
+	return ids, nil
+}
+
+func (mc *MemoryCache) getDeltaState(user string, calendar string) (*DeltaState, error) {
+	mc.mu.RLock()
+	defer mc.mu.RUnlock()
+
+	state, ok := mc.deltaStates[calendarKey{user, calendar}]
+	if !ok {
+		return nil, nil
+	}
+
+	copied := *state
+
+	return &copied, nil
+}
+
+func (mc *MemoryCache) getSyncedCalendars(user string) ([]string, error) {
+	var calendars []string
+
+	mc.mu.RLock()
+	defer mc.mu.RUnlock()
+
+	for key := range mc.deltaStates {
+		if key.user == user {
+			calendars = append(calendars, key.calendar)
+		}
+	}
+
+	sort.Strings(calendars)
+
+	return calendars, nil
+}
+
+func (mc *MemoryCache) saveDelta(user string, calendar string, state *DeltaState, upserts []*StoredEvent, removed []string, reset bool) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	key := calendarKey{user, calendar}
+
+	if _, ok := mc.events[key]; !ok || reset {
+		mc.events[key] = make(map[string]*StoredEvent)
+	}
+
+	for _, id := range removed {
+		delete(mc.events[key], id)
+	}
+
+	for _, event := range upserts {
+		mc.events[key][event.id] = event
+	}
+
+	copied := *state
+	mc.deltaStates[key] = &copied
+
+	return nil
+}
+
+func (mc *MemoryCache) getEvents(user string, calendar string, start time.Time, end time.Time) ([]*Event, error) {
+	var stored []*StoredEvent
+	var events []*Event
+
+	mc.mu.RLock()
+	defer mc.mu.RUnlock()
+
+	for _, event := range mc.events[calendarKey{user, calendar}] {
+		if event.start.Before(end) && event.end.After(start) {
+			stored = append(stored, event)
+		}
+	}
+
+	sort.Slice(stored, func(i, j int) bool {
+		return stored[i].start.Before(stored[j].start)
+	})
+
+	for _, event := range stored {
+		events = append(events, event.event)
+	}
+
+	return events, nil
+}
+
+func (mc *MemoryCache) removeCalendar(user string, calendar string) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	delete(mc.events, calendarKey{user, calendar})
+	delete(mc.deltaStates, calendarKey{user, calendar})
+
+	return nil
+}
+
+func (mc *MemoryCache) removeUser(user string) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	delete(mc.users, user)
+	delete(mc.subs, user)
+
+	for token, feed := range mc.feeds {
+		if feed.user == user {
+			delete(mc.feeds, token)
+		}
+	}
+
+	for key := range mc.events {
+		if key.user == user {
+			delete(mc.events, key)
+		}
+	}
+
+	for key := range mc.deltaStates {
+		if key.user == user {
+			delete(mc.deltaStates, key)
+		}
+	}
+
+	return nil
+}
+
+func (mc *MemoryCache) getSubscription(user string) (*Subscription, error) {
+	mc.mu.RLock()
+	defer mc.mu.RUnlock()
+
+	sub, ok := mc.subs[user]
+	if !ok {
+		return nil, nil
+	}
+
+	copied := *sub
+
+	return &copied, nil
+}
+
+func (mc *MemoryCache) saveSubscription(user string, sub *Subscription) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	copied := *sub
+	mc.subs[user] = &copied
+
+	return nil
+}
+
+func (mc *MemoryCache) saveFeedToken(feed *FeedToken) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	copied := *feed
+	mc.feeds[feed.token] = &copied
+
+	return nil
+}
+
+func (mc *MemoryCache) loadFeedTokens() ([]*FeedToken, error) {
+	var feeds []*FeedToken
+
+	mc.mu.RLock()
+	defer mc.mu.RUnlock()
+
+	for _, feed := range mc.feeds {
+		copied := *feed
+		feeds = append(feeds, &copied)
+	}
+
+	sort.Slice(feeds, func(i, j int) bool {
+		return feeds[i].created.Before(feeds[j].created)
+	})
+
+	return feeds, nil
+}
+
+func (mc *MemoryCache) touchFeedToken(token string, lastUsed time.Time) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	if feed, ok := mc.feeds[token]; ok {
+		feed.lastUsed = lastUsed
+	}
+
+	return nil
+}
+
+func (mc *MemoryCache) removeFeedToken(token string) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	delete(mc.feeds, token)
+
+	return nil
+}
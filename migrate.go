@@ -0,0 +1,76 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func openCacheDB() (string, *sql.DB, error) {
+	var db *sql.DB
+	var err error
+
+	backend := cacheBackend()
+
+	switch backend {
+	case postgresBackend:
+		db, err = openPostgres(postgresConfs())
+	case sqliteBackend:
+		db, err = openSQLite(viper.GetString("sqlite.path"))
+	default:
+		err = fmt.Errorf("cache_backend %q has no schema to migrate", backend)
+	}
+
+	return backend, db, err
+}
+
+// runMigrateCommand handles "migrate up" and "migrate status"
+func runMigrateCommand(args []string) error {
+	action := "up"
+	if len(args) > 0 {
+		action = args[0]
+	}
+
+	dialect, db, err := openCacheDB()
+	if err != nil {
+		return err
+	}
+
+	defer db.Close()
+
+	switch action {
+	case "up":
+		applied, err := migrateUp(dialect, db)
+		if err != nil {
+			return err
+		}
+
+		if len(applied) == 0 {
+			fmt.Println("Schema is up to date")
+		}
+
+		for _, m := range applied {
+			fmt.Printf("Applied %04d_%s\n", m.version, m.name)
+		}
+	case "status":
+		states, err := migrationStatus(dialect, db)
+		for _, s := range states {
+			appliedAt := "pending"
+			if s.appliedAt.Valid {
+				appliedAt = s.appliedAt.Time.Format(time.RFC3339)
+			}
+
+			fmt.Printf("%04d_%-30s %s\n", s.migration.version, s.migration.name, appliedAt)
+		}
+
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown migrate action %q, use up or status", action)
+	}
+
+	return nil
+}
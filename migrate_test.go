@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// captureStdout returns what run printed
+func captureStdout(t *testing.T, run func() error) (string, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stdout := os.Stdout
+	os.Stdout = w
+
+	output := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(r)
+		output <- string(data)
+	}()
+
+	err = run()
+
+	w.Close()
+	os.Stdout = stdout
+
+	return <-output, err
+}
+
+func newSQLiteConfig(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "cache.db")
+
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+
+	viper.Set("cache_backend", sqliteBackend)
+	viper.Set("sqlite.path", path)
+
+	return path
+}
+
+func TestMigrateUp(t *testing.T) {
+	path := newSQLiteConfig(t)
+
+	migrations, err := loadMigrations(sqliteBackend)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	latest := migrations[len(migrations)-1]
+
+	output, err := captureStdout(t, func() error { return runMigrateCommand([]string{"status"}) })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Count(output, "pending") != len(migrations) {
+		t.Errorf("status of a fresh database:\n%s", output)
+	}
+
+	output, err = captureStdout(t, func() error { return runMigrateCommand([]string{"up"}) })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, m := range migrations {
+		if !strings.Contains(output, fmt.Sprintf("Applied %04d_%s\n", m.version, m.name)) {
+			t.Errorf("%04d_%s not applied:\n%s", m.version, m.name, output)
+		}
+	}
+
+	db, err := openSQLite(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	var version int
+	if err := db.QueryRow("SELECT MAX(version) FROM " + schemaMigrationsTable).Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+
+	if version != latest.version {
+		t.Errorf("schema at version %d, want %d", version, latest.version)
+	}
+
+	output, err = captureStdout(t, func() error { return runMigrateCommand([]string{"status"}) })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) != len(migrations) || strings.Contains(output, "pending") {
+		t.Errorf("status once migrated:\n%s", output)
+	}
+
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if _, err := time.Parse(time.RFC3339, fields[len(fields)-1]); err != nil {
+			t.Errorf("no time applied on %q", line)
+		}
+	}
+
+	output, err = captureStdout(t, func() error { return runMigrateCommand([]string{"up"}) })
+	if err != nil || output != "Schema is up to date\n" {
+		t.Errorf("migrating again printed %q, %v", output, err)
+	}
+
+	// The backend starts on the migrated schema without migrating it
+	cd, err := newSQLiteCache(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cd.db.Close()
+}
+
+func TestMigrateNewerSchema(t *testing.T) {
+	path := newSQLiteConfig(t)
+
+	cd, err := newSQLiteCache(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A later build migrated the database further
+	_, err = cd.db.Exec("INSERT INTO "+schemaMigrationsTable+"(version, name, applied_at) VALUES($1, $2, $3)", 9999, "from_the_future", time.Now())
+	cd.db.Close()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, autoMigrate := range []bool{true, false} {
+		if _, err := newSQLiteCache(path, autoMigrate); err == nil || !strings.Contains(err.Error(), "newer") {
+			t.Errorf("started with auto_migrate %v on a newer schema, %v", autoMigrate, err)
+		}
+	}
+
+	if _, err := captureStdout(t, func() error { return runMigrateCommand([]string{"up"}) }); err == nil {
+		t.Error("migrated a newer schema")
+	}
+
+	if _, err := captureStdout(t, func() error { return runMigrateCommand([]string{"status"}) }); err == nil {
+		t.Error("no error on the status of a newer schema")
+	}
+}
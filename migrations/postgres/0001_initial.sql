@@ -0,0 +1,27 @@
+CREATE TABLE IF NOT EXISTS logged_users (
+    id SERIAL,
+    "user" VARCHAR(8) NOT NULL UNIQUE,
+    token VARCHAR(60) NOT NULL UNIQUE,
+    last_updated TIMESTAMP NOT NULL,
+    PRIMARY KEY (id)
+);
+
+CREATE TABLE IF NOT EXISTS attachments (
+    id SERIAL,
+    att_id VARCHAR(256) NOT NULL UNIQUE,
+    fname VARCHAR(256) NOT NULL,
+    content_type VARCHAR(128) NOT NULL,
+    last_updated TIMESTAMP NOT NULL,
+    PRIMARY KEY (id)
+);
+
+CREATE TABLE IF NOT EXISTS month_cache (
+    id SERIAL,
+    "user" VARCHAR(8) NOT NULL,
+    start TIMESTAMP NOT NULL,
+    "end" TIMESTAMP NOT NULL,
+    contents TEXT NOT NULL,
+    last_updated TIMESTAMP NOT NULL,
+    UNIQUE (start, "end", "user"),
+    PRIMARY KEY (id)
+);
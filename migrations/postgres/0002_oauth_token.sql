@@ -0,0 +1 @@
+ALTER TABLE logged_users ADD COLUMN IF NOT EXISTS oauth_token TEXT;
@@ -0,0 +1,3 @@
+-- User names are the local part of the UPN, which can be way longer than 8 characters
+ALTER TABLE logged_users ALTER COLUMN "user" TYPE VARCHAR(256);
+ALTER TABLE month_cache ALTER COLUMN "user" TYPE VARCHAR(256);
@@ -0,0 +1,26 @@
+CREATE TABLE IF NOT EXISTS calendar_events (
+    id SERIAL,
+    "user" VARCHAR(256) NOT NULL,
+    event_id VARCHAR(512) NOT NULL,
+    start TIMESTAMP NOT NULL,
+    "end" TIMESTAMP NOT NULL,
+    contents TEXT NOT NULL,
+    last_updated TIMESTAMP NOT NULL,
+    UNIQUE ("user", event_id),
+    PRIMARY KEY (id)
+);
+
+CREATE INDEX IF NOT EXISTS calendar_events_range ON calendar_events ("user", start, "end");
+
+CREATE TABLE IF NOT EXISTS delta_links (
+    id SERIAL,
+    "user" VARCHAR(256) NOT NULL UNIQUE,
+    delta_link TEXT NOT NULL,
+    start TIMESTAMP NOT NULL,
+    "end" TIMESTAMP NOT NULL,
+    last_synced TIMESTAMP NOT NULL,
+    PRIMARY KEY (id)
+);
+
+-- Superseded by calendar_events
+DROP TABLE IF EXISTS month_cache;
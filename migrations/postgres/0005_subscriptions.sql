@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS subscriptions (
+    id SERIAL,
+    "user" VARCHAR(256) NOT NULL UNIQUE,
+    subscription_id VARCHAR(256) NOT NULL,
+    client_state VARCHAR(256) NOT NULL,
+    expiration TIMESTAMP NOT NULL,
+    last_updated TIMESTAMP NOT NULL,
+    PRIMARY KEY (id)
+);
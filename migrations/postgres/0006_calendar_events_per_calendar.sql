@@ -0,0 +1,31 @@
+-- Events and deltaLinks are kept per calendar of the user, the default one
+-- having an empty calendar_id. Everything is synced again from scratch.
+DROP TABLE IF EXISTS calendar_events;
+DROP TABLE IF EXISTS delta_links;
+
+CREATE TABLE calendar_events (
+    id SERIAL,
+    "user" VARCHAR(256) NOT NULL,
+    calendar_id VARCHAR(512) NOT NULL DEFAULT '',
+    event_id VARCHAR(512) NOT NULL,
+    start TIMESTAMP NOT NULL,
+    "end" TIMESTAMP NOT NULL,
+    contents TEXT NOT NULL,
+    last_updated TIMESTAMP NOT NULL,
+    UNIQUE ("user", calendar_id, event_id),
+    PRIMARY KEY (id)
+);
+
+CREATE INDEX calendar_events_range ON calendar_events ("user", calendar_id, start, "end");
+
+CREATE TABLE delta_links (
+    id SERIAL,
+    "user" VARCHAR(256) NOT NULL,
+    calendar_id VARCHAR(512) NOT NULL DEFAULT '',
+    delta_link TEXT NOT NULL,
+    start TIMESTAMP NOT NULL,
+    "end" TIMESTAMP NOT NULL,
+    last_synced TIMESTAMP NOT NULL,
+    UNIQUE ("user", calendar_id),
+    PRIMARY KEY (id)
+);
@@ -0,0 +1,3 @@
+-- Tokens of device code logins are issued to the app as a public client, and
+-- are refreshed without the client secret
+ALTER TABLE logged_users ADD COLUMN IF NOT EXISTS public_client BOOLEAN NOT NULL DEFAULT FALSE;
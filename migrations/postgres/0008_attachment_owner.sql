@@ -0,0 +1,5 @@
+-- Attachments are deleted along with the user who downloaded them when revoking
+-- their feed. The ones downloaded before are left without an owner.
+ALTER TABLE attachments ADD COLUMN IF NOT EXISTS "user" VARCHAR(256);
+
+CREATE INDEX IF NOT EXISTS attachments_user ON attachments ("user");
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS feed_tokens (
+    id SERIAL,
+    token VARCHAR(60) NOT NULL UNIQUE,
+    "user" VARCHAR(256) NOT NULL,
+    name VARCHAR(256) NOT NULL,
+    options TEXT NOT NULL,
+    created TIMESTAMP NOT NULL,
+    last_used TIMESTAMP,
+    PRIMARY KEY (id)
+);
+
+CREATE INDEX IF NOT EXISTS feed_tokens_user ON feed_tokens ("user");
@@ -0,0 +1,25 @@
+CREATE TABLE IF NOT EXISTS logged_users (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    "user" VARCHAR(256) NOT NULL UNIQUE,
+    token VARCHAR(60) NOT NULL UNIQUE,
+    oauth_token TEXT,
+    last_updated TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS attachments (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    att_id VARCHAR(256) NOT NULL UNIQUE,
+    fname VARCHAR(256) NOT NULL,
+    content_type VARCHAR(128) NOT NULL,
+    last_updated TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS month_cache (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    "user" VARCHAR(256) NOT NULL,
+    start TIMESTAMP NOT NULL,
+    "end" TIMESTAMP NOT NULL,
+    contents TEXT NOT NULL,
+    last_updated TIMESTAMP NOT NULL,
+    UNIQUE (start, "end", "user")
+);
@@ -0,0 +1,24 @@
+CREATE TABLE IF NOT EXISTS calendar_events (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    "user" VARCHAR(256) NOT NULL,
+    event_id VARCHAR(512) NOT NULL,
+    start TIMESTAMP NOT NULL,
+    "end" TIMESTAMP NOT NULL,
+    contents TEXT NOT NULL,
+    last_updated TIMESTAMP NOT NULL,
+    UNIQUE ("user", event_id)
+);
+
+CREATE INDEX IF NOT EXISTS calendar_events_range ON calendar_events ("user", start, "end");
+
+CREATE TABLE IF NOT EXISTS delta_links (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    "user" VARCHAR(256) NOT NULL UNIQUE,
+    delta_link TEXT NOT NULL,
+    start TIMESTAMP NOT NULL,
+    "end" TIMESTAMP NOT NULL,
+    last_synced TIMESTAMP NOT NULL
+);
+
+-- Superseded by calendar_events
+DROP TABLE IF EXISTS month_cache;
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS subscriptions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    "user" VARCHAR(256) NOT NULL UNIQUE,
+    subscription_id VARCHAR(256) NOT NULL,
+    client_state VARCHAR(256) NOT NULL,
+    expiration TIMESTAMP NOT NULL,
+    last_updated TIMESTAMP NOT NULL
+);
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS feed_tokens (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    token VARCHAR(60) NOT NULL UNIQUE,
+    "user" VARCHAR(256) NOT NULL,
+    name VARCHAR(256) NOT NULL,
+    options TEXT NOT NULL,
+    created TIMESTAMP NOT NULL,
+    last_used TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS feed_tokens_user ON feed_tokens ("user");
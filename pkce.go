@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+
+	"golang.org/x/oauth2"
+)
+
+var errInvalidState = errors.New("login state doesn't match the one of the session")
+
+// authRequest is a login started by redirecting the session to Azure AD, until
+// the user is sent back to redirect_url
+type authRequest struct {
+	state    string
+	verifier string
+}
+
+// secureRandomString returns n random bytes as URL safe base64, for the
+// values an attacker must not be able to guess
+func secureRandomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// codeChallenge is the S256 PKCE challenge derived from verifier
+func codeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// getURL starts a login, returning where to send the user to. The state ties
+// the redirect back to this session and the code challenge ties the code to
+// this login, so neither can be replayed from another browser.
+func (c *Calendar) getURL() (string, error) {
+	state, err := secureRandomString(24)
+	if err != nil {
+		return "", err
+	}
+
+	verifier, err := secureRandomString(48)
+	if err != nil {
+		return "", err
+	}
+
+	c.authMu.Lock()
+	c.auth = &authRequest{state: state, verifier: verifier}
+	c.authMu.Unlock()
+
+	c.touch()
+
+	return c.conf.AuthCodeURL(state,
+		oauth2.AccessTypeOffline,
+		oauth2.SetAuthURLParam("code_challenge", codeChallenge(verifier)),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+	), nil
+}
+
+// verifyState checks the state the user was redirected back with against the
+// login in progress, returning its code verifier. A login can only be
+// completed once.
+func (c *Calendar) verifyState(state string) (string, error) {
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
+
+	auth := c.auth
+	if auth == nil || subtle.ConstantTimeCompare([]byte(auth.state), []byte(state)) != 1 {
+		return "", errInvalidState
+	}
+
+	c.auth = nil
+
+	return auth.verifier, nil
+}
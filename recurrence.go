@@ -0,0 +1,585 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	ics "github.com/arran4/golang-ical"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	icalUTCFormat  = "20060102T150405Z"
+	icalDateFormat = "20060102"
+
+	// Graph recurrences are at most daily, so two instances are never closer than this
+	instanceTolerance = 12 * time.Hour
+)
+
+var weekdays = map[string]time.Weekday{
+	"sunday":    time.Sunday,
+	"monday":    time.Monday,
+	"tuesday":   time.Tuesday,
+	"wednesday": time.Wednesday,
+	"thursday":  time.Thursday,
+	"friday":    time.Friday,
+	"saturday":  time.Saturday,
+}
+
+var icalWeekdays = []string{"SU", "MO", "TU", "WE", "TH", "FR", "SA"}
+
+var weekIndexes = map[string]int{
+	"first":  1,
+	"second": 2,
+	"third":  3,
+	"fourth": 4,
+	"last":   -1,
+}
+
+type timeRange struct {
+	start time.Time
+	end   time.Time
+}
+
+type recurrencePattern struct {
+	typ            string
+	interval       int
+	month          int
+	dayOfMonth     int
+	daysOfWeek     []time.Weekday
+	firstDayOfWeek time.Weekday
+	index          int
+}
+
+type recurrenceRange struct {
+	typ                 string
+	startDate           time.Time
+	endDate             time.Time
+	numberOfOccurrences int
+}
+
+type recurrence struct {
+	pattern *recurrencePattern
+	rng     *recurrenceRange
+	loc     *time.Location
+}
+
+// seriesInstances groups the instances of a series found on the calendar view,
+// along with its master once retrieved
+type seriesInstances struct {
+	present    []time.Time
+	instances  []*Event
+	exceptions []*Event
+
+	master *Event
+	rec    *recurrence
+}
+
+func (r *timeRange) contains(t time.Time) bool {
+	return !t.Before(r.start) && t.Before(r.end)
+}
+
+func dateOnly(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+func daysBetween(from time.Time, to time.Time) int {
+	return int(dateOnly(to).Sub(dateOnly(from)).Hours() / 24)
+}
+
+func monthsBetween(from time.Time, to time.Time) int {
+	return (to.Year()-from.Year())*12 + int(to.Month()) - int(from.Month())
+}
+
+func startOfWeek(t time.Time, firstDay time.Weekday) time.Time {
+	return dateOnly(t).AddDate(0, 0, -((int(t.Weekday()) - int(firstDay) + 7) % 7))
+}
+
+func parseRecurrence(e *Event, loc *time.Location) (*recurrence, error) {
+	if e.Recurrence == nil || e.Recurrence.Pattern == nil || e.Recurrence.Range == nil {
+		return nil, errors.New("event has no recurrence")
+	}
+
+	pattern := e.Recurrence.Pattern
+	rng := e.Recurrence.Range
+
+	r := &recurrence{
+		pattern: &recurrencePattern{
+			typ:            pattern.Type,
+			interval:       pattern.Interval,
+			month:          pattern.Month,
+			dayOfMonth:     pattern.DayOfMonth,
+			firstDayOfWeek: weekdays[pattern.FirstDayOfWeek],
+			index:          weekIndexes[pattern.Index],
+		},
+		rng: &recurrenceRange{
+			typ:                 rng.Type,
+			numberOfOccurrences: rng.NumberOfOccurrences,
+		},
+		loc: loc,
+	}
+
+	if r.pattern.interval < 1 {
+		r.pattern.interval = 1
+	}
+
+	if r.pattern.index == 0 {
+		r.pattern.index = 1
+	}
+
+	for _, name := range pattern.DaysOfWeek {
+		r.pattern.daysOfWeek = append(r.pattern.daysOfWeek, weekdays[name])
+	}
+
+	var err error
+
+	r.rng.startDate, err = time.Parse("2006-01-02", rng.StartDate)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.rng.typ == "endDate" {
+		r.rng.endDate, err = time.Parse("2006-01-02", rng.EndDate)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch r.pattern.typ {
+	case "daily", "weekly", "absoluteMonthly", "relativeMonthly", "absoluteYearly", "relativeYearly":
+	default:
+		return nil, errors.New("unknown recurrence pattern " + r.pattern.typ)
+	}
+
+	if (r.pattern.typ == "weekly" || strings.HasPrefix(r.pattern.typ, "relative")) && len(r.pattern.daysOfWeek) == 0 {
+		return nil, errors.New("recurrence pattern " + r.pattern.typ + " without days of week")
+	}
+
+	return r, nil
+}
+
+func (r *recurrence) byDay() string {
+	var days []string
+
+	for _, d := range r.pattern.daysOfWeek {
+		days = append(days, icalWeekdays[d])
+	}
+
+	return strings.Join(days, ",")
+}
+
+func (r *recurrence) rrule() string {
+	var parts []string
+
+	switch r.pattern.typ {
+	case "daily":
+		parts = append(parts, "FREQ=DAILY")
+	case "weekly":
+		parts = append(parts, "FREQ=WEEKLY", "BYDAY="+r.byDay(), "WKST="+icalWeekdays[r.pattern.firstDayOfWeek])
+	case "absoluteMonthly":
+		parts = append(parts, "FREQ=MONTHLY", "BYMONTHDAY="+strconv.Itoa(r.pattern.dayOfMonth))
+	case "relativeMonthly":
+		parts = append(parts, "FREQ=MONTHLY", "BYDAY="+r.byDay(), "BYSETPOS="+strconv.Itoa(r.pattern.index))
+	case "absoluteYearly":
+		parts = append(parts, "FREQ=YEARLY", "BYMONTH="+strconv.Itoa(r.pattern.month), "BYMONTHDAY="+strconv.Itoa(r.pattern.dayOfMonth))
+	case "relativeYearly":
+		parts = append(parts, "FREQ=YEARLY", "BYMONTH="+strconv.Itoa(r.pattern.month), "BYDAY="+r.byDay(), "BYSETPOS="+strconv.Itoa(r.pattern.index))
+	}
+
+	if r.pattern.interval > 1 {
+		parts = append(parts, "INTERVAL="+strconv.Itoa(r.pattern.interval))
+	}
+
+	switch r.rng.typ {
+	case "endDate":
+		until := time.Date(r.rng.endDate.Year(), r.rng.endDate.Month(), r.rng.endDate.Day(), 23, 59, 59, 0, r.loc)
+		parts = append(parts, "UNTIL="+until.UTC().Format(icalUTCFormat))
+	case "numbered":
+		parts = append(parts, "COUNT="+strconv.Itoa(r.rng.numberOfOccurrences))
+	}
+
+	return strings.Join(parts, ";")
+}
+
+// relativeDayMatches checks if day is the n-th (or last) day of its month
+// falling on any of the pattern weekdays
+func (r *recurrence) relativeDayMatches(day time.Time) bool {
+	var candidates []time.Time
+
+	first := time.Date(day.Year(), day.Month(), 1, 0, 0, 0, 0, time.UTC)
+	for d := first; d.Month() == first.Month(); d = d.AddDate(0, 0, 1) {
+		for _, wd := range r.pattern.daysOfWeek {
+			if d.Weekday() == wd {
+				candidates = append(candidates, d)
+				break
+			}
+		}
+	}
+
+	if len(candidates) == 0 {
+		return false
+	}
+
+	var selected time.Time
+	if r.pattern.index < 0 {
+		selected = candidates[len(candidates)-1]
+	} else if r.pattern.index <= len(candidates) {
+		selected = candidates[r.pattern.index-1]
+	} else {
+		return false
+	}
+
+	return selected.Day() == day.Day()
+}
+
+func (r *recurrence) occursOn(day time.Time) bool {
+	start := r.rng.startDate
+
+	if daysBetween(start, day) < 0 {
+		return false
+	}
+
+	switch r.pattern.typ {
+	case "daily":
+		return daysBetween(start, day)%r.pattern.interval == 0
+	case "weekly":
+		weeks := daysBetween(startOfWeek(start, r.pattern.firstDayOfWeek), startOfWeek(day, r.pattern.firstDayOfWeek)) / 7
+		if weeks%r.pattern.interval != 0 {
+			return false
+		}
+
+		for _, wd := range r.pattern.daysOfWeek {
+			if day.Weekday() == wd {
+				return true
+			}
+		}
+
+		return false
+	case "absoluteMonthly":
+		return monthsBetween(start, day)%r.pattern.interval == 0 && day.Day() == r.pattern.dayOfMonth
+	case "relativeMonthly":
+		return monthsBetween(start, day)%r.pattern.interval == 0 && r.relativeDayMatches(day)
+	case "absoluteYearly":
+		return (day.Year()-start.Year())%r.pattern.interval == 0 && int(day.Month()) == r.pattern.month && day.Day() == r.pattern.dayOfMonth
+	case "relativeYearly":
+		return (day.Year()-start.Year())%r.pattern.interval == 0 && int(day.Month()) == r.pattern.month && r.relativeDayMatches(day)
+	}
+
+	return false
+}
+
+// occurrences expands the recurrence, returning the instances starting inside
+// any of the given windows. seriesStart provides the time of day of every instance.
+func (r *recurrence) occurrences(seriesStart time.Time, windows []*timeRange) []time.Time {
+	var last time.Time
+	var instances []time.Time
+
+	for _, w := range windows {
+		if w.end.After(last) {
+			last = w.end
+		}
+	}
+
+	if r.rng.typ == "endDate" && r.rng.endDate.Before(last) {
+		last = r.rng.endDate.AddDate(0, 0, 1)
+	}
+
+	local := seriesStart.In(r.loc)
+	count := 0
+
+	for day := dateOnly(r.rng.startDate); day.Before(last); day = day.AddDate(0, 0, 1) {
+		if !r.occursOn(day) {
+			continue
+		}
+
+		count++
+		if r.rng.typ == "numbered" && count > r.rng.numberOfOccurrences {
+			break
+		}
+
+		t := time.Date(day.Year(), day.Month(), day.Day(), local.Hour(), local.Minute(), local.Second(), 0, r.loc)
+		for _, w := range windows {
+			if w.contains(t) {
+				instances = append(instances, t)
+				break
+			}
+		}
+	}
+
+	return instances
+}
+
+func containsInstance(instances []time.Time, t time.Time) bool {
+	for _, i := range instances {
+		diff := i.Sub(t)
+		if diff > -instanceTolerance && diff < instanceTolerance {
+			return true
+		}
+	}
+
+	return false
+}
+
+// addRecurringEvents emits single events as they are, and every series as its
+// master with RRULE and EXDATE, plus one event per modified occurrence
+func (c *Calendar) addRecurringEvents(cal *ics.Calendar, values []*Event, windows []*timeRange, opts *FeedOptions) error {
+	var order []string
+	var singles []*Event
+
+	series := make(map[string]*seriesInstances)
+
+	for _, e := range values {
+		if !e.isSeriesInstance() {
+			if !c.skipEvent(e, opts) {
+				singles = append(singles, e)
+			}
+
+			continue
+		}
+
+		masterID := e.SeriesMasterID
+
+		s, ok := series[masterID]
+		if !ok {
+			s = &seriesInstances{}
+			series[masterID] = s
+			order = append(order, masterID)
+		}
+
+		// Filtered instances end up as EXDATE, just like cancelled ones
+		if c.skipEvent(e, opts) {
+			continue
+		}
+
+		s.present = append(s.present, e.originalStartTime())
+		s.instances = append(s.instances, e)
+
+		if e.Type == "exception" {
+			s.exceptions = append(s.exceptions, e)
+		}
+	}
+
+	// Every event going on the feed is known once the masters are retrieved
+	emitted := append([]*Event{}, singles...)
+
+	masters, failed := c.getSeriesMasters(opts.mailbox, order, opts.bodies)
+
+	for _, masterID := range order {
+		s := series[masterID]
+
+		rec, err := c.seriesRecurrence(masters[masterID], failed[masterID], opts)
+		if err != nil {
+			log.Warn().
+				Err(err).
+				Str("user", c.userName).
+				Str("series", masterID).
+				Str("method", "getSeriesMasters").
+				Msg("Falling back to single instances")
+
+			emitted = append(emitted, s.instances...)
+			continue
+		}
+
+		s.master, s.rec = masters[masterID], rec
+
+		emitted = append(emitted, s.master)
+		emitted = append(emitted, s.exceptions...)
+	}
+
+	if !opts.google && opts.bodies {
+		var err error
+
+		if opts.attachments, err = c.prefetchAttachments(opts.baseHost, opts.mailbox, emitted); err != nil {
+			return err
+		}
+	}
+
+	for _, e := range singles {
+		if _, err := c.addEvent(cal, e, opts); err != nil {
+			return err
+		}
+	}
+
+	for _, masterID := range order {
+		s := series[masterID]
+
+		if s.master == nil {
+			for _, e := range s.instances {
+				if _, err := c.addEvent(cal, e, opts); err != nil {
+					return err
+				}
+			}
+
+			continue
+		}
+
+		if err := c.addSeries(cal, s, windows, opts); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// seriesRecurrence returns the recurrence of a series master, unless it
+// couldn't be fetched or is filtered out
+func (c *Calendar) seriesRecurrence(master *Event, err error, opts *FeedOptions) (*recurrence, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	if !opts.full && c.shouldSkip(master) {
+		return nil, errors.New("series master is filtered out")
+	}
+
+	return parseRecurrence(master, master.startTime().Location())
+}
+
+// seriesMasterKey identifies a series master fetched for the recurring feeds
+func seriesMasterKey(mailbox string, id string, withBody bool) string {
+	return mailbox + " " + id + " " + strconv.FormatBool(withBody)
+}
+
+// getSeriesMasters returns the series masters of the mailbox with ids,
+// fetching in batches the ones not fetched since the last sync bringing
+// changes, and requesting on their own the ones that failed within a batch.
+// The masters that couldn't be fetched have their error instead.
+func (c *Calendar) getSeriesMasters(mailbox string, ids []string, withBody bool) (map[string]*Event, map[string]error) {
+	masters := make(map[string]*Event)
+	failed := make(map[string]error)
+
+	var missing []string
+	var paths []string
+
+	c.mastersMu.Lock()
+
+	gen := c.mastersGen
+	for _, id := range ids {
+		if master, ok := c.masters[seriesMasterKey(mailbox, id, withBody)]; ok {
+			masters[id] = master
+			continue
+		}
+
+		missing = append(missing, id)
+		paths = append(paths, c.eventPath(mailbox, id, withBody))
+	}
+
+	c.mastersMu.Unlock()
+
+	if len(missing) == 0 {
+		return masters, failed
+	}
+
+	responses, err := c.batchGet(paths)
+	if err != nil {
+		for _, id := range missing {
+			failed[id] = err
+		}
+
+		return masters, failed
+	}
+
+	for i, id := range missing {
+		master := &Event{}
+
+		err := responses[i].err()
+		if err == nil {
+			err = json.Unmarshal(responses[i].Body, master)
+		}
+
+		if err == nil && master.ID == "" {
+			err = errors.New("unable to retrieve event " + id)
+		}
+
+		if err != nil {
+			log.Warn().
+				Err(err).
+				Str("user", c.userName).
+				Str("series", id).
+				Str("method", "getSeriesMasters").
+				Msg("Batched request failed, sending it alone")
+
+			if master, err = c.getEvent(mailbox, id, withBody); err != nil {
+				failed[id] = err
+				continue
+			}
+		}
+
+		masters[id] = master
+	}
+
+	c.mastersMu.Lock()
+	defer c.mastersMu.Unlock()
+
+	// Kept unless a sync brought changes meanwhile
+	if c.mastersGen != gen {
+		return masters, failed
+	}
+
+	if c.masters == nil {
+		c.masters = make(map[string]*Event)
+	}
+
+	for _, id := range missing {
+		if master, ok := masters[id]; ok {
+			c.masters[seriesMasterKey(mailbox, id, withBody)] = master
+		}
+	}
+
+	return masters, failed
+}
+
+// forgetSeriesMasters drops the series masters fetched, once a sync brought
+// changes to the events of the user
+func (c *Calendar) forgetSeriesMasters() {
+	c.mastersMu.Lock()
+	defer c.mastersMu.Unlock()
+
+	c.masters = nil
+	c.mastersGen++
+}
+
+func (c *Calendar) addSeries(cal *ics.Calendar, s *seriesInstances, windows []*timeRange, opts *FeedOptions) error {
+	master, rec := s.master, s.rec
+	masterID := master.ID
+	masterStart := master.startTime()
+	allDay := master.IsAllDay
+
+	event, err := c.addEvent(cal, master, opts)
+	if err != nil {
+		return err
+	}
+
+	event.AddRrule(rec.rrule())
+
+	expected := rec.occurrences(masterStart, windows)
+	sort.Slice(expected, func(i, j int) bool {
+		return expected[i].Before(expected[j])
+	})
+
+	for _, t := range expected {
+		if containsInstance(s.present, t) {
+			continue
+		}
+
+		value, props := formatICalTime(t, allDay)
+		event.AddExdate(value, props...)
+	}
+
+	for _, e := range s.exceptions {
+		exception, err := c.addEvent(cal, e, opts)
+		if err != nil {
+			return err
+		}
+
+		value, props := formatICalTime(e.originalStartTime().In(masterStart.Location()), allDay)
+		exception.SetProperty(ics.ComponentPropertyUniqueId, masterID)
+		exception.SetProperty(ics.ComponentProperty(ics.PropertyRecurrenceId), value, props...)
+	}
+
+	return nil
+}
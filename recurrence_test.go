@@ -0,0 +1,169 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func date(year int, month time.Month, day int) time.Time {
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+func TestRecurrenceRRule(t *testing.T) {
+	lisbon, err := time.LoadLocation("Europe/Lisbon")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		rec  *recurrence
+		want string
+	}{
+		{
+			name: "last friday of the month",
+			rec: &recurrence{
+				pattern: &recurrencePattern{typ: "relativeMonthly", interval: 1, daysOfWeek: []time.Weekday{time.Friday}, index: -1},
+				rng:     &recurrenceRange{typ: "noEnd", startDate: date(2022, 1, 1)},
+				loc:     time.UTC,
+			},
+			want: "FREQ=MONTHLY;BYDAY=FR;BYSETPOS=-1",
+		},
+		{
+			name: "every other year",
+			rec: &recurrence{
+				pattern: &recurrencePattern{typ: "absoluteYearly", interval: 2, month: 3, dayOfMonth: 15},
+				rng:     &recurrenceRange{typ: "noEnd", startDate: date(2020, 3, 15)},
+				loc:     time.UTC,
+			},
+			want: "FREQ=YEARLY;BYMONTH=3;BYMONTHDAY=15;INTERVAL=2",
+		},
+		{
+			name: "numbered",
+			rec: &recurrence{
+				pattern: &recurrencePattern{typ: "daily", interval: 1},
+				rng:     &recurrenceRange{typ: "numbered", startDate: date(2022, 1, 3), numberOfOccurrences: 5},
+				loc:     time.UTC,
+			},
+			want: "FREQ=DAILY;COUNT=5",
+		},
+		{
+			// The end date is inclusive, in the time zone of the series
+			name: "end date",
+			rec: &recurrence{
+				pattern: &recurrencePattern{typ: "weekly", interval: 1, daysOfWeek: []time.Weekday{time.Monday, time.Thursday}, firstDayOfWeek: time.Sunday},
+				rng:     &recurrenceRange{typ: "endDate", startDate: date(2022, 6, 1), endDate: date(2022, 6, 30)},
+				loc:     lisbon,
+			},
+			want: "FREQ=WEEKLY;BYDAY=MO,TH;WKST=SU;UNTIL=20220630T225959Z",
+		},
+	}
+
+	for _, tt := range tests {
+		if got := tt.rec.rrule(); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRecurrenceOccurrences(t *testing.T) {
+	seriesStart := time.Date(2022, 1, 3, 9, 0, 0, 0, time.UTC)
+	at := func(year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, 9, 0, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name    string
+		rec     *recurrence
+		windows []*timeRange
+		want    []time.Time
+	}{
+		{
+			name: "last friday of the month",
+			rec: &recurrence{
+				pattern: &recurrencePattern{typ: "relativeMonthly", interval: 1, daysOfWeek: []time.Weekday{time.Friday}, index: -1},
+				rng:     &recurrenceRange{typ: "noEnd", startDate: date(2022, 1, 1)},
+				loc:     time.UTC,
+			},
+			windows: []*timeRange{{start: date(2022, 1, 1), end: date(2022, 5, 1)}},
+			want:    []time.Time{at(2022, 1, 28), at(2022, 2, 25), at(2022, 3, 25), at(2022, 4, 29)},
+		},
+		{
+			name: "every other year",
+			rec: &recurrence{
+				pattern: &recurrencePattern{typ: "absoluteYearly", interval: 2, month: 3, dayOfMonth: 15},
+				rng:     &recurrenceRange{typ: "noEnd", startDate: date(2020, 3, 15)},
+				loc:     time.UTC,
+			},
+			windows: []*timeRange{{start: date(2020, 1, 1), end: date(2025, 1, 1)}},
+			want:    []time.Time{at(2020, 3, 15), at(2022, 3, 15), at(2024, 3, 15)},
+		},
+		{
+			// Occurrences before the window still count
+			name: "numbered",
+			rec: &recurrence{
+				pattern: &recurrencePattern{typ: "daily", interval: 1},
+				rng:     &recurrenceRange{typ: "numbered", startDate: date(2022, 1, 3), numberOfOccurrences: 5},
+				loc:     time.UTC,
+			},
+			windows: []*timeRange{{start: date(2022, 1, 5), end: date(2022, 2, 1)}},
+			want:    []time.Time{at(2022, 1, 5), at(2022, 1, 6), at(2022, 1, 7)},
+		},
+		{
+			name: "end date",
+			rec: &recurrence{
+				pattern: &recurrencePattern{typ: "daily", interval: 2},
+				rng:     &recurrenceRange{typ: "endDate", startDate: date(2022, 1, 3), endDate: date(2022, 1, 9)},
+				loc:     time.UTC,
+			},
+			windows: []*timeRange{{start: date(2022, 1, 1), end: date(2022, 2, 1)}},
+			want:    []time.Time{at(2022, 1, 3), at(2022, 1, 5), at(2022, 1, 7), at(2022, 1, 9)},
+		},
+	}
+
+	for _, tt := range tests {
+		got := tt.rec.occurrences(seriesStart, tt.windows)
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+			continue
+		}
+
+		for i := range got {
+			if !got[i].Equal(tt.want[i]) {
+				t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestRecurrenceExdates(t *testing.T) {
+	seriesStart := time.Date(2022, 1, 3, 9, 0, 0, 0, time.UTC)
+
+	// Mondays and Saturdays, on a feed filtered down to the first week's
+	// weekdays and the second week's Monday
+	rec := &recurrence{
+		pattern: &recurrencePattern{typ: "weekly", interval: 1, daysOfWeek: []time.Weekday{time.Monday, time.Saturday}},
+		rng:     &recurrenceRange{typ: "noEnd", startDate: date(2022, 1, 3)},
+		loc:     time.UTC,
+	}
+	windows := []*timeRange{
+		{start: date(2022, 1, 3), end: date(2022, 1, 8)},
+		{start: date(2022, 1, 10), end: date(2022, 1, 11)},
+	}
+
+	// Only the second Monday is on the calendar view, the first was cancelled
+	present := []time.Time{time.Date(2022, 1, 10, 9, 0, 0, 0, time.UTC)}
+
+	var exdates []time.Time
+	for _, instance := range rec.occurrences(seriesStart, windows) {
+		if !containsInstance(present, instance) {
+			exdates = append(exdates, instance)
+		}
+	}
+
+	// The Saturday, out of the windows, is left to the RRULE
+	if len(exdates) != 1 || !exdates[0].Equal(seriesStart) {
+		t.Errorf("excluded %v", exdates)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// logout ends the session of a browser. The OAuth credentials of the user are
+// forgotten, so their feed stops until they log in again, which brings the
+// same feed URL back.
+func logout(token string) error {
+	cal := sessions.logout(token)
+
+	// Nobody logged in yet on this session
+	if cal == nil || cal.userName == "" {
+		return nil
+	}
+
+	if err := cal.unsubscribe(); err != nil {
+		log.Warn().
+			Err(err).
+			Str("user", cal.userName).
+			Str("method", "logout").
+			Msg("Unable to delete subscription")
+	}
+
+	renderedFeeds.forgetUser(cal.userName)
+
+	log.Info().
+		Str("user", cal.userName).
+		Str("method", "logout").
+		Msg("Logged out")
+
+	return cachedData.storeToken(cal.userName, token, nil, false)
+}
+
+// revokeUser deletes the feed of user for good, along with their OAuth
+// credentials, their synced events and, if asked to, the attachments they
+// downloaded. Logging in again gets them a new feed URL.
+func revokeUser(user string, withAttachments bool) error {
+	stored, err := cachedData.loadUserTokens()
+	if err != nil {
+		return err
+	}
+
+	cal := sessions.removeUser(user)
+
+	if s, ok := stored[user]; ok && cal == nil && s.oauthToken != nil {
+		cal = newCalendarHandlerFromToken(user, s.oauthToken, s.publicClient)
+	}
+
+	// Graph would otherwise keep notifying about a user nobody serves
+	if cal != nil && cal.isValid() {
+		if err := cal.unsubscribe(); err != nil {
+			log.Warn().
+				Err(err).
+				Str("user", user).
+				Str("method", "revokeUser").
+				Msg("Unable to delete subscription")
+		}
+	}
+
+	if err := cachedData.removeUser(user); err != nil {
+		return err
+	}
+
+	forgetFeedTokens(user)
+	renderedFeeds.forgetUser(user)
+
+	var ids []string
+	if withAttachments {
+		if ids, err = cachedData.removeAttachments(user); err != nil {
+			return err
+		}
+	}
+
+	for _, id := range ids {
+		if !validAttachmentID(id) {
+			continue
+		}
+
+		if err := os.RemoveAll(viper.GetString("attachments_dir") + "/" + id); err != nil {
+			return err
+		}
+	}
+
+	log.Info().
+		Str("user", user).
+		Int("attachments", len(ids)).
+		Str("method", "revokeUser").
+		Msg("Revoked feed")
+
+	return nil
+}
+
+// dropRevokedSessions stops serving the feeds revoked with the revoke command,
+// or by another instance sharing the database
+func dropRevokedSessions() error {
+	if err := reloadFeedTokens(); err != nil {
+		return err
+	}
+
+	stored, err := cachedData.loadUserTokens()
+	if err != nil {
+		return err
+	}
+
+	for _, user := range sessions.dropRevoked(stored) {
+		renderedFeeds.forgetUser(user)
+
+		log.Info().
+			Str("user", user).
+			Str("method", "dropRevokedSessions").
+			Msg("Dropped revoked session")
+	}
+
+	return nil
+}
+
+// runRevokeCommand handles "revoke <user or feed token> [--attachments]", a
+// named feed token revoking that feed only
+func runRevokeCommand(args []string) error {
+	var target string
+	var withAttachments bool
+
+	for _, arg := range args {
+		switch {
+		case arg == "--attachments":
+			withAttachments = true
+		case target == "" && !strings.HasPrefix(arg, "-"):
+			target = arg
+		default:
+			return fmt.Errorf("unexpected argument %q", arg)
+		}
+	}
+
+	if target == "" {
+		return errors.New("usage: revoke <user or feed token> [--attachments]")
+	}
+
+	if err := initCache(); err != nil {
+		return err
+	}
+
+	if err := reloadFeedTokens(); err != nil {
+		return err
+	}
+
+	if feed := findFeedToken(target); feed != nil {
+		if err := removeFeedToken(target); err != nil {
+			return err
+		}
+
+		fmt.Printf("Revoked the feed %q of %s\n", feed.name, feed.user)
+
+		return nil
+	}
+
+	stored, err := cachedData.loadUserTokens()
+	if err != nil {
+		return err
+	}
+
+	user := target
+	if i := strings.Index(user, "@"); i >= 0 {
+		user = user[:i]
+	}
+
+	for name, s := range stored {
+		if s.token == target {
+			user = name
+		}
+	}
+
+	if _, ok := stored[user]; !ok {
+		return fmt.Errorf("no feed for %q", target)
+	}
+
+	if err := revokeUser(user, withAttachments); err != nil {
+		return err
+	}
+
+	fmt.Printf("Revoked the feed of %s\n", user)
+
+	return nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// sessionRegistry holds the sessions of the service, shared between the echo
+// handlers and the background refresh. Every user known to the service has a
+// single feed token, kept when they log out so logging in again brings the
+// same feed URL back.
+type sessionRegistry struct {
+	mu sync.RWMutex
+
+	// sessions by token, those of browsers still logging in included
+	sessions map[string]*Calendar
+
+	// tokens are the feed tokens of the users, by user name, and users the
+	// other way around
+	tokens map[string]string
+	users  map[string]string
+}
+
+// sessions are the sessions of every browser and user of the service
+var sessions = newSessionRegistry()
+
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{
+		sessions: make(map[string]*Calendar),
+		tokens:   make(map[string]string),
+		users:    make(map[string]string),
+	}
+}
+
+// get returns the session behind token, if any
+func (r *sessionRegistry) get(token string) *Calendar {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.sessions[token]
+}
+
+// add starts the session of a browser which hasn't logged in yet
+func (r *sessionRegistry) add(token string, cal *Calendar) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.sessions[token] = cal
+}
+
+// register serves the feed of user under token from cal, for the users
+// rehydrated from the storage or provisioned by the app
+func (r *sessionRegistry) register(user string, token string, cal *Calendar) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.sessions[token] = cal
+	r.tokens[user] = token
+	r.users[token] = user
+}
+
+// remember keeps the feed token of a user without a session, for when they
+// log in again
+func (r *sessionRegistry) remember(user string, token string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.tokens[user] = token
+	r.users[token] = user
+}
+
+// claim returns the feed token of user, logging in from the browser holding
+// cookieToken. Users logging in for the first time get the cookie as their
+// feed token, unless it's the feed token of someone else. A session logging
+// in as someone else stops serving the feed of its previous user right away.
+func (r *sessionRegistry) claim(user string, cookieToken string, cal *Calendar) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	owner, owned := r.users[cookieToken]
+
+	token, ok := r.tokens[user]
+	if !ok {
+		token = cookieToken
+		if owned && owner != user {
+			minted, err := secureRandomString(45)
+			if err != nil {
+				return "", err
+			}
+
+			token = minted
+		}
+
+		r.tokens[user] = token
+		r.users[token] = user
+	}
+
+	if owned && owner != user && r.sessions[cookieToken] == cal {
+		delete(r.sessions, cookieToken)
+	}
+
+	return token, nil
+}
+
+// serve has cal serve the feed of user under the token they claimed, once
+// logged in, replacing the session of the browser holding cookieToken
+func (r *sessionRegistry) serve(user string, token string, cookieToken string, cal *Calendar) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if token != cookieToken && r.sessions[cookieToken] == cal {
+		delete(r.sessions, cookieToken)
+	}
+
+	r.sessions[token] = cal
+	r.tokens[user] = token
+	r.users[token] = user
+}
+
+// logout ends the session behind token, returning it. Its user, if any, is
+// remembered.
+func (r *sessionRegistry) logout(token string) *Calendar {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cal := r.sessions[token]
+	delete(r.sessions, token)
+
+	return cal
+}
+
+// removeUser forgets user and their feed token, returning their session if
+// they had one
+func (r *sessionRegistry) removeUser(user string) *Calendar {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	token, ok := r.tokens[user]
+	if !ok {
+		return nil
+	}
+
+	cal := r.sessions[token]
+
+	delete(r.sessions, token)
+	delete(r.tokens, user)
+	delete(r.users, token)
+
+	return cal
+}
+
+// userOf returns the user the feed token belongs to, whether they're logged
+// in or not
+func (r *sessionRegistry) userOf(token string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.users[token]
+}
+
+// userSession returns the session serving the feeds of user, if they're
+// logged in
+func (r *sessionRegistry) userSession(user string) *Calendar {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	token, ok := r.tokens[user]
+	if !ok {
+		return nil
+	}
+
+	return r.sessions[token]
+}
+
+// loggedIn returns the sessions of the logged in users, by feed token
+func (r *sessionRegistry) loggedIn() map[string]*Calendar {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	sessions := make(map[string]*Calendar, len(r.tokens))
+	for token := range r.users {
+		if cal, ok := r.sessions[token]; ok {
+			sessions[token] = cal
+		}
+	}
+
+	return sessions
+}
+
+// expire ends the sessions which aren't logged in and had no activity since
+// before, returning the users of those expired, by token. Those of browsers
+// which never finished logging in have none.
+func (r *sessionRegistry) expire(before time.Time) map[string]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	expired := make(map[string]string)
+
+	for token, cal := range r.sessions {
+		if cal.isValid() || !cal.lastActivity().Before(before) {
+			continue
+		}
+
+		delete(r.sessions, token)
+		expired[token] = r.users[token]
+	}
+
+	return expired
+}
+
+// dropRevoked forgets the users whose feed token isn't the stored one
+// anymore, returning those who were logged in. Sessions still logging in are
+// only stored once they're done, and kept until then.
+func (r *sessionRegistry) dropRevoked(stored map[string]*StoredUser) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var dropped []string
+
+	for user, token := range r.tokens {
+		if s, ok := stored[user]; ok && s.token == token {
+			continue
+		}
+
+		cal, ok := r.sessions[token]
+		if ok && !cal.isValid() {
+			continue
+		}
+
+		delete(r.sessions, token)
+		delete(r.tokens, user)
+		delete(r.users, token)
+
+		if ok {
+			dropped = append(dropped, user)
+		}
+	}
+
+	return dropped
+}
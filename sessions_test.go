@@ -0,0 +1,108 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSessionRegistryLogin(t *testing.T) {
+	r := newSessionRegistry()
+
+	jane := newCalendarHandler()
+	r.add("cookie", jane)
+
+	// The first login of a user keeps the cookie as their feed token
+	if token, err := r.claim("jane.doe", "cookie", jane); err != nil || token != "cookie" {
+		t.Fatalf("claimed %q, %v", token, err)
+	}
+
+	jane.setValid(true)
+	r.serve("jane.doe", "cookie", "cookie", jane)
+
+	if r.userSession("jane.doe") != jane || r.userOf("cookie") != "jane.doe" {
+		t.Fatal("session not indexed")
+	}
+
+	// Logging in from another browser moves it to the same feed token
+	other := newCalendarHandler()
+	r.add("other", other)
+
+	if token, err := r.claim("jane.doe", "other", other); err != nil || token != "cookie" {
+		t.Fatalf("claimed %q, %v", token, err)
+	}
+
+	if r.get("cookie") != jane {
+		t.Error("feed not served until the new session is logged in")
+	}
+
+	other.setValid(true)
+	r.serve("jane.doe", "cookie", "other", other)
+
+	if r.get("cookie") != other || r.get("other") != nil {
+		t.Error("session not moved to the feed token")
+	}
+
+	// A browser logging in as someone else stops serving the previous feed,
+	// and doesn't hand it over
+	other.setValid(false)
+
+	token, err := r.claim("john.doe", "cookie", other)
+	if err != nil || token == "cookie" || r.get("cookie") != nil {
+		t.Fatalf("claimed %q, %v, feed of the previous user served by %p", token, err, r.get("cookie"))
+	}
+
+	other.setValid(true)
+	r.serve("john.doe", token, "cookie", other)
+
+	if r.userSession("john.doe") != other || r.userSession("jane.doe") != nil || r.userOf("cookie") != "jane.doe" {
+		t.Error("unexpected sessions after logging in as someone else")
+	}
+
+	if n := len(r.loggedIn()); n != 1 {
+		t.Errorf("%d sessions logged in", n)
+	}
+}
+
+func TestSessionRegistryLogout(t *testing.T) {
+	r := newSessionRegistry()
+
+	jane := newCalendarHandler()
+	jane.setValid(true)
+	r.register("jane.doe", "token", jane)
+
+	if r.logout("token") != jane || r.get("token") != nil {
+		t.Fatal("session not ended")
+	}
+
+	// Logged out users get their feed token back
+	if token, err := r.claim("jane.doe", "cookie", newCalendarHandler()); err != nil || token != "token" {
+		t.Errorf("claimed %q, %v", token, err)
+	}
+
+	r.removeUser("jane.doe")
+
+	if r.userOf("token") != "" {
+		t.Error("feed token of a removed user still known")
+	}
+
+	// Revoked users are forgotten, unless they're still logging in
+	r.register("jane.doe", "token", jane)
+	r.remember("john.doe", "john")
+
+	stored := map[string]*StoredUser{"jane.doe": {token: "token"}}
+
+	if dropped := r.dropRevoked(stored); len(dropped) != 0 || r.userOf("john") != "" {
+		t.Errorf("dropped %v", dropped)
+	}
+
+	jane.setValid(false)
+
+	if dropped := r.dropRevoked(nil); len(dropped) != 0 || r.get("token") != jane {
+		t.Errorf("dropped %v while logging in", dropped)
+	}
+
+	jane.setValid(true)
+
+	if dropped := r.dropRevoked(nil); len(dropped) != 1 || r.get("token") != nil {
+		t.Errorf("dropped %v", dropped)
+	}
+}
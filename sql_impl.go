@@ -7,16 +7,20 @@ import (
 	"time"
 
 	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/oauth2"
 )
 
 const (
 	loggedUsersTable = "logged_users"
 	attachmentsTable = "attachments"
-	monthCacheTable  = "month_cache"
+	eventsTable      = "calendar_events"
+	deltaLinksTable  = "delta_links"
+	subsTable        = "subscriptions"
+	feedTokensTable  = "feed_tokens"
 )
 
-var cachedData *CachedData
-
 type DBConfs struct {
 	user     string
 	password string
@@ -24,14 +28,16 @@ type DBConfs struct {
 	schema   string
 }
 
-type CachedData struct {
+// SQLCache is shared by the PostgreSQL and SQLite backends, the queries
+// being written in the subset of SQL both understand
+type SQLCache struct {
 	db *sql.DB
 }
 
-func initCache(opts *DBConfs) error {
+func openPostgres(opts *DBConfs) (*sql.DB, error) {
 	db, err := sql.Open("postgres", fmt.Sprintf("postgres://%s:%s@%s/%s?sslmode=disable", opts.user, opts.password, opts.host, opts.schema))
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// See "Important settings" section.
@@ -39,30 +45,103 @@ func initCache(opts *DBConfs) error {
 	db.SetMaxOpenConns(10)
 	db.SetMaxIdleConns(10)
 
-	if err := validateTables(opts.schema, db); err != nil {
-		return err
+	return db, nil
+}
+
+func openSQLite(path string) (*sql.DB, error) {
+	if path == "" {
+		return nil, fmt.Errorf("sqlite.path is not configured")
+	}
+
+	db, err := sql.Open("sqlite3", "file:"+path+"?_busy_timeout=5000&_journal_mode=WAL")
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite only handles one writer at a time
+	db.SetMaxOpenConns(1)
+
+	return db, nil
+}
+
+func newPostgresCache(opts *DBConfs, autoMigrate bool) (*SQLCache, error) {
+	db, err := openPostgres(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validateSchema(postgresBackend, db, autoMigrate); err != nil {
+		return nil, err
+	}
+
+	return &SQLCache{
+		db: db,
+	}, nil
+}
+
+func newSQLiteCache(path string, autoMigrate bool) (*SQLCache, error) {
+	db, err := openSQLite(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validateSchema(sqliteBackend, db, autoMigrate); err != nil {
+		return nil, err
 	}
 
-	cachedData = &CachedData{
+	return &SQLCache{
 		db: db,
+	}, nil
+}
+
+func encryptTokenColumn(oauthToken *oauth2.Token) (sql.NullString, error) {
+	if oauthToken == nil {
+		return sql.NullString{}, nil
 	}
 
-	return nil
+	encrypted, err := encryptToken(oauthToken)
+	if err == errNoTokenKey {
+		return sql.NullString{}, nil
+	} else if err != nil {
+		return sql.NullString{}, err
+	}
+
+	return sql.NullString{String: encrypted, Valid: true}, nil
 }
 
-func (cd *CachedData) storeToken(user string, token string) error {
-	_, err := cd.db.Exec("INSERT INTO "+loggedUsersTable+"(\"user\", token, last_updated) VALUES($1, $2, $3) "+
-		"ON CONFLICT (\"user\") DO UPDATE SET token = EXCLUDED.token, last_updated = EXCLUDED.last_updated WHERE "+loggedUsersTable+".\"user\" = $1", user, token, time.Now())
+func (cd *SQLCache) storeToken(user string, token string, oauthToken *oauth2.Token, publicClient bool) error {
+	encrypted, err := encryptTokenColumn(oauthToken)
+	if err != nil {
+		return err
+	}
+
+	_, err = cd.db.Exec("INSERT INTO "+loggedUsersTable+"(\"user\", token, oauth_token, public_client, last_updated) VALUES($1, $2, $3, $4, $5) "+
+		"ON CONFLICT (\"user\") DO UPDATE SET token = EXCLUDED.token, oauth_token = EXCLUDED.oauth_token, public_client = EXCLUDED.public_client, last_updated = EXCLUDED.last_updated "+
+		"WHERE "+loggedUsersTable+".\"user\" = $1", user, token, encrypted, publicClient, time.Now().UTC())
 
 	return err
 }
 
-func (cd *CachedData) loadUserTokens() (map[string]string, error) {
+func (cd *SQLCache) updateOAuthToken(user string, oauthToken *oauth2.Token) error {
+	encrypted, err := encryptTokenColumn(oauthToken)
+	if err != nil || !encrypted.Valid {
+		return err
+	}
+
+	_, err = cd.db.Exec("UPDATE "+loggedUsersTable+" SET oauth_token = $1 WHERE \"user\" = $2", encrypted, user)
+
+	return err
+}
+
+func (cd *SQLCache) loadUserTokens() (map[string]*StoredUser, error) {
 	var user, token string
+	var encrypted sql.NullString
+	var publicClient bool
+	var lastUpdated time.Time
 
-	tokens := make(map[string]string)
+	users := make(map[string]*StoredUser)
 
-	rows, err := cd.db.Query("SELECT \"user\", token FROM " + loggedUsersTable)
+	rows, err := cd.db.Query("SELECT \"user\", token, oauth_token, public_client, last_updated FROM " + loggedUsersTable)
 	if err != nil {
 		return nil, err
 	}
@@ -70,18 +149,37 @@ func (cd *CachedData) loadUserTokens() (map[string]string, error) {
 	defer rows.Close()
 
 	for rows.Next() {
-		err = rows.Scan(&user, &token)
+		err = rows.Scan(&user, &token, &encrypted, &publicClient, &lastUpdated)
 		if err != nil {
 			return nil, err
 		}
 
-		tokens[user] = token
+		stored := &StoredUser{token: token, publicClient: publicClient, lastUpdated: lastUpdated.UTC()}
+
+		if encrypted.Valid {
+			stored.oauthToken, err = decryptToken(encrypted.String)
+			if err != nil {
+				log.Warn().
+					Err(err).
+					Str("user", user).
+					Str("method", "loadUserTokens").
+					Msg("Unable to decrypt stored OAuth token")
+			}
+		}
+
+		users[user] = stored
 	}
 
-	return tokens, nil
+	return users, nil
+}
+
+func (cd *SQLCache) touchUser(user string, lastUpdated time.Time) error {
+	_, err := cd.db.Exec("UPDATE "+loggedUsersTable+" SET last_updated = $1 WHERE \"user\" = $2", lastUpdated.UTC(), user)
+
+	return err
 }
 
-func (cd *CachedData) attachmentExists(id string) []string {
+func (cd *SQLCache) attachmentExists(id string) []string {
 	var fname, contentType string
 
 	err := cd.db.QueryRow("SELECT fname, content_type FROM "+attachmentsTable+" WHERE att_id = $1", id).Scan(&fname, &contentType)
@@ -92,48 +190,266 @@ func (cd *CachedData) attachmentExists(id string) []string {
 	return []string{fname, contentType}
 }
 
-func (cd *CachedData) saveAttachment(id string, name string, contentType string) error {
-	_, err := cd.db.Exec("INSERT INTO "+attachmentsTable+"(att_id, fname, content_type, last_updated) VALUES($1, $2, $3, $4)", id, name, contentType, time.Now())
+func (cd *SQLCache) saveAttachment(user string, id string, name string, contentType string) error {
+	_, err := cd.db.Exec("INSERT INTO "+attachmentsTable+"(att_id, fname, content_type, \"user\", last_updated) VALUES($1, $2, $3, $4, $5)", id, name, contentType, user, time.Now())
 	return err
 }
 
-func (cd *CachedData) getCacheForUserLastUpdate(user string, start time.Time, end time.Time) (time.Time, error) {
-	var lastUpdated sql.NullTime
+func (cd *SQLCache) removeAttachments(user string) ([]string, error) {
+	var ids []string
+
+	tx, err := cd.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT att_id FROM "+attachmentsTable+" WHERE \"user\" = $1 ORDER BY att_id", user)
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		ids = append(ids, id)
+	}
+
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec("DELETE FROM "+attachmentsTable+" WHERE \"user\" = $1", user); err != nil {
+		return nil, err
+	}
+
+	return ids, tx.Commit()
+}
+
+func (cd *SQLCache) getDeltaState(user string, calendar string) (*DeltaState, error) {
+	state := &DeltaState{}
+
+	err := cd.db.QueryRow("SELECT delta_link, start, \"end\", last_synced FROM "+deltaLinksTable+" WHERE \"user\" = $1 AND calendar_id = $2", user, calendar).
+		Scan(&state.deltaLink, &state.start, &state.end, &state.lastSynced)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	state.start = state.start.UTC()
+	state.end = state.end.UTC()
 
-	err := cd.db.QueryRow("SELECT last_updated FROM "+monthCacheTable+" WHERE \"user\" = $1 AND start = $2 AND \"end\" = $3", user, start, end).Scan(&lastUpdated)
+	return state, nil
+}
+
+func (cd *SQLCache) getSyncedCalendars(user string) ([]string, error) {
+	var calendars []string
+
+	rows, err := cd.db.Query("SELECT calendar_id FROM "+deltaLinksTable+" WHERE \"user\" = $1 ORDER BY calendar_id", user)
 	if err != nil {
-		return time.Now(), err
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var calendar string
+
+		if err := rows.Scan(&calendar); err != nil {
+			return nil, err
+		}
+
+		calendars = append(calendars, calendar)
 	}
 
-	return lastUpdated.Time, nil
+	return calendars, rows.Err()
 }
 
-func (cd *CachedData) saveCacheForUser(user string, start time.Time, end time.Time, cachedValues []interface{}) error {
-	jsonData, err := json.Marshal(cachedValues)
+func (cd *SQLCache) saveDelta(user string, calendar string, state *DeltaState, upserts []*StoredEvent, removed []string, reset bool) error {
+	tx, err := cd.db.Begin()
 	if err != nil {
 		return err
 	}
 
-	_, err = cd.db.Exec("INSERT INTO "+monthCacheTable+"(\"user\", start, \"end\", contents, last_updated) VALUES($1, $2, $3, $4, $5) "+
-		"ON CONFLICT (start,\"end\",\"user\") DO UPDATE SET contents = EXCLUDED.contents, last_updated = EXCLUDED.last_updated "+
-		"WHERE "+monthCacheTable+".\"user\" = $1 AND "+monthCacheTable+".start = $2 AND "+monthCacheTable+".\"end\" = $3", user, start, end, string(jsonData), time.Now())
+	defer tx.Rollback()
 
-	return err
+	if reset {
+		if _, err := tx.Exec("DELETE FROM "+eventsTable+" WHERE \"user\" = $1 AND calendar_id = $2", user, calendar); err != nil {
+			return err
+		}
+	}
+
+	for _, id := range removed {
+		if _, err := tx.Exec("DELETE FROM "+eventsTable+" WHERE \"user\" = $1 AND calendar_id = $2 AND event_id = $3", user, calendar, id); err != nil {
+			return err
+		}
+	}
+
+	for _, event := range upserts {
+		jsonData, err := json.Marshal(event.event)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("INSERT INTO "+eventsTable+"(\"user\", calendar_id, event_id, start, \"end\", contents, last_updated) VALUES($1, $2, $3, $4, $5, $6, $7) "+
+			"ON CONFLICT (\"user\", calendar_id, event_id) DO UPDATE SET start = EXCLUDED.start, \"end\" = EXCLUDED.\"end\", contents = EXCLUDED.contents, last_updated = EXCLUDED.last_updated",
+			user, calendar, event.id, event.start.UTC(), event.end.UTC(), string(jsonData), time.Now())
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec("INSERT INTO "+deltaLinksTable+"(\"user\", calendar_id, delta_link, start, \"end\", last_synced) VALUES($1, $2, $3, $4, $5, $6) "+
+		"ON CONFLICT (\"user\", calendar_id) DO UPDATE SET delta_link = EXCLUDED.delta_link, start = EXCLUDED.start, \"end\" = EXCLUDED.\"end\", last_synced = EXCLUDED.last_synced",
+		user, calendar, state.deltaLink, state.start.UTC(), state.end.UTC(), state.lastSynced)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (cd *SQLCache) getEvents(user string, calendar string, start time.Time, end time.Time) ([]*Event, error) {
+	var events []*Event
+
+	rows, err := cd.db.Query("SELECT contents FROM "+eventsTable+" WHERE \"user\" = $1 AND calendar_id = $2 AND \"end\" > $3 AND start < $4 ORDER BY start", user, calendar, start.UTC(), end.UTC())
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var contents string
+
+		event := &Event{}
+
+		if err := rows.Scan(&contents); err != nil {
+			return nil, err
+		}
+
+		if err := json.Unmarshal([]byte(contents), event); err != nil {
+			return nil, err
+		}
+
+		events = append(events, event)
+	}
+
+	return events, rows.Err()
 }
 
-func (cd *CachedData) getUserCache(user string, start time.Time, end time.Time) ([]interface{}, error) {
-	var cachedValues []interface{}
-	var cachedValuesText string
+func (cd *SQLCache) removeCalendar(user string, calendar string) error {
+	tx, err := cd.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM "+eventsTable+" WHERE \"user\" = $1 AND calendar_id = $2", user, calendar); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM "+deltaLinksTable+" WHERE \"user\" = $1 AND calendar_id = $2", user, calendar); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
 
-	err := cd.db.QueryRow("SELECT contents FROM "+monthCacheTable+" WHERE \"user\" = $1 AND start = $2 AND \"end\" = $3", user, start, end).Scan(&cachedValuesText)
+func (cd *SQLCache) removeUser(user string) error {
+	tx, err := cd.db.Begin()
 	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	for _, table := range []string{eventsTable, deltaLinksTable, subsTable, feedTokensTable, loggedUsersTable} {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE \"user\" = $1", user); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (cd *SQLCache) getSubscription(user string) (*Subscription, error) {
+	sub := &Subscription{}
+
+	err := cd.db.QueryRow("SELECT subscription_id, client_state, expiration FROM "+subsTable+" WHERE \"user\" = $1", user).
+		Scan(&sub.id, &sub.clientState, &sub.expiration)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
 		return nil, err
 	}
 
-	err = json.Unmarshal([]byte(cachedValuesText), &cachedValues)
+	sub.expiration = sub.expiration.UTC()
+
+	return sub, nil
+}
+
+func (cd *SQLCache) saveSubscription(user string, sub *Subscription) error {
+	_, err := cd.db.Exec("INSERT INTO "+subsTable+"(\"user\", subscription_id, client_state, expiration, last_updated) VALUES($1, $2, $3, $4, $5) "+
+		"ON CONFLICT (\"user\") DO UPDATE SET subscription_id = EXCLUDED.subscription_id, client_state = EXCLUDED.client_state, expiration = EXCLUDED.expiration, last_updated = EXCLUDED.last_updated",
+		user, sub.id, sub.clientState, sub.expiration.UTC(), time.Now())
+
+	return err
+}
+
+func (cd *SQLCache) saveFeedToken(feed *FeedToken) error {
+	_, err := cd.db.Exec("INSERT INTO "+feedTokensTable+"(token, \"user\", name, options, created) VALUES($1, $2, $3, $4, $5)",
+		feed.token, feed.user, feed.name, feed.options, feed.created.UTC())
+
+	return err
+}
+
+func (cd *SQLCache) loadFeedTokens() ([]*FeedToken, error) {
+	var feeds []*FeedToken
+
+	rows, err := cd.db.Query("SELECT token, \"user\", name, options, created, last_used FROM " + feedTokensTable + " ORDER BY created")
 	if err != nil {
 		return nil, err
 	}
 
-	return cachedValues, nil
+	defer rows.Close()
+
+	for rows.Next() {
+		var lastUsed sql.NullTime
+
+		feed := &FeedToken{}
+		if err := rows.Scan(&feed.token, &feed.user, &feed.name, &feed.options, &feed.created, &lastUsed); err != nil {
+			return nil, err
+		}
+
+		feed.created = feed.created.UTC()
+		if lastUsed.Valid {
+			feed.lastUsed = lastUsed.Time.UTC()
+		}
+
+		feeds = append(feeds, feed)
+	}
+
+	return feeds, rows.Err()
+}
+
+func (cd *SQLCache) touchFeedToken(token string, lastUsed time.Time) error {
+	_, err := cd.db.Exec("UPDATE "+feedTokensTable+" SET last_used = $1 WHERE token = $2", lastUsed.UTC(), token)
+
+	return err
+}
+
+func (cd *SQLCache) removeFeedToken(token string) error {
+	_, err := cd.db.Exec("DELETE FROM "+feedTokensTable+" WHERE token = $1", token)
+
+	return err
 }
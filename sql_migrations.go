@@ -0,0 +1,219 @@
+package main
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	schemaMigrationsTable = "schema_migrations"
+)
+
+//go:embed migrations
+var migrationFiles embed.FS
+
+type migration struct {
+	version int
+	name    string
+	sql     string
+}
+
+type migrationState struct {
+	migration *migration
+	appliedAt sql.NullTime
+}
+
+func loadMigrations(dialect string) ([]*migration, error) {
+	var migrations []*migration
+
+	dir := path.Join("migrations", dialect)
+	entries, err := migrationFiles.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		fname := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(fname, ".sql") {
+			continue
+		}
+
+		sep := strings.Index(fname, "_")
+		if sep < 0 {
+			return nil, fmt.Errorf("invalid migration file name %s", fname)
+		}
+
+		version, err := strconv.Atoi(fname[:sep])
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration file name %s: %w", fname, err)
+		}
+
+		contents, err := migrationFiles.ReadFile(path.Join(dir, fname))
+		if err != nil {
+			return nil, err
+		}
+
+		migrations = append(migrations, &migration{
+			version: version,
+			name:    strings.TrimSuffix(fname[sep+1:], ".sql"),
+			sql:     string(contents),
+		})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].version < migrations[j].version
+	})
+
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].version == migrations[i-1].version {
+			return nil, fmt.Errorf("duplicated migration version %d", migrations[i].version)
+		}
+	}
+
+	return migrations, nil
+}
+
+func createSchemaMigrationsTable(db *sql.DB) error {
+	_, err := db.Exec("CREATE TABLE IF NOT EXISTS " + schemaMigrationsTable + " (" +
+		"version INTEGER NOT NULL," +
+		"name VARCHAR(256) NOT NULL," +
+		"applied_at TIMESTAMP NOT NULL," +
+		"PRIMARY KEY (version));")
+
+	return err
+}
+
+func appliedMigrations(db *sql.DB) (map[int]time.Time, error) {
+	var version int
+	var appliedAt time.Time
+
+	applied := make(map[int]time.Time)
+
+	rows, err := db.Query("SELECT version, applied_at FROM " + schemaMigrationsTable)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+
+		applied[version] = appliedAt
+	}
+
+	return applied, rows.Err()
+}
+
+func migrationStatus(dialect string, db *sql.DB) ([]*migrationState, error) {
+	var states []*migrationState
+
+	if err := createSchemaMigrationsTable(db); err != nil {
+		return nil, err
+	}
+
+	migrations, err := loadMigrations(dialect)
+	if err != nil {
+		return nil, err
+	}
+
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+
+	known := make(map[int]bool)
+	for _, m := range migrations {
+		known[m.version] = true
+
+		state := &migrationState{migration: m}
+		if appliedAt, ok := applied[m.version]; ok {
+			state.appliedAt = sql.NullTime{Time: appliedAt, Valid: true}
+		}
+
+		states = append(states, state)
+	}
+
+	for version := range applied {
+		if !known[version] {
+			return states, fmt.Errorf("database schema version %d is newer than this build knows about, please upgrade", version)
+		}
+	}
+
+	return states, nil
+}
+
+func pendingMigrations(states []*migrationState) []*migration {
+	var pending []*migration
+
+	for _, s := range states {
+		if !s.appliedAt.Valid {
+			pending = append(pending, s.migration)
+		}
+	}
+
+	return pending
+}
+
+func applyMigration(db *sql.DB, m *migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(m.sql); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("migration %04d_%s: %w", m.version, m.name, err)
+	}
+
+	if _, err := tx.Exec("INSERT INTO "+schemaMigrationsTable+"(version, name, applied_at) VALUES($1, $2, $3)", m.version, m.name, time.Now()); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func migrateUp(dialect string, db *sql.DB) ([]*migration, error) {
+	states, err := migrationStatus(dialect, db)
+	if err != nil {
+		return nil, err
+	}
+
+	pending := pendingMigrations(states)
+	for _, m := range pending {
+		if err := applyMigration(db, m); err != nil {
+			return nil, err
+		}
+	}
+
+	return pending, nil
+}
+
+// validateSchema is run on startup. It refuses to run against a schema newer
+// than this build, and applies any pending migration unless auto_migrate is off.
+func validateSchema(dialect string, db *sql.DB, autoMigrate bool) error {
+	if autoMigrate {
+		_, err := migrateUp(dialect, db)
+		return err
+	}
+
+	states, err := migrationStatus(dialect, db)
+	if err != nil {
+		return err
+	}
+
+	if pending := pendingMigrations(states); len(pending) > 0 {
+		return fmt.Errorf("%d pending schema migrations, run the migrate command first", len(pending))
+	}
+
+	return nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/viper"
+	"golang.org/x/oauth2"
+)
+
+const (
+	postgresBackend = "postgres"
+	sqliteBackend   = "sqlite"
+	memoryBackend   = "memory"
+)
+
+var cachedData CachedData
+
+// DeltaState keeps where the delta sync of a calendar stopped, and the range it covers
+type DeltaState struct {
+	deltaLink  string
+	start      time.Time
+	end        time.Time
+	lastSynced time.Time
+}
+
+// StoredEvent is a Graph event kept on the local event store
+type StoredEvent struct {
+	id    string
+	start time.Time
+	end   time.Time
+	event *Event
+}
+
+// Subscription is the Graph change notification subscription of a user
+type Subscription struct {
+	id          string
+	clientState string
+	expiration  time.Time
+}
+
+// FeedToken is a named feed of a user, serving the options stored along with
+// it instead of the ones on its URL
+type FeedToken struct {
+	token    string
+	user     string
+	name     string
+	options  string
+	created  time.Time
+	lastUsed time.Time
+}
+
+// CachedData is implemented by every storage backend able to keep the logged
+// users, the attachments metadata, the events kept in sync through delta
+// queries, the change notification subscriptions and the named feeds of the
+// users. Events are kept per calendar, the default calendar of the user having
+// an empty id, and getEvents returns every event overlapping the requested
+// range. Calendars no longer accessible are dropped with removeCalendar, and
+// everything kept for a user with removeUser.
+type CachedData interface {
+	storeToken(user string, token string, oauthToken *oauth2.Token, publicClient bool) error
+	updateOAuthToken(user string, oauthToken *oauth2.Token) error
+	loadUserTokens() (map[string]*StoredUser, error)
+	touchUser(user string, lastUpdated time.Time) error
+	attachmentExists(id string) []string
+	saveAttachment(user string, id string, name string, contentType string) error
+	removeAttachments(user string) ([]string, error)
+	getDeltaState(user string, calendar string) (*DeltaState, error)
+	getSyncedCalendars(user string) ([]string, error)
+	saveDelta(user string, calendar string, state *DeltaState, upserts []*StoredEvent, removed []string, reset bool) error
+	getEvents(user string, calendar string, start time.Time, end time.Time) ([]*Event, error)
+	removeCalendar(user string, calendar string) error
+	removeUser(user string) error
+	saveFeedToken(feed *FeedToken) error
+	loadFeedTokens() ([]*FeedToken, error)
+	touchFeedToken(token string, lastUsed time.Time) error
+	removeFeedToken(token string) error
+	getSubscription(user string) (*Subscription, error)
+	saveSubscription(user string, sub *Subscription) error
+}
+
+func postgresConfs() *DBConfs {
+	sqlConfs := viper.GetStringMapString("psql")
+
+	return &DBConfs{
+		user:     sqlConfs["user"],
+		password: sqlConfs["password"],
+		host:     sqlConfs["host"],
+		schema:   sqlConfs["schema"],
+	}
+}
+
+func cacheBackend() string {
+	backend := viper.GetString("cache_backend")
+	if backend == "" {
+		return postgresBackend
+	}
+
+	return backend
+}
+
+func initCache() error {
+	var err error
+
+	autoMigrate := viper.GetBool("auto_migrate")
+
+	switch backend := cacheBackend(); backend {
+	case postgresBackend:
+		cachedData, err = newPostgresCache(postgresConfs(), autoMigrate)
+	case sqliteBackend:
+		cachedData, err = newSQLiteCache(viper.GetString("sqlite.path"), autoMigrate)
+	case memoryBackend:
+		cachedData = newMemoryCache()
+	default:
+		err = fmt.Errorf("unknown cache_backend %q", backend)
+	}
+
+	return err
+}
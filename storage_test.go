@@ -0,0 +1,277 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"golang.org/x/oauth2"
+)
+
+// forEachBackend runs test against every backend that can run in a test,
+// the SQLite one on a file of its own
+func forEachBackend(t *testing.T, test func(t *testing.T, cd CachedData)) {
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+
+	viper.Set("token_key", "test-key")
+
+	t.Run(memoryBackend, func(t *testing.T) {
+		test(t, newMemoryCache())
+	})
+
+	t.Run(sqliteBackend, func(t *testing.T) {
+		cd, err := newSQLiteCache(filepath.Join(t.TempDir(), "cache.db"), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		t.Cleanup(func() { cd.db.Close() })
+
+		test(t, cd)
+	})
+}
+
+func storedEvent(id string, start time.Time, duration time.Duration) *StoredEvent {
+	return &StoredEvent{
+		id:    id,
+		start: start,
+		end:   start.Add(duration),
+		event: newTestEvent(id, id, start, duration),
+	}
+}
+
+func eventIDs(events []*Event) []string {
+	var ids []string
+
+	for _, e := range events {
+		ids = append(ids, e.ID)
+	}
+
+	return ids
+}
+
+func sameIDs(got []string, want ...string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func TestCachedDataUsers(t *testing.T) {
+	lastFetch := time.Date(2022, 1, 3, 9, 0, 0, 0, time.UTC)
+
+	forEachBackend(t, func(t *testing.T, cd CachedData) {
+		if err := cd.storeToken("jane.doe", "feed", &oauth2.Token{AccessToken: "first"}, true); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := cd.updateOAuthToken("jane.doe", &oauth2.Token{AccessToken: "refreshed"}); err != nil {
+			t.Fatal(err)
+		}
+
+		// Unknown users aren't added
+		if err := cd.updateOAuthToken("john.doe", &oauth2.Token{AccessToken: "other"}); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := cd.touchUser("jane.doe", lastFetch); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := cd.touchUser("john.doe", lastFetch); err != nil {
+			t.Fatal(err)
+		}
+
+		users, err := cd.loadUserTokens()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		jane, ok := users["jane.doe"]
+		if len(users) != 1 || !ok {
+			t.Fatalf("loaded %v", users)
+		}
+
+		if jane.token != "feed" || !jane.publicClient || jane.oauthToken == nil || jane.oauthToken.AccessToken != "refreshed" || !jane.lastUpdated.Equal(lastFetch) {
+			t.Errorf("loaded %+v", jane)
+		}
+
+		if err := cd.removeUser("jane.doe"); err != nil {
+			t.Fatal(err)
+		}
+
+		if users, err := cd.loadUserTokens(); err != nil || len(users) != 0 {
+			t.Errorf("loaded %v after removal, %v", users, err)
+		}
+	})
+}
+
+func TestCachedDataEvents(t *testing.T) {
+	monday := time.Date(2022, 1, 3, 0, 0, 0, 0, time.UTC)
+
+	forEachBackend(t, func(t *testing.T, cd CachedData) {
+		state := &DeltaState{deltaLink: "delta-1", start: monday, end: monday.AddDate(0, 0, 14), lastSynced: monday}
+		upserts := []*StoredEvent{
+			storedEvent("before", monday.Add(-2*time.Hour), time.Hour),
+			storedEvent("overlapping", monday.Add(-time.Hour), 2*time.Hour),
+			storedEvent("inside", monday.Add(9*time.Hour), time.Hour),
+			storedEvent("after", monday.AddDate(0, 0, 1), time.Hour),
+		}
+
+		if err := cd.saveDelta("jane.doe", "", state, upserts, nil, true); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := cd.saveDelta("jane.doe", "shared", state, []*StoredEvent{storedEvent("shared", monday.Add(9*time.Hour), time.Hour)}, nil, true); err != nil {
+			t.Fatal(err)
+		}
+
+		// Events overlapping the range, by start, of that calendar only
+		events, err := cd.getEvents("jane.doe", "", monday, monday.AddDate(0, 0, 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ids := eventIDs(events); !sameIDs(ids, "overlapping", "inside") {
+			t.Errorf("got %v", ids)
+		}
+
+		got, err := cd.getDeltaState("jane.doe", "")
+		if err != nil || got == nil {
+			t.Fatalf("got %v, %v", got, err)
+		}
+
+		if got.deltaLink != "delta-1" || !got.start.Equal(monday) || !got.end.Equal(state.end) {
+			t.Errorf("got %+v", got)
+		}
+
+		if calendars, err := cd.getSyncedCalendars("jane.doe"); err != nil || !sameIDs(calendars, "", "shared") {
+			t.Errorf("got %q, %v", calendars, err)
+		}
+
+		// Incremental changes keep the rest, a reset drops it
+		moved := storedEvent("inside", monday.Add(15*time.Hour), time.Hour)
+		state.deltaLink = "delta-2"
+
+		if err := cd.saveDelta("jane.doe", "", state, []*StoredEvent{moved}, []string{"overlapping"}, false); err != nil {
+			t.Fatal(err)
+		}
+
+		events, _ = cd.getEvents("jane.doe", "", monday.AddDate(0, 0, -1), monday.AddDate(0, 0, 7))
+		if ids := eventIDs(events); !sameIDs(ids, "before", "inside", "after") {
+			t.Errorf("got %v", ids)
+		}
+
+		if err := cd.saveDelta("jane.doe", "", state, []*StoredEvent{storedEvent("new", monday, time.Hour)}, nil, true); err != nil {
+			t.Fatal(err)
+		}
+
+		events, _ = cd.getEvents("jane.doe", "", monday.AddDate(0, 0, -1), monday.AddDate(0, 0, 7))
+		if ids := eventIDs(events); !sameIDs(ids, "new") {
+			t.Errorf("got %v after a reset", ids)
+		}
+
+		if err := cd.removeCalendar("jane.doe", "shared"); err != nil {
+			t.Fatal(err)
+		}
+
+		if got, err := cd.getDeltaState("jane.doe", "shared"); err != nil || got != nil {
+			t.Errorf("got %v, %v for a removed calendar", got, err)
+		}
+
+		if err := cd.removeUser("jane.doe"); err != nil {
+			t.Fatal(err)
+		}
+
+		if calendars, err := cd.getSyncedCalendars("jane.doe"); err != nil || len(calendars) != 0 {
+			t.Errorf("got %q, %v for a removed user", calendars, err)
+		}
+	})
+}
+
+func TestCachedDataSubscriptions(t *testing.T) {
+	expiration := time.Date(2022, 1, 5, 9, 0, 0, 0, time.UTC)
+
+	forEachBackend(t, func(t *testing.T, cd CachedData) {
+		if sub, err := cd.getSubscription("jane.doe"); err != nil || sub != nil {
+			t.Fatalf("got %v, %v", sub, err)
+		}
+
+		if err := cd.saveSubscription("jane.doe", &Subscription{id: "sub-1", clientState: "state", expiration: expiration}); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := cd.saveSubscription("jane.doe", &Subscription{id: "sub-2", clientState: "state", expiration: expiration}); err != nil {
+			t.Fatal(err)
+		}
+
+		sub, err := cd.getSubscription("jane.doe")
+		if err != nil || sub == nil || sub.id != "sub-2" || !sub.expiration.Equal(expiration) {
+			t.Errorf("got %+v, %v", sub, err)
+		}
+	})
+}
+
+func TestCachedDataFeedTokens(t *testing.T) {
+	created := time.Date(2022, 1, 3, 9, 0, 0, 0, time.UTC)
+
+	forEachBackend(t, func(t *testing.T, cd CachedData) {
+		for i, token := range []string{"work", "phone"} {
+			feed := &FeedToken{token: token, user: "jane.doe", name: token, options: "full=true", created: created.Add(time.Duration(i) * time.Hour)}
+			if err := cd.saveFeedToken(feed); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := cd.touchFeedToken("phone", created.AddDate(0, 0, 1)); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := cd.removeFeedToken("work"); err != nil {
+			t.Fatal(err)
+		}
+
+		feeds, err := cd.loadFeedTokens()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(feeds) != 1 || feeds[0].token != "phone" || feeds[0].options != "full=true" || !feeds[0].lastUsed.Equal(created.AddDate(0, 0, 1)) {
+			t.Errorf("loaded %+v", feeds)
+		}
+	})
+}
+
+func TestCachedDataAttachments(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, cd CachedData) {
+		if err := cd.saveAttachment("jane.doe", "att-2", "agenda.pdf", "application/pdf"); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := cd.saveAttachment("jane.doe", "att-1", "notes.txt", "text/plain"); err != nil {
+			t.Fatal(err)
+		}
+
+		if att := cd.attachmentExists("att-2"); len(att) != 2 || att[0] != "agenda.pdf" || att[1] != "application/pdf" {
+			t.Errorf("got %v", att)
+		}
+
+		ids, err := cd.removeAttachments("jane.doe")
+		if err != nil || !sameIDs(ids, "att-1", "att-2") {
+			t.Errorf("removed %v, %v", ids, err)
+		}
+
+		if att := cd.attachmentExists("att-2"); att != nil {
+			t.Errorf("got %v after removal", att)
+		}
+	})
+}
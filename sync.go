@@ -0,0 +1,299 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+const (
+	deltaRangeSlack = 4 * 7 * 24 * time.Hour
+)
+
+var errResyncRequired = errors.New("delta sync state is no longer valid")
+
+// getDeltaRange returns the range the local event store must cover, which is
+// the widest window a feed is allowed to ask for
+func getDeltaRange() (time.Time, time.Time, error) {
+	max, err := parseDays(viper.GetString("sync_window.max"))
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	start, end := getSyncWindow(max, max)
+
+	return start, end, nil
+}
+
+// covers reports whether the synced range of the state includes [start, end)
+func (s *DeltaState) covers(start time.Time, end time.Time) bool {
+	return s != nil && !s.start.After(start) && !s.end.Before(end)
+}
+
+// mailboxPath is the root of the Graph resources of a mailbox, the user's own
+// one when empty
+func (c *Calendar) mailboxPath(mailbox string) string {
+	if mailbox == "" {
+		mailbox = c.appMailbox
+	}
+
+	if mailbox == "" {
+		return "/me"
+	}
+
+	return "/users/" + url.PathEscape(mailbox)
+}
+
+// mailboxCalendar names a calendar of another mailbox shared with the user the
+// way it's synced and stored, prefixed by the mailbox. Mailboxes and calendar
+// ids with colons are rejected by parseMailbox and parseCalendars.
+func mailboxCalendar(mailbox string, calendar string) string {
+	if mailbox == "" {
+		return calendar
+	}
+
+	return mailbox + ":" + calendar
+}
+
+// splitCalendar returns the mailbox and the id of a synced calendar
+func splitCalendar(calendar string) (string, string) {
+	if i := strings.Index(calendar, ":"); i >= 0 {
+		return calendar[:i], calendar[i+1:]
+	}
+
+	return "", calendar
+}
+
+// calendarViewPath is the calendar view of the given calendar, or of the
+// default one of its mailbox when it has no id
+func (c *Calendar) calendarViewPath(calendar string) string {
+	mailbox, id := splitCalendar(calendar)
+	if id == "" {
+		return c.mailboxPath(mailbox) + "/calendarView"
+	}
+
+	return c.mailboxPath(mailbox) + "/calendars/" + url.PathEscape(id) + "/calendarView"
+}
+
+func (c *Calendar) initialDeltaURL(calendar string, start time.Time, end time.Time) string {
+	return c.calendarViewPath(calendar) + "/delta?startDateTime=" + start.Format(RFC3339Short) + "&endDateTime=" + end.Format(RFC3339Short)
+}
+
+// syncedCalendars returns the calendars of the user kept in sync, which always
+// include the default one
+func (c *Calendar) syncedCalendars() ([]string, error) {
+	calendars, err := cachedData.getSyncedCalendars(c.userName)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, calendar := range calendars {
+		if calendar == "" {
+			return calendars, nil
+		}
+	}
+
+	return append([]string{""}, calendars...), nil
+}
+
+// fetchDelta follows the pages of a delta query until the next deltaLink,
+// returning the events to upsert and the ids of the removed ones
+func (c *Calendar) fetchDelta(nextPage string) ([]*StoredEvent, []string, string, error) {
+	var order []string
+
+	changes := make(map[string]*StoredEvent)
+
+	for {
+		var page EventPage
+
+		// Delta queries on a calendar view take no $select, so every property
+		// comes along, but the pages can at least be made larger
+		body, err := c.getRemoteData(nextPage, fmt.Sprintf("odata.maxpagesize=%d", graphPageSize()))
+		if err == nil {
+			err = decodeGraphResponse(body, &page)
+		}
+
+		if err != nil {
+			var graphErr *GraphError
+			if errors.As(err, &graphErr) && (strings.EqualFold(graphErr.Code, "syncStateNotFound") || strings.EqualFold(graphErr.Code, "resyncRequired")) {
+				return nil, nil, "", errResyncRequired
+			}
+
+			return nil, nil, "", fmt.Errorf("delta query failed: %w", err)
+		}
+
+		for _, e := range page.Value {
+			if e == nil {
+				continue
+			}
+
+			if _, ok := changes[e.ID]; !ok {
+				order = append(order, e.ID)
+			}
+
+			// A nil entry marks the removed events
+			if e.Removed != nil {
+				changes[e.ID] = nil
+				continue
+			}
+
+			// Bodies come along anyway, but aren't kept for nothing
+			if !viper.GetBool("bodies") {
+				e.Body = nil
+			}
+
+			changes[e.ID] = &StoredEvent{
+				id:    e.ID,
+				start: e.startTime(),
+				end:   e.endTime(),
+				event: e,
+			}
+		}
+
+		if page.NextLink != "" {
+			nextPage = page.NextLink
+			continue
+		}
+
+		if page.DeltaLink == "" {
+			return nil, nil, "", errors.New("delta query returned neither a nextLink nor a deltaLink")
+		}
+
+		var upserts []*StoredEvent
+		var removed []string
+
+		for _, id := range order {
+			if event := changes[id]; event != nil {
+				upserts = append(upserts, event)
+			} else {
+				removed = append(removed, id)
+			}
+		}
+
+		return upserts, removed, page.DeltaLink, nil
+	}
+}
+
+// syncEvents brings the local event store of a calendar of the user up to
+// date, starting from scratch when there's no usable deltaLink for the
+// current range
+func (c *Calendar) syncEvents(calendar string) error {
+	c.syncMu.Lock()
+	defer c.syncMu.Unlock()
+
+	return c.syncEventsLocked(calendar)
+}
+
+// syncEventsLocked is syncEvents, for callers already holding syncMu
+func (c *Calendar) syncEventsLocked(calendar string) error {
+	start, end, err := getDeltaRange()
+	if err != nil {
+		return err
+	}
+
+	state, err := cachedData.getDeltaState(c.userName, calendar)
+	if err != nil {
+		return err
+	}
+
+	// The range of a delta query can't change, so it's synced again from
+	// scratch, with some slack ahead, once the window moves past its end
+	reset := !state.covers(start, end)
+	if reset {
+		end = end.Add(deltaRangeSlack)
+	} else {
+		start, end = state.start, state.end
+	}
+
+	nextPage := c.initialDeltaURL(calendar, start, end)
+	if !reset {
+		nextPage = state.deltaLink
+	}
+
+	upserts, removed, deltaLink, err := c.fetchDelta(nextPage)
+	if err == errResyncRequired && !reset {
+		reset = true
+		upserts, removed, deltaLink, err = c.fetchDelta(c.initialDeltaURL(calendar, start, end))
+	}
+
+	if isAccessLost(err) {
+		// What was synced is not kept around once the calendar is gone, or no
+		// longer shared with the user
+		log.Warn().
+			Err(err).
+			Str("user", c.userName).
+			Str("calendar", calendar).
+			Str("method", "syncEvents").
+			Msg("Lost access to calendar, dropping its events")
+
+		if err := cachedData.removeCalendar(c.userName, calendar); err != nil {
+			return err
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if reset || len(upserts) > 0 || len(removed) > 0 {
+		c.forgetSeriesMasters()
+
+		log.Info().
+			Str("user", c.userName).
+			Str("calendar", calendar).
+			Bool("reset", reset).
+			Int("updated", len(upserts)).
+			Int("removed", len(removed)).
+			Str("method", "syncEvents").
+			Msg("Synced events for user")
+	}
+
+	return cachedData.saveDelta(c.userName, calendar, &DeltaState{
+		deltaLink:  deltaLink,
+		start:      start,
+		end:        end,
+		lastSynced: time.Now(),
+	}, upserts, removed, reset)
+}
+
+// ensureSynced syncs the events of a calendar of the user if the last sync is
+// older than maxAge, or doesn't cover the current range. Stale data is
+// served if syncing fails.
+func (c *Calendar) ensureSynced(calendar string, maxAge time.Duration) (*DeltaState, error) {
+	start, end, err := getDeltaRange()
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := cachedData.getDeltaState(c.userName, calendar)
+	if err != nil {
+		return nil, err
+	}
+
+	if state.covers(start, end) && time.Since(state.lastSynced) < maxAge {
+		return state, nil
+	}
+
+	if err := c.syncEvents(calendar); err != nil {
+		// Once access is lost, what was synced is not served anymore either
+		if state == nil || isAuthError(err) || isAccessLost(err) {
+			return nil, err
+		}
+
+		log.Warn().
+			Err(err).
+			Str("user", c.userName).
+			Str("calendar", calendar).
+			Str("method", "syncEvents").
+			Msg("Serving previously synced events")
+
+		return state, nil
+	}
+
+	return cachedData.getDeltaState(c.userName, calendar)
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+	_ "time/tzdata"
+
+	ics "github.com/arran4/golang-ical"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	icalLocalFormat = "20060102T150405"
+
+	mailboxTimeZoneTTL = 24 * time.Hour
+)
+
+// resolveTimeZone accepts both Windows and IANA zone names, falling back to UTC
+func resolveTimeZone(name string) *time.Location {
+	if name == "" || name == "UTC" || name == "tzone://Microsoft/Utc" {
+		return time.UTC
+	}
+
+	if iana, ok := windowsZones[name]; ok {
+		name = iana
+	}
+
+	if name == "Etc/UTC" {
+		return time.UTC
+	}
+
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		log.Warn().
+			Err(err).
+			Str("zone", name).
+			Msg("Unknown time zone, using UTC")
+
+		return time.UTC
+	}
+
+	return loc
+}
+
+// formatICalTime returns the iCal value of t and its parameters, qualified by
+// TZID unless t is in UTC
+func formatICalTime(t time.Time, allDay bool) (string, []ics.PropertyParameter) {
+	if allDay {
+		return t.Format(icalDateFormat), []ics.PropertyParameter{ics.WithValue("DATE")}
+	}
+
+	if t.Location() == time.UTC || t.Location().String() == "UTC" {
+		return t.UTC().Format(icalUTCFormat), nil
+	}
+
+	return t.Format(icalLocalFormat), []ics.PropertyParameter{
+		&ics.KeyValues{Key: string(ics.ParameterTzid), Value: []string{t.Location().String()}},
+	}
+}
+
+func setEventTime(event *ics.VEvent, property ics.ComponentProperty, t time.Time, allDay bool) {
+	value, props := formatICalTime(t, allDay)
+	event.SetProperty(property, value, props...)
+}
+
+func formatOffset(offset int) string {
+	sign := "+"
+	if offset < 0 {
+		sign = "-"
+		offset = -offset
+	}
+
+	return fmt.Sprintf("%s%02d%02d", sign, offset/3600, (offset%3600)/60)
+}
+
+func newObservance(onset time.Time, offsetFrom int, after time.Time) ics.Component {
+	name, offsetTo := after.Zone()
+
+	base := ics.ComponentBase{}
+	base.Properties = []ics.IANAProperty{
+		{BaseProperty: ics.BaseProperty{IANAToken: string(ics.PropertyDtstart), Value: onset.UTC().Add(time.Duration(offsetFrom) * time.Second).Format(icalLocalFormat)}},
+		{BaseProperty: ics.BaseProperty{IANAToken: string(ics.PropertyTzoffsetfrom), Value: formatOffset(offsetFrom)}},
+		{BaseProperty: ics.BaseProperty{IANAToken: string(ics.PropertyTzoffsetto), Value: formatOffset(offsetTo)}},
+		{BaseProperty: ics.BaseProperty{IANAToken: string(ics.PropertyTzname), Value: name}},
+	}
+
+	if after.IsDST() {
+		return &ics.Daylight{ComponentBase: base}
+	}
+
+	return &ics.Standard{ComponentBase: base}
+}
+
+// findTransition narrows down, to the second, the instant between from and to
+// where the UTC offset changes
+func findTransition(from time.Time, to time.Time) time.Time {
+	_, offset := from.Zone()
+
+	for to.Sub(from) > time.Second {
+		mid := from.Add(to.Sub(from) / 2)
+		if _, o := mid.Zone(); o == offset {
+			from = mid
+		} else {
+			to = mid
+		}
+	}
+
+	return to
+}
+
+// newVTimezone describes loc between from and to, with one observance per
+// offset transition found by walking the Go time zone database
+func newVTimezone(loc *time.Location, from time.Time, to time.Time) *ics.VTimezone {
+	tz := &ics.VTimezone{}
+	tz.Properties = []ics.IANAProperty{
+		{BaseProperty: ics.BaseProperty{IANAToken: string(ics.PropertyTzid), Value: loc.String()}},
+	}
+
+	t := from.In(loc)
+	_, offset := t.Zone()
+	tz.Components = append(tz.Components, newObservance(t, offset, t))
+
+	for t.Before(to) {
+		next := t.Add(24 * time.Hour)
+
+		if _, o := next.Zone(); o != offset {
+			transition := findTransition(t, next)
+			tz.Components = append(tz.Components, newObservance(transition, offset, transition))
+			offset = o
+		}
+
+		t = next
+	}
+
+	return tz
+}
+
+// addTimezones prepends a VTIMEZONE for every TZID referenced by the events
+func addTimezones(cal *ics.Calendar) {
+	var tzids []string
+
+	years := make(map[string][2]int)
+
+	for _, event := range cal.Events() {
+		for _, p := range event.Properties {
+			tzid, ok := p.ICalParameters[string(ics.ParameterTzid)]
+			if !ok || len(tzid) == 0 || len(p.Value) < 4 {
+				continue
+			}
+
+			year, err := strconv.Atoi(p.Value[:4])
+			if err != nil {
+				continue
+			}
+
+			span, ok := years[tzid[0]]
+			if !ok {
+				tzids = append(tzids, tzid[0])
+				span = [2]int{year, year}
+			}
+
+			if year < span[0] {
+				span[0] = year
+			}
+
+			if year > span[1] {
+				span[1] = year
+			}
+
+			years[tzid[0]] = span
+		}
+	}
+
+	sort.Strings(tzids)
+
+	var timezones []ics.Component
+	for _, tzid := range tzids {
+		loc, err := time.LoadLocation(tzid)
+		if err != nil {
+			continue
+		}
+
+		// Recurring events may expand further than the events themselves
+		last := years[tzid][1]
+		if now := time.Now().Year() + 5; now > last {
+			last = now
+		}
+
+		from := time.Date(years[tzid][0], time.January, 1, 0, 0, 0, 0, loc)
+		to := time.Date(last+1, time.January, 1, 0, 0, 0, 0, loc)
+
+		timezones = append(timezones, newVTimezone(loc, from, to))
+	}
+
+	cal.Components = append(timezones, cal.Components...)
+}
+
+// getTimeZone returns the mailbox time zone of the user, as configured on
+// Outlook, refreshing it once a day
+func (c *Calendar) getTimeZone() *time.Location {
+	c.tzMu.Lock()
+	location, updated := c.location, c.locationUpdated
+	c.tzMu.Unlock()
+
+	if location != nil && time.Since(updated) < mailboxTimeZoneTTL {
+		return location
+	}
+
+	var settings MailboxTimeZone
+
+	body, err := c.getRemoteData(c.mailboxPath("") + "/mailboxSettings/timeZone")
+	if err == nil {
+		err = decodeGraphResponse(body, &settings)
+	}
+
+	c.tzMu.Lock()
+	defer c.tzMu.Unlock()
+
+	name := settings.Value
+	if err != nil || name == "" {
+		log.Warn().
+			Err(err).
+			Str("user", c.userName).
+			Str("method", "getTimeZone").
+			Msg("Unable to retrieve the mailbox time zone")
+
+		if c.location == nil {
+			c.location = time.UTC
+		}
+
+		c.locationUpdated = time.Now()
+
+		return c.location
+	}
+
+	c.mailboxTimeZone = name
+	c.location = resolveTimeZone(name)
+	c.locationUpdated = time.Now()
+
+	return c.location
+}
+
+// timeZoneName returns the name of the mailbox time zone, once known
+func (c *Calendar) timeZoneName() string {
+	c.tzMu.Lock()
+	defer c.tzMu.Unlock()
+
+	return c.mailboxTimeZone
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	ics "github.com/arran4/golang-ical"
+)
+
+type observance struct {
+	daylight   bool
+	dtstart    string
+	offsetFrom string
+	offsetTo   string
+	name       string
+}
+
+func observances(t *testing.T, tz *ics.VTimezone) []observance {
+	var found []observance
+
+	for _, c := range tz.Components {
+		var o observance
+		var base ics.ComponentBase
+
+		switch c := c.(type) {
+		case *ics.Standard:
+			base = c.ComponentBase
+		case *ics.Daylight:
+			base = c.ComponentBase
+			o.daylight = true
+		default:
+			t.Fatalf("unexpected component %T", c)
+		}
+
+		for _, p := range base.Properties {
+			switch ics.ComponentProperty(p.IANAToken) {
+			case ics.ComponentPropertyDtStart:
+				o.dtstart = p.Value
+			case ics.ComponentProperty(ics.PropertyTzoffsetfrom):
+				o.offsetFrom = p.Value
+			case ics.ComponentProperty(ics.PropertyTzoffsetto):
+				o.offsetTo = p.Value
+			case ics.ComponentProperty(ics.PropertyTzname):
+				o.name = p.Value
+			case ics.ComponentPropertyRrule:
+				// Every transition is listed on its own, so past changes to
+				// the rules of the zone hold
+				t.Errorf("observance with RRULE %s", p.Value)
+			}
+		}
+
+		found = append(found, o)
+	}
+
+	return found
+}
+
+func TestVTimezoneDST(t *testing.T) {
+	lisbon, err := time.LoadLocation("Europe/Lisbon")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tz := newVTimezone(lisbon, time.Date(2022, 1, 1, 0, 0, 0, 0, lisbon), time.Date(2023, 1, 1, 0, 0, 0, 0, lisbon))
+
+	if len(tz.Properties) != 1 || tz.Properties[0].Value != "Europe/Lisbon" {
+		t.Errorf("got %+v", tz.Properties)
+	}
+
+	want := []observance{
+		{daylight: false, dtstart: "20220101T000000", offsetFrom: "+0000", offsetTo: "+0000", name: "WET"},
+		{daylight: true, dtstart: "20220327T010000", offsetFrom: "+0000", offsetTo: "+0100", name: "WEST"},
+		{daylight: false, dtstart: "20221030T020000", offsetFrom: "+0100", offsetTo: "+0000", name: "WET"},
+	}
+
+	got := observances(t, tz)
+	if len(got) != len(want) {
+		t.Fatalf("got %+v", got)
+	}
+
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("observance %d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestVTimezoneNoDST(t *testing.T) {
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tz := newVTimezone(tokyo, time.Date(2022, 1, 1, 0, 0, 0, 0, tokyo), time.Date(2024, 1, 1, 0, 0, 0, 0, tokyo))
+
+	got := observances(t, tz)
+	want := observance{daylight: false, dtstart: "20220101T000000", offsetFrom: "+0900", offsetTo: "+0900", name: "JST"}
+
+	if len(got) != 1 || got[0] != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestFindTransition(t *testing.T) {
+	lisbon, err := time.LoadLocation("Europe/Lisbon")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	from := time.Date(2022, 3, 26, 12, 0, 0, 0, lisbon)
+
+	// Down to the second, the offset having changed already
+	want := time.Date(2022, 3, 27, 1, 0, 0, 0, time.UTC)
+	if got := findTransition(from, from.Add(24*time.Hour)); got.Before(want) || got.Sub(want) >= time.Second {
+		t.Errorf("got %v, want %v", got.UTC(), want)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+	"golang.org/x/oauth2"
+)
+
+var errNoTokenKey = errors.New("token_key is not configured")
+
+type StoredUser struct {
+	token        string
+	oauthToken   *oauth2.Token
+	publicClient bool
+
+	// lastUpdated is when the user last logged in or fetched their feed
+	lastUpdated time.Time
+}
+
+// persistingTokenSource wraps the oauth2 token source of a Calendar and writes
+// the token back to the database every time it gets refreshed
+type persistingTokenSource struct {
+	mu   sync.Mutex
+	src  oauth2.TokenSource
+	cal  *Calendar
+	last *oauth2.Token
+}
+
+func tokenCipher() (cipher.AEAD, error) {
+	key := viper.GetString("token_key")
+	if key == "" {
+		return nil, errNoTokenKey
+	}
+
+	sum := sha256.Sum256([]byte(key))
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func encryptToken(tok *oauth2.Token) (string, error) {
+	aead, err := tokenCipher()
+	if err != nil {
+		return "", err
+	}
+
+	plain, err := json.Marshal(tok)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	sealed := aead.Seal(nonce, nonce, plain, nil)
+
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func decryptToken(data string) (*oauth2.Token, error) {
+	var tok oauth2.Token
+
+	aead, err := tokenCipher()
+	if err != nil {
+		return nil, err
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("encrypted token is too short")
+	}
+
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(plain, &tok); err != nil {
+		return nil, err
+	}
+
+	return &tok, nil
+}
+
+func (ts *persistingTokenSource) Token() (*oauth2.Token, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	tok, err := ts.src.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	if ts.last != nil && ts.last.AccessToken == tok.AccessToken {
+		return tok, nil
+	}
+
+	ts.last = tok
+
+	if ts.cal.userName != "" {
+		if err := cachedData.updateOAuthToken(ts.cal.userName, tok); err != nil {
+			log.Error().
+				Err(err).
+				Str("user", ts.cal.userName).
+				Str("method", "updateOAuthToken").
+				Send()
+		}
+	}
+
+	return tok, nil
+}
@@ -1,16 +1,19 @@
 package main
 
 import (
+	"fmt"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/spf13/viper"
 	"golang.org/x/net/html"
 )
 
-func parseTeamsLink(body string, onlineMeeting interface{}) string {
-	if onlineMeeting != nil {
-		return onlineMeeting.(map[string]interface{})["joinUrl"].(string)
+func parseTeamsLink(body string, joinURL string) string {
+	if joinURL != "" {
+		return joinURL
 	}
 
 	re := regexp.MustCompile(`(http|https):\/\/(teams\.microsoft\.com)([\w.,@?^=%&:/~+#-]*[\w@?^=%&/~+#-])?`)
@@ -61,39 +64,78 @@ func html2text(body string) (string, error) {
 	return "", nil
 }
 
-func getStartEndWeekDays() (time.Time, time.Time) {
-	var start, end time.Time
+// getWeekStart returns the configured first day of the week, Monday unless
+// week_start says otherwise
+func getWeekStart() time.Weekday {
+	if day, ok := weekdays[strings.ToLower(viper.GetString("week_start"))]; ok {
+		return day
+	}
+
+	return time.Monday
+}
 
+// getCurrentWeek returns the seven days of the current week
+func getCurrentWeek() (time.Time, time.Time) {
 	now := time.Now()
 	t := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
 
-	switch t.Weekday() {
-	case time.Saturday:
-		start = t.Add(time.Hour * 24 * 2)
-	case time.Sunday:
-		start = t.Add(time.Hour * 24)
-	case time.Monday:
-		start = t
-	default:
-		start = t
-		for {
-			start = start.Add(time.Hour * 24 * -1)
-			if start.Weekday() == time.Monday {
-				break
-			}
-		}
+	start := startOfWeek(t, getWeekStart())
+
+	return start, start.AddDate(0, 0, 7)
+}
+
+// parseDays parses an amount of days ("14d") or weeks ("2w")
+func parseDays(s string) (int, error) {
+	if len(s) < 2 {
+		return 0, fmt.Errorf("invalid range %q, use days (14d) or weeks (2w)", s)
+	}
+
+	n, err := strconv.Atoi(s[:len(s)-1])
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid range %q, use days (14d) or weeks (2w)", s)
+	}
+
+	switch s[len(s)-1] {
+	case 'd':
+		return n, nil
+	case 'w':
+		return n * 7, nil
 	}
 
-	end = start.Add(time.Hour * 24 * 5)
+	return 0, fmt.Errorf("invalid range %q, use days (14d) or weeks (2w)", s)
+}
+
+// getWindowDays returns the days configured under key, unless overridden by
+// value, capped to sync_window.max
+func getWindowDays(value string, key string) (int, error) {
+	if value == "" {
+		value = viper.GetString(key)
+	}
+
+	days, err := parseDays(value)
+	if err != nil {
+		return 0, err
+	}
+
+	max, err := parseDays(viper.GetString("sync_window.max"))
+	if err != nil {
+		return 0, err
+	}
+
+	if days > max {
+		days = max
+	}
 
-	return start, end
+	return days, nil
 }
 
-func getMonthAfterStartEndWeekDays() (time.Time, time.Time) {
-	start, end := getStartEndWeekDays()
+// getSyncWindow returns the range covered by a feed, going past and future
+// days away from the start of the current week, rounded up to whole weeks
+func getSyncWindow(past int, future int) (time.Time, time.Time) {
+	start, _ := getCurrentWeek()
 
-	start = start.Add(time.Hour * 24 * 7)
-	end = start.Add(time.Hour * 24 * 7 * 3)
+	pastWeeks := (past + 6) / 7
+	futureWeeks := (future + 6) / 7
 
-	return start, end
+	return start.AddDate(0, 0, -7*pastWeeks), start.AddDate(0, 0, 7*futureWeeks)
 }
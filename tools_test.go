@@ -0,0 +1,165 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func setSyncWindow(t *testing.T, past string, future string, max string) {
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+
+	viper.Set("sync_window.past", past)
+	viper.Set("sync_window.future", future)
+	viper.Set("sync_window.max", max)
+}
+
+func TestParseDays(t *testing.T) {
+	tests := []struct {
+		value string
+		days  int
+		ok    bool
+	}{
+		{"0d", 0, true},
+		{"14d", 14, true},
+		{"2w", 14, true},
+		{"52w", 364, true},
+		{"", 0, false},
+		{"d", 0, false},
+		{"14", 0, false},
+		{"2m", 0, false},
+		{"-1d", 0, false},
+	}
+
+	for _, tt := range tests {
+		days, err := parseDays(tt.value)
+		if (err == nil) != tt.ok || days != tt.days {
+			t.Errorf("%q: got %d, %v", tt.value, days, err)
+		}
+	}
+}
+
+func TestFeedWindow(t *testing.T) {
+	tests := []struct {
+		name   string
+		past   string
+		future string
+		max    string
+		params string
+		want   [2]int
+		ok     bool
+	}{
+		{name: "configured", past: "1w", future: "4w", max: "365d", want: [2]int{7, 28}, ok: true},
+		{name: "overridden", past: "0d", future: "4w", max: "365d", params: "past=2w&future=10d", want: [2]int{14, 10}, ok: true},
+		{name: "override clamped", past: "0d", future: "4w", max: "8w", params: "past=100w&future=400d", want: [2]int{56, 56}, ok: true},
+		{name: "configuration clamped", past: "10w", future: "10w", max: "2w", want: [2]int{14, 14}, ok: true},
+		{name: "invalid override", past: "0d", future: "4w", max: "365d", params: "future=1y"},
+		{name: "invalid max", past: "0d", future: "4w", max: "forever"},
+	}
+
+	for _, tt := range tests {
+		setSyncWindow(t, tt.past, tt.future, tt.max)
+
+		params, err := url.ParseQuery(tt.params)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		opts, err := parseFeedOptions("http://localhost:5000", params)
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("%s: no error", tt.name)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+
+		if got := [2]int{opts.past, opts.future}; got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSyncWindow(t *testing.T) {
+	setSyncWindow(t, "0d", "4w", "365d")
+
+	weekStart, weekEnd := getCurrentWeek()
+
+	tests := []struct {
+		past   int
+		future int
+		weeks  [2]int
+	}{
+		{0, 0, [2]int{0, 0}},
+		{0, 28, [2]int{0, 4}},
+		{1, 1, [2]int{1, 1}},
+		{7, 8, [2]int{1, 2}},
+		{365, 365, [2]int{53, 53}},
+	}
+
+	for _, tt := range tests {
+		start, end := getSyncWindow(tt.past, tt.future)
+
+		// Whole weeks away from the start of the current one
+		if want := weekStart.AddDate(0, 0, -7*tt.weeks[0]); !start.Equal(want) {
+			t.Errorf("%d days past: starts %v, want %v", tt.past, start, want)
+		}
+
+		if want := weekStart.AddDate(0, 0, 7*tt.weeks[1]); !end.Equal(want) {
+			t.Errorf("%d days ahead: ends %v, want %v", tt.future, end, want)
+		}
+	}
+
+	if weekEnd.Sub(weekStart).Hours() != 7*24 || weekStart.Weekday() != getWeekStart() {
+		t.Errorf("current week from %v to %v", weekStart, weekEnd)
+	}
+
+	// The store covers the widest window a feed can ask for
+	start, end, err := getDeltaRange()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if wantStart, wantEnd := getSyncWindow(365, 365); !start.Equal(wantStart) || !end.Equal(wantEnd) {
+		t.Errorf("store covers %v to %v", start, end)
+	}
+}
+
+func TestWeekStart(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Weekday
+	}{
+		{"", time.Monday},
+		{"monday", time.Monday},
+		{"sunday", time.Sunday},
+		{"Saturday", time.Saturday},
+		{"someday", time.Monday},
+	}
+
+	t.Cleanup(viper.Reset)
+
+	for _, tt := range tests {
+		viper.Reset()
+		viper.Set("week_start", tt.value)
+
+		start, end := getCurrentWeek()
+		today := dateOnly(time.Now())
+
+		if got := getWeekStart(); got != tt.want || start.Weekday() != tt.want {
+			t.Errorf("%q: week starts on %v, %v", tt.value, got, start.Weekday())
+		}
+
+		if today.Before(start) || !today.Before(end) {
+			t.Errorf("%q: current week from %v to %v", tt.value, start, end)
+		}
+	}
+}
@@ -1,9 +1,12 @@
 package main
 
 import (
-	"math/rand"
+	"errors"
 	"net/http"
 	"net/url"
+	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/labstack/echo/v4"
@@ -12,29 +15,214 @@ import (
 )
 
 const (
-	cookieName = "o365toical"
+	cookieName      = "o365toical"
+	defaultCalendar = "default"
 )
 
-func randomString(n int) string {
-	var letters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
+// sessionCookie is the cookie of a browser session, out of reach of scripts
+// and other sites, and only sent over HTTPS
+func sessionCookie(value string) *http.Cookie {
+	return &http.Cookie{
+		Name:     cookieName,
+		Value:    value,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
 
-	s := make([]rune, n)
-	for i := range s {
-		s[i] = letters[rand.Intn(len(letters))]
+// newSessionCookie mints the cookie of a new browser session, whose value
+// becomes the feed token of the user logging in with it
+func newSessionCookie() (*http.Cookie, error) {
+	token, err := secureRandomString(45)
+	if err != nil {
+		return nil, err
 	}
 
-	return string(s)
+	return sessionCookie(token), nil
 }
 
-func web() {
+// parseCalendars reads the comma separated calendar ids of a feed, where
+// "default" stands for the default calendar, also used when none is given.
+// Colons are kept for naming the calendars of other mailboxes.
+func parseCalendars(param string) ([]string, error) {
+	var calendars []string
+
+	seen := make(map[string]bool)
+	for _, id := range strings.Split(param, ",") {
+		id = strings.TrimSpace(id)
+		if id == defaultCalendar {
+			id = ""
+		}
+
+		if strings.Contains(id, ":") {
+			return nil, errors.New("invalid calendar " + id)
+		}
+
+		if !seen[id] {
+			seen[id] = true
+			calendars = append(calendars, id)
+		}
+	}
+
+	return calendars, nil
+}
+
+// parseMailbox reads the mailbox sharing its calendars with the user, if any,
+// by user id or email address
+func parseMailbox(param string) (string, error) {
+	mailbox := strings.TrimSpace(param)
+	if strings.ContainsAny(mailbox, ":/") {
+		return "", errors.New("invalid mailbox " + mailbox)
+	}
+
+	return mailbox, nil
+}
+
+// accessLostResponse is the answer to requests for calendars Graph denies
+// access to, or can't find
+func accessLostResponse(err error) (int, string) {
+	var graphErr *GraphError
+	if errors.As(err, &graphErr) && graphErr.StatusCode == http.StatusForbidden {
+		return http.StatusForbidden, "No access to the calendar, it may no longer be shared with you"
+	}
+
+	return http.StatusNotFound, "Unknown calendar or mailbox"
+}
+
+// parseFeedOptions reads the options of a feed from the parameters of its URL,
+// or the ones stored with a named feed
+func parseFeedOptions(baseHost string, params url.Values) (*FeedOptions, error) {
+	var err error
+
+	opts := &FeedOptions{
+		baseHost:  baseHost,
+		full:      params.Get("full") == "true",
+		google:    params.Get("google") == "true",
+		recurring: params.Get("recurring") == "true",
+		weekends:  viper.GetBool("weekends"),
+		bodies:    viper.GetBool("bodies"),
+		titles:    params.Get("titles") != "false",
+	}
+
+	if weekends := params.Get("weekends"); weekends != "" {
+		opts.weekends = weekends == "true"
+	}
+
+	// Bodies aren't stored unless configured, so feeds can only leave them out
+	if params.Get("bodies") == "false" {
+		opts.bodies = false
+	}
+
+	// Without titles, nothing else about the events is shown either
+	if !opts.titles {
+		opts.bodies = false
+	}
+
+	opts.mailbox, err = parseMailbox(params.Get("mailbox"))
+	if err != nil {
+		return nil, err
+	}
+
+	calendars, err := parseCalendars(params.Get("calendars"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, calendar := range calendars {
+		opts.calendars = append(opts.calendars, mailboxCalendar(opts.mailbox, calendar))
+	}
+
+	opts.past, err = getWindowDays(params.Get("past"), "sync_window.past")
+	if err != nil {
+		return nil, err
+	}
+
+	opts.future, err = getWindowDays(params.Get("future"), "sync_window.future")
+	if err != nil {
+		return nil, err
+	}
+
+	return opts, nil
+}
+
+// namesSharedMailbox tells whether the parameters of a feed name another
+// mailbox, by mailbox or as the prefix of a calendar id
+func namesSharedMailbox(params url.Values) bool {
+	return strings.TrimSpace(params.Get("mailbox")) != "" || strings.Contains(params.Get("calendars"), ":")
+}
+
+// readsSharedMailbox tells whether any calendar of the feed belongs to another
+// mailbox, as synced, whatever parameter it came from
+func (o *FeedOptions) readsSharedMailbox() bool {
+	if o.mailbox != "" {
+		return true
+	}
+
+	for _, calendar := range o.calendars {
+		if mailbox, _ := splitCalendar(calendar); mailbox != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// interactiveLogin keeps users from logging in when app_only is enabled, the
+// feeds being provisioned by the administrator instead
+func interactiveLogin(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if appOnly() {
+			log.Info().
+				Str("src_ip", c.RealIP()).
+				Str("method", c.Request().Method).
+				Str("path", c.Path()).
+				Int("status", http.StatusForbidden).
+				Msg("Logging in is disabled in app_only mode")
+
+			return c.String(http.StatusForbidden, "Feeds are provisioned by the administrator")
+		}
+
+		return next(c)
+	}
+}
+
+func newServer() *echo.Echo {
 	e := echo.New()
 
+	// Attachments are the only files served, and attachments_dir may be absolute
+	e.Filesystem = os.DirFS(viper.GetString("attachments_dir"))
+
 	e.GET("/", func(c echo.Context) error {
 		start := time.Now()
 
 		cookie, err := c.Cookie(cookieName)
 		if err == nil {
-			if _, ok := loggedUsers[cookie.Value]; ok {
+			if cal := sessions.get(cookie.Value); cal != nil && !cal.isValid() {
+				authURL, err := cal.getURL()
+				if err != nil {
+					log.Error().
+						Err(err).
+						Str("src_ip", c.RealIP()).
+						Str("method", c.Request().Method).
+						Str("path", c.Path()).
+						Dur("duration", time.Since(start)).
+						Int("status", http.StatusInternalServerError).
+						Send()
+
+					return err
+				}
+
+				log.Info().
+					Str("src_ip", c.RealIP()).
+					Str("method", c.Request().Method).
+					Str("path", c.Path()).
+					Int("status", http.StatusTemporaryRedirect).
+					Dur("duration", time.Since(start)).
+					Msg("Session needs to log in again")
+
+				return c.Redirect(http.StatusTemporaryRedirect, authURL)
+			} else if cal != nil {
 				log.Info().
 					Str("src_ip", c.RealIP()).
 					Str("method", c.Request().Method).
@@ -47,28 +235,7 @@ func web() {
 			}
 		}
 
-		cookie = new(http.Cookie)
-		cookie.Name = cookieName
-		cookie.Value = randomString(60)
-		c.SetCookie(cookie)
-
-		loggedUsers[cookie.Value] = newCalendarHandler()
-
-		log.Info().
-			Str("src_ip", c.RealIP()).
-			Str("method", c.Request().Method).
-			Str("path", c.Path()).
-			Int("status", http.StatusTemporaryRedirect).
-			Dur("duration", time.Since(start)).
-			Msg("New session created")
-
-		return c.Redirect(http.StatusTemporaryRedirect, loggedUsers[cookie.Value].getURL())
-	})
-
-	e.GET("/token", func(c echo.Context) error {
-		start := time.Now()
-
-		cookie, err := c.Cookie(cookieName)
+		cookie, err = newSessionCookie()
 		if err != nil {
 			log.Error().
 				Err(err).
@@ -82,10 +249,12 @@ func web() {
 			return err
 		}
 
-		code := c.QueryParam("code")
+		c.SetCookie(cookie)
 
-		cal := loggedUsers[cookie.Value]
-		cookieToken, err := cal.handleToken(code, cookie.Value)
+		cal := newCalendarHandler()
+		sessions.add(cookie.Value, cal)
+
+		authURL, err := cal.getURL()
 		if err != nil {
 			log.Error().
 				Err(err).
@@ -99,41 +268,84 @@ func web() {
 			return err
 		}
 
-		if cookieToken != "" && cookieToken != cookie.Value {
-			cookie.Value = cookieToken
-			c.SetCookie(cookie)
-		}
-
 		log.Info().
 			Str("src_ip", c.RealIP()).
 			Str("method", c.Request().Method).
 			Str("path", c.Path()).
 			Int("status", http.StatusTemporaryRedirect).
 			Dur("duration", time.Since(start)).
-			Msg("New token stored")
+			Msg("New session created")
 
-		return c.Redirect(http.StatusTemporaryRedirect, "/success")
-	})
+		return c.Redirect(http.StatusTemporaryRedirect, authURL)
+	}, interactiveLogin)
 
-	e.GET("/success", func(c echo.Context) error {
+	e.GET("/token", func(c echo.Context) error {
 		start := time.Now()
 
+		restart := "\n\nStart again at https://" + c.Request().Host + "/"
+
+		// Azure AD sends the user back with an error when the login was
+		// cancelled or refused
+		if reason := c.QueryParam("error"); reason != "" {
+			log.Warn().
+				Str("error", reason).
+				Str("src_ip", c.RealIP()).
+				Str("method", c.Request().Method).
+				Str("path", c.Path()).
+				Dur("duration", time.Since(start)).
+				Int("status", http.StatusBadRequest).
+				Msg("Login refused")
+
+			return c.String(http.StatusBadRequest, "Login failed: "+c.QueryParam("error_description")+restart)
+		}
+
+		var cal *Calendar
+
 		cookie, err := c.Cookie(cookieName)
-		if err != nil {
-			log.Error().
+		if err == nil {
+			cal = sessions.get(cookie.Value)
+		}
+
+		if cal == nil {
+			log.Warn().
+				Str("src_ip", c.RealIP()).
+				Str("method", c.Request().Method).
+				Str("path", c.Path()).
+				Dur("duration", time.Since(start)).
+				Int("status", http.StatusBadRequest).
+				Msg("Login redirect without a session")
+
+			return c.String(http.StatusBadRequest, "This login wasn't started from this browser"+restart)
+		}
+
+		code := c.QueryParam("code")
+
+		cookieToken, err := cal.handleToken(code, c.QueryParam("state"), cookie.Value)
+		if err == errInvalidState {
+			log.Warn().
 				Err(err).
 				Str("src_ip", c.RealIP()).
 				Str("method", c.Request().Method).
 				Str("path", c.Path()).
 				Dur("duration", time.Since(start)).
-				Int("status", http.StatusInternalServerError).
+				Int("status", http.StatusBadRequest).
 				Send()
 
-			return err
-		}
+			return c.String(http.StatusBadRequest, "This login couldn't be verified, it may have been started elsewhere or already completed"+restart)
+		} else if isAuthError(err) {
+			// Codes are rejected when redeemed twice, or without the code
+			// verifier of the login they were issued to
+			log.Warn().
+				Err(err).
+				Str("src_ip", c.RealIP()).
+				Str("method", c.Request().Method).
+				Str("path", c.Path()).
+				Dur("duration", time.Since(start)).
+				Int("status", http.StatusBadRequest).
+				Send()
 
-		err = cachedData.storeToken(loggedUsers[cookie.Value].userName, cookie.Value)
-		if err != nil {
+			return c.String(http.StatusBadRequest, "Microsoft didn't accept this login"+restart)
+		} else if err != nil {
 			log.Error().
 				Err(err).
 				Str("src_ip", c.RealIP()).
@@ -146,84 +358,114 @@ func web() {
 			return err
 		}
 
+		if cookieToken != "" && cookieToken != cookie.Value {
+			c.SetCookie(sessionCookie(cookieToken))
+		}
+
 		log.Info().
 			Str("src_ip", c.RealIP()).
 			Str("method", c.Request().Method).
 			Str("path", c.Path()).
-			Int("status", http.StatusOK).
+			Int("status", http.StatusTemporaryRedirect).
 			Dur("duration", time.Since(start)).
-			Send()
+			Msg("New token stored")
 
-		url := "https://" + c.Request().Host + "/calendar?token=" + cookie.Value
+		return c.Redirect(http.StatusTemporaryRedirect, "/success")
+	}, interactiveLogin)
 
-		output := `For regular devices:
-` + url + `
-` + url + `&full=true    # Includes tentatives and marked as 'Free' on the calendar
+	// Logs in with a device code, for when the browser can't reach
+	// redirect_url. The page reloads itself until the code is entered.
+	e.GET("/device", func(c echo.Context) error {
+		start := time.Now()
 
-For Google Calendar:
-` + url + `&google=true
-` + url + `&google=true&full=true    # Includes tentatives and marked as 'Free' on the calendar`
+		var cal *Calendar
 
-		return c.String(http.StatusOK, output)
-	})
+		cookie, err := c.Cookie(cookieName)
+		if err == nil {
+			cal = sessions.get(cookie.Value)
+		}
 
-	e.GET("/calendar", func(c echo.Context) error {
-		start := time.Now()
+		if cal != nil && cal.isValid() {
+			log.Info().
+				Str("src_ip", c.RealIP()).
+				Str("method", c.Request().Method).
+				Str("path", c.Path()).
+				Int("status", http.StatusTemporaryRedirect).
+				Dur("duration", time.Since(start)).
+				Msg("Session already found")
 
-		token := c.QueryParam("token")
-		if len(token) == 0 {
-			cookie, err := c.Cookie(cookieName)
+			return c.Redirect(http.StatusTemporaryRedirect, "/")
+		}
+
+		if cal == nil {
+			cookie, err = newSessionCookie()
 			if err != nil {
 				log.Error().
+					Err(err).
 					Str("src_ip", c.RealIP()).
 					Str("method", c.Request().Method).
 					Str("path", c.Path()).
 					Dur("duration", time.Since(start)).
-					Int("status", http.StatusTemporaryRedirect).
-					Msg("No token nor cookie")
+					Int("status", http.StatusInternalServerError).
+					Send()
 
-				return c.Redirect(http.StatusTemporaryRedirect, "/")
-			} else {
-				token = cookie.Value
+				return err
 			}
-		}
 
-		full := false
-		if c.QueryParam("full") == "true" {
-			full = true
-		}
+			c.SetCookie(cookie)
 
-		google := false
-		if c.QueryParam("google") == "true" {
-			google = true
+			cal = newCalendarHandler()
+			sessions.add(cookie.Value, cal)
 		}
 
-		cal := loggedUsers[token]
-		if cal == nil {
+		code, err := cal.deviceCode()
+		if err != nil {
 			log.Error().
+				Err(err).
 				Str("src_ip", c.RealIP()).
 				Str("method", c.Request().Method).
 				Str("path", c.Path()).
 				Dur("duration", time.Since(start)).
-				Int("status", http.StatusTemporaryRedirect).
-				Msg("Unknown token")
+				Int("status", http.StatusBadGateway).
+				Send()
 
-			return c.Redirect(http.StatusTemporaryRedirect, "/")
+			return c.String(http.StatusBadGateway, "Unable to get a code from Microsoft, try again later")
 		}
 
-		baseHost := c.Request().Host
-		if body, err := cal.getCalendar(baseHost, full, google); err == nil {
+		tok, err := cal.pollDeviceLogin()
+		if err == errAuthorizationPending {
+			c.Response().Header().Set("Refresh", strconv.Itoa(int(cal.pollInterval().Seconds())))
+
 			log.Info().
 				Str("src_ip", c.RealIP()).
 				Str("method", c.Request().Method).
 				Str("path", c.Path()).
 				Int("status", http.StatusOK).
 				Dur("duration", time.Since(start)).
+				Msg("Waiting for the device code")
+
+			return c.String(http.StatusOK, "To log in, open "+code.VerificationURI+" on any device and enter the code "+code.UserCode+`
+
+This page reloads by itself until you do.`)
+		} else if err != nil {
+			log.Warn().
+				Err(err).
+				Str("src_ip", c.RealIP()).
+				Str("method", c.Request().Method).
+				Str("path", c.Path()).
+				Dur("duration", time.Since(start)).
+				Int("status", http.StatusUnauthorized).
 				Send()
 
-			c.Response().Header().Set(echo.HeaderContentType, "text/calendar")
-			return c.String(http.StatusOK, body)
-		} else {
+			return c.String(http.StatusUnauthorized, "Login failed: "+err.Error()+`
+
+Reload this page for a new code.`)
+		}
+
+		cal.usePublicClient()
+
+		cookieToken, err := cal.login(tok, cookie.Value)
+		if err != nil {
 			log.Error().
 				Err(err).
 				Str("src_ip", c.RealIP()).
@@ -233,28 +475,709 @@ For Google Calendar:
 				Int("status", http.StatusInternalServerError).
 				Send()
 
-			return c.String(http.StatusInternalServerError, err.Error())
+			return err
 		}
 
-	})
+		if cookieToken != "" && cookieToken != cookie.Value {
+			c.SetCookie(sessionCookie(cookieToken))
+		}
 
-	e.GET("/attachment/:attId/:fname", func(c echo.Context) error {
+		log.Info().
+			Str("src_ip", c.RealIP()).
+			Str("method", c.Request().Method).
+			Str("path", c.Path()).
+			Int("status", http.StatusTemporaryRedirect).
+			Dur("duration", time.Since(start)).
+			Msg("New token stored")
+
+		return c.Redirect(http.StatusTemporaryRedirect, "/success")
+	}, interactiveLogin)
+
+	e.GET("/success", func(c echo.Context) error {
 		start := time.Now()
 
-		attId, _ := url.QueryUnescape(c.Param("attId"))
-		fname, _ := url.QueryUnescape(c.Param("fname"))
+		cookie, err := c.Cookie(cookieName)
+		if err != nil {
+			log.Error().
+				Err(err).
+				Str("src_ip", c.RealIP()).
+				Str("method", c.Request().Method).
+				Str("path", c.Path()).
+				Dur("duration", time.Since(start)).
+				Int("status", http.StatusInternalServerError).
+				Send()
+
+			return err
+		}
+
+		if cal := sessions.get(cookie.Value); cal == nil || !cal.isValid() {
+			log.Info().
+				Str("src_ip", c.RealIP()).
+				Str("method", c.Request().Method).
+				Str("path", c.Path()).
+				Int("status", http.StatusTemporaryRedirect).
+				Dur("duration", time.Since(start)).
+				Msg("Session not logged in")
 
-		baseDir := viper.GetString("attachments_dir") + "/" + attId
+			return c.Redirect(http.StatusTemporaryRedirect, "/")
+		}
 
 		log.Info().
 			Str("src_ip", c.RealIP()).
 			Str("method", c.Request().Method).
 			Str("path", c.Path()).
+			Int("status", http.StatusOK).
 			Dur("duration", time.Since(start)).
 			Send()
 
-		return c.File(baseDir + "/" + fname)
-	})
+		url := "https://" + c.Request().Host + "/calendar?token=" + cookie.Value
+
+		output := `For regular devices:
+` + url + `
+` + url + `&full=true    # Includes tentatives and marked as 'Free' on the calendar
+` + url + `&recurring=true    # Recurring meetings as a single series instead of unrelated events
+` + url + `&past=14d&future=90d    # Range to include, relative to the start of the current week
+` + url + `&weekends=true    # Includes the events happening on Saturdays and Sundays
+` + url + `&bodies=false    # Leaves out descriptions and attachments, for when only the busy times matter
+
+For your other calendars, or several of them in a single feed:
+https://` + c.Request().Host + `/calendars?token=` + cookie.Value + `
 
+For feeds with their own options, which whoever has their URL can't change:
+https://` + c.Request().Host + `/feeds?token=` + cookie.Value + `
+
+For the calendars someone else shares with you, or delegated to you:
+https://` + c.Request().Host + `/calendars?token=` + cookie.Value + `&mailbox=someone@example.com
+
+For Google Calendar:
+` + url + `&google=true
+` + url + `&google=true&full=true    # Includes tentatives and marked as 'Free' on the calendar
+
+To stop the feed until you log in again, keeping its URL:
+curl -X POST -d token=` + cookie.Value + ` https://` + c.Request().Host + `/logout
+
+To get rid of the feed URL for good, if it leaked:
+curl -X POST -d token=` + cookie.Value + ` https://` + c.Request().Host + `/revoke    # Add -d attachments=true to delete the downloaded attachments too`
+
+		return c.String(http.StatusOK, output)
+	}, interactiveLogin)
+
+	// Logging out takes the feed token too, never the session cookie alone,
+	// so other sites can't log users out
+	e.POST("/logout", func(c echo.Context) error {
+		start := time.Now()
+
+		token := c.FormValue("token")
+		if token == "" || sessions.userOf(token) == "" {
+			log.Error().
+				Str("src_ip", c.RealIP()).
+				Str("method", c.Request().Method).
+				Str("path", c.Path()).
+				Dur("duration", time.Since(start)).
+				Int("status", http.StatusNotFound).
+				Msg("Unknown token")
+
+			return c.String(http.StatusNotFound, "Unknown feed")
+		}
+
+		if err := logout(token); err != nil {
+			log.Error().
+				Err(err).
+				Str("src_ip", c.RealIP()).
+				Str("method", c.Request().Method).
+				Str("path", c.Path()).
+				Dur("duration", time.Since(start)).
+				Int("status", http.StatusInternalServerError).
+				Send()
+
+			return err
+		}
+
+		if cookie, err := c.Cookie(cookieName); err == nil && cookie.Value == token {
+			expired := sessionCookie("")
+			expired.MaxAge = -1
+			c.SetCookie(expired)
+		}
+
+		log.Info().
+			Str("src_ip", c.RealIP()).
+			Str("method", c.Request().Method).
+			Str("path", c.Path()).
+			Int("status", http.StatusOK).
+			Dur("duration", time.Since(start)).
+			Send()
+
+		return c.String(http.StatusOK, `Logged out, your feed stops until you log in again on https://`+c.Request().Host+`/, which brings the same feed URL back.
+
+To get rid of the feed URL for good, revoke it instead.`)
+	}, interactiveLogin)
+
+	// Revoking takes the feed token, so a leaked feed URL is enough to kill
+	// it, but never the session cookie, which other sites' forms could make
+	// use of
+	e.POST("/revoke", func(c echo.Context) error {
+		start := time.Now()
+
+		token := c.FormValue("token")
+
+		// A named feed is revoked on its own
+		if feed := findFeedToken(token); feed != nil {
+			if err := removeFeedToken(token); err != nil {
+				log.Error().
+					Err(err).
+					Str("user", feed.user).
+					Str("src_ip", c.RealIP()).
+					Str("method", c.Request().Method).
+					Str("path", c.Path()).
+					Dur("duration", time.Since(start)).
+					Int("status", http.StatusInternalServerError).
+					Send()
+
+				return err
+			}
+
+			log.Info().
+				Str("user", feed.user).
+				Str("feed", feed.name).
+				Str("src_ip", c.RealIP()).
+				Str("method", c.Request().Method).
+				Str("path", c.Path()).
+				Int("status", http.StatusOK).
+				Dur("duration", time.Since(start)).
+				Msg("Named feed revoked")
+
+			return c.String(http.StatusOK, "Feed "+feed.name+" revoked")
+		}
+
+		user := sessions.userOf(token)
+
+		if token == "" || user == "" {
+			log.Error().
+				Str("src_ip", c.RealIP()).
+				Str("method", c.Request().Method).
+				Str("path", c.Path()).
+				Dur("duration", time.Since(start)).
+				Int("status", http.StatusNotFound).
+				Msg("Unknown token")
+
+			return c.String(http.StatusNotFound, "Unknown feed")
+		}
+
+		if err := revokeUser(user, c.FormValue("attachments") == "true"); err != nil {
+			log.Error().
+				Err(err).
+				Str("user", user).
+				Str("src_ip", c.RealIP()).
+				Str("method", c.Request().Method).
+				Str("path", c.Path()).
+				Dur("duration", time.Since(start)).
+				Int("status", http.StatusInternalServerError).
+				Send()
+
+			return err
+		}
+
+		if cookie, err := c.Cookie(cookieName); err == nil && cookie.Value == token {
+			expired := sessionCookie("")
+			expired.MaxAge = -1
+			c.SetCookie(expired)
+		}
+
+		log.Info().
+			Str("user", user).
+			Str("src_ip", c.RealIP()).
+			Str("method", c.Request().Method).
+			Str("path", c.Path()).
+			Int("status", http.StatusOK).
+			Dur("duration", time.Since(start)).
+			Send()
+
+		return c.String(http.StatusOK, "Feed revoked, logging in again gets you a new feed URL")
+	})
+
+	e.GET("/calendar", func(c echo.Context) error {
+		start := time.Now()
+
+		token := c.QueryParam("token")
+		if len(token) == 0 {
+			cookie, err := c.Cookie(cookieName)
+			if err != nil {
+				log.Error().
+					Str("src_ip", c.RealIP()).
+					Str("method", c.Request().Method).
+					Str("path", c.Path()).
+					Dur("duration", time.Since(start)).
+					Int("status", http.StatusTemporaryRedirect).
+					Msg("No token nor cookie")
+
+				return c.Redirect(http.StatusTemporaryRedirect, "/")
+			} else {
+				token = cookie.Value
+			}
+		}
+
+		params := c.QueryParams()
+
+		// Named feeds serve the options stored with them, whatever their URL
+		// says, from the session of their user
+		cal := sessions.get(token)
+		if cal == nil {
+			if feed := useFeedToken(token); feed != nil {
+				cal = sessions.userSession(feed.user)
+
+				stored, err := url.ParseQuery(feed.options)
+				if err != nil {
+					log.Error().
+						Err(err).
+						Str("user", feed.user).
+						Str("feed", feed.name).
+						Str("src_ip", c.RealIP()).
+						Str("method", c.Request().Method).
+						Str("path", c.Path()).
+						Dur("duration", time.Since(start)).
+						Int("status", http.StatusInternalServerError).
+						Msg("Unable to parse the options of the named feed")
+
+					return err
+				}
+
+				params = stored
+			}
+		}
+
+		// The app can read every mailbox, so feeds stick to their own, named
+		// in whatever way
+		if cal != nil && cal.appMailbox != "" && namesSharedMailbox(params) {
+			log.Error().
+				Str("src_ip", c.RealIP()).
+				Str("method", c.Request().Method).
+				Str("path", c.Path()).
+				Dur("duration", time.Since(start)).
+				Int("status", http.StatusForbidden).
+				Msg("Shared calendars requested on a provisioned feed")
+
+			return c.String(http.StatusForbidden, "Shared calendars are not available on provisioned feeds")
+		}
+
+		opts, err := parseFeedOptions(c.Request().Host, params)
+		if err != nil {
+			log.Error().
+				Err(err).
+				Str("src_ip", c.RealIP()).
+				Str("method", c.Request().Method).
+				Str("path", c.Path()).
+				Dur("duration", time.Since(start)).
+				Int("status", http.StatusBadRequest).
+				Send()
+
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+
+		if cal == nil {
+			log.Error().
+				Str("src_ip", c.RealIP()).
+				Str("method", c.Request().Method).
+				Str("path", c.Path()).
+				Dur("duration", time.Since(start)).
+				Int("status", http.StatusTemporaryRedirect).
+				Msg("Unknown token")
+
+			return c.Redirect(http.StatusTemporaryRedirect, "/")
+		}
+
+		if !cal.isValid() {
+			log.Error().
+				Str("src_ip", c.RealIP()).
+				Str("method", c.Request().Method).
+				Str("path", c.Path()).
+				Dur("duration", time.Since(start)).
+				Int("status", http.StatusUnauthorized).
+				Msg("Session needs to log in again")
+
+			return c.String(http.StatusUnauthorized, "Log in again at https://"+c.Request().Host+"/")
+		}
+
+		// Nor do the calendars they end up syncing
+		if cal.appMailbox != "" && opts.readsSharedMailbox() {
+			log.Error().
+				Str("src_ip", c.RealIP()).
+				Str("method", c.Request().Method).
+				Str("path", c.Path()).
+				Dur("duration", time.Since(start)).
+				Int("status", http.StatusForbidden).
+				Msg("Shared calendars requested on a provisioned feed")
+
+			return c.String(http.StatusForbidden, "Shared calendars are not available on provisioned feeds")
+		}
+
+		// Apps polling the same feed together get the same render
+		key := feedKey(token, opts)
+		body, err := renderedFeeds.get(key, cal.userName, viper.GetDuration("feed_cache_ttl"), func() (string, error) {
+			return cal.getCalendar(opts)
+		})
+
+		if err == nil {
+			cal.touch()
+
+			etag, modified := renderedFeeds.version(key, cal.userName, body)
+
+			c.Response().Header().Set(headerETag, etag)
+			c.Response().Header().Set(echo.HeaderLastModified, modified.Format(http.TimeFormat))
+			c.Response().Header().Add(echo.HeaderVary, echo.HeaderAcceptEncoding)
+
+			if notModified(c.Request(), etag, modified) {
+				log.Info().
+					Str("src_ip", c.RealIP()).
+					Str("method", c.Request().Method).
+					Str("path", c.Path()).
+					Int("status", http.StatusNotModified).
+					Dur("duration", time.Since(start)).
+					Send()
+
+				return c.NoContent(http.StatusNotModified)
+			}
+
+			log.Info().
+				Str("src_ip", c.RealIP()).
+				Str("method", c.Request().Method).
+				Str("path", c.Path()).
+				Int("status", http.StatusOK).
+				Dur("duration", time.Since(start)).
+				Send()
+
+			return compressed(c, http.StatusOK, "text/calendar", []byte(body))
+		} else if isAccessLost(err) {
+			status, message := accessLostResponse(err)
+
+			log.Error().
+				Err(err).
+				Str("src_ip", c.RealIP()).
+				Str("method", c.Request().Method).
+				Str("path", c.Path()).
+				Dur("duration", time.Since(start)).
+				Int("status", status).
+				Send()
+
+			return c.String(status, message)
+		} else if isAuthError(err) && cal.appMailbox != "" {
+			log.Error().
+				Err(err).
+				Str("src_ip", c.RealIP()).
+				Str("method", c.Request().Method).
+				Str("path", c.Path()).
+				Dur("duration", time.Since(start)).
+				Int("status", http.StatusBadGateway).
+				Msg("Credentials of the app rejected")
+
+			return c.String(http.StatusBadGateway, "Microsoft rejected the credentials of the service")
+		} else if isAuthError(err) {
+			log.Error().
+				Err(err).
+				Str("src_ip", c.RealIP()).
+				Str("method", c.Request().Method).
+				Str("path", c.Path()).
+				Dur("duration", time.Since(start)).
+				Int("status", http.StatusUnauthorized).
+				Send()
+
+			return c.String(http.StatusUnauthorized, "Log in again at https://"+c.Request().Host+"/")
+		} else {
+			log.Error().
+				Err(err).
+				Str("src_ip", c.RealIP()).
+				Str("method", c.Request().Method).
+				Str("path", c.Path()).
+				Dur("duration", time.Since(start)).
+				Int("status", http.StatusInternalServerError).
+				Send()
+
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+
+	})
+
+	e.GET("/calendars", func(c echo.Context) error {
+		start := time.Now()
+
+		token := c.QueryParam("token")
+		if len(token) == 0 {
+			if cookie, err := c.Cookie(cookieName); err == nil {
+				token = cookie.Value
+			}
+		}
+
+		cal := sessions.get(token)
+		if cal == nil || !cal.isValid() {
+			log.Error().
+				Str("src_ip", c.RealIP()).
+				Str("method", c.Request().Method).
+				Str("path", c.Path()).
+				Dur("duration", time.Since(start)).
+				Int("status", http.StatusTemporaryRedirect).
+				Msg("Unknown token")
+
+			return c.Redirect(http.StatusTemporaryRedirect, "/")
+		}
+
+		mailbox, err := parseMailbox(c.QueryParam("mailbox"))
+		if err != nil {
+			log.Error().
+				Err(err).
+				Str("src_ip", c.RealIP()).
+				Str("method", c.Request().Method).
+				Str("path", c.Path()).
+				Dur("duration", time.Since(start)).
+				Int("status", http.StatusBadRequest).
+				Send()
+
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+
+		if cal.appMailbox != "" && mailbox != "" {
+			log.Error().
+				Str("src_ip", c.RealIP()).
+				Str("method", c.Request().Method).
+				Str("path", c.Path()).
+				Dur("duration", time.Since(start)).
+				Int("status", http.StatusForbidden).
+				Msg("Shared calendars requested on a provisioned feed")
+
+			return c.String(http.StatusForbidden, "Shared calendars are not available on provisioned feeds")
+		}
+
+		calendars, err := cal.getCalendars(mailbox)
+		if isAccessLost(err) {
+			status, message := accessLostResponse(err)
+
+			log.Error().
+				Err(err).
+				Str("src_ip", c.RealIP()).
+				Str("method", c.Request().Method).
+				Str("path", c.Path()).
+				Dur("duration", time.Since(start)).
+				Int("status", status).
+				Send()
+
+			return c.String(status, message)
+		} else if err != nil {
+			log.Error().
+				Err(err).
+				Str("src_ip", c.RealIP()).
+				Str("method", c.Request().Method).
+				Str("path", c.Path()).
+				Dur("duration", time.Since(start)).
+				Int("status", http.StatusInternalServerError).
+				Send()
+
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+
+		log.Info().
+			Str("src_ip", c.RealIP()).
+			Str("method", c.Request().Method).
+			Str("path", c.Path()).
+			Int("status", http.StatusOK).
+			Dur("duration", time.Since(start)).
+			Send()
+
+		var output strings.Builder
+		var ids []string
+
+		feed := "https://" + c.Request().Host + "/calendar?token=" + token
+		if mailbox != "" {
+			feed += "&mailbox=" + url.QueryEscape(mailbox)
+		}
+
+		for _, v := range calendars {
+			if v.IsDefaultCalendar {
+				ids = append(ids, defaultCalendar)
+				output.WriteString(v.Name + " (default):\n" + feed + "\n\n")
+				continue
+			}
+
+			ids = append(ids, url.QueryEscape(v.ID))
+			output.WriteString(v.Name + ":\n" + feed + "&calendars=" + url.QueryEscape(v.ID) + "\n\n")
+		}
+
+		if len(ids) > 1 {
+			output.WriteString("All of them, in a single feed:\n" + feed + "&calendars=" + strings.Join(ids, ","))
+		}
+
+		return c.String(http.StatusOK, strings.TrimSpace(output.String()))
+	})
+
+	e.POST("/notifications", handleNotifications)
+
+	// Named feeds are managed with the token of the user's own feed, or their
+	// session cookie
+	e.GET("/feeds", func(c echo.Context) error {
+		start := time.Now()
+
+		token := c.QueryParam("token")
+		if len(token) == 0 {
+			if cookie, err := c.Cookie(cookieName); err == nil {
+				token = cookie.Value
+			}
+		}
+
+		cal := sessions.get(token)
+		if cal == nil || !cal.isValid() {
+			log.Error().
+				Str("src_ip", c.RealIP()).
+				Str("method", c.Request().Method).
+				Str("path", c.Path()).
+				Dur("duration", time.Since(start)).
+				Int("status", http.StatusTemporaryRedirect).
+				Msg("Unknown token")
+
+			return c.Redirect(http.StatusTemporaryRedirect, "/")
+		}
+
+		var output strings.Builder
+
+		feeds := userFeedTokens(cal.userName)
+		if len(feeds) == 0 {
+			output.WriteString("No named feeds yet\n\n")
+		}
+
+		for _, feed := range feeds {
+			options := feed.options
+			if options == "" {
+				options = "default options"
+			}
+
+			lastUsed := "never used"
+			if !feed.lastUsed.IsZero() {
+				lastUsed = "last used " + feed.lastUsed.Format(time.RFC3339)
+			}
+
+			output.WriteString(feed.name + " (" + options + ", " + lastUsed + "):\n")
+			output.WriteString("https://" + c.Request().Host + "/calendar?token=" + feed.token + "\n\n")
+		}
+
+		output.WriteString(`Named feeds serve the options they were created with, whatever their URL says. To add one:
+curl -X POST -d token=` + token + ` -d name="Phone" -d titles=false -d past=7d https://` + c.Request().Host + `/feeds
+
+To revoke one:
+curl -X POST -d token=<its token> https://` + c.Request().Host + `/revoke`)
+
+		log.Info().
+			Str("user", cal.userName).
+			Str("src_ip", c.RealIP()).
+			Str("method", c.Request().Method).
+			Str("path", c.Path()).
+			Int("status", http.StatusOK).
+			Dur("duration", time.Since(start)).
+			Send()
+
+		return c.String(http.StatusOK, output.String())
+	})
+
+	e.POST("/feeds", func(c echo.Context) error {
+		start := time.Now()
+
+		params, err := c.FormParams()
+		if err != nil {
+			log.Error().
+				Err(err).
+				Str("src_ip", c.RealIP()).
+				Str("method", c.Request().Method).
+				Str("path", c.Path()).
+				Dur("duration", time.Since(start)).
+				Int("status", http.StatusBadRequest).
+				Send()
+
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+
+		token := params.Get("token")
+		if len(token) == 0 {
+			if cookie, err := c.Cookie(cookieName); err == nil {
+				token = cookie.Value
+			}
+		}
+
+		cal := sessions.get(token)
+		if cal == nil || !cal.isValid() {
+			log.Error().
+				Str("src_ip", c.RealIP()).
+				Str("method", c.Request().Method).
+				Str("path", c.Path()).
+				Dur("duration", time.Since(start)).
+				Int("status", http.StatusNotFound).
+				Msg("Unknown token")
+
+			return c.String(http.StatusNotFound, "Unknown feed")
+		}
+
+		// What's left are the options of the new feed
+		options := make(url.Values)
+		for key, values := range params {
+			if key != "token" && key != "name" {
+				options[key] = values
+			}
+		}
+
+		feed, err := newFeedToken(cal.userName, params.Get("name"), options)
+		if errors.Is(err, errInvalidFeed) {
+			log.Error().
+				Err(err).
+				Str("user", cal.userName).
+				Str("src_ip", c.RealIP()).
+				Str("method", c.Request().Method).
+				Str("path", c.Path()).
+				Dur("duration", time.Since(start)).
+				Int("status", http.StatusBadRequest).
+				Send()
+
+			return c.String(http.StatusBadRequest, err.Error())
+		} else if err != nil {
+			log.Error().
+				Err(err).
+				Str("user", cal.userName).
+				Str("src_ip", c.RealIP()).
+				Str("method", c.Request().Method).
+				Str("path", c.Path()).
+				Dur("duration", time.Since(start)).
+				Int("status", http.StatusInternalServerError).
+				Send()
+
+			return err
+		}
+
+		log.Info().
+			Str("user", cal.userName).
+			Str("feed", feed.name).
+			Str("src_ip", c.RealIP()).
+			Str("method", c.Request().Method).
+			Str("path", c.Path()).
+			Int("status", http.StatusCreated).
+			Dur("duration", time.Since(start)).
+			Msg("Named feed created")
+
+		return c.String(http.StatusCreated, feed.name+":\nhttps://"+c.Request().Host+"/calendar?token="+feed.token)
+	})
+
+	e.GET("/attachment/:attId/:fname", func(c echo.Context) error {
+		start := time.Now()
+
+		attId, _ := url.QueryUnescape(c.Param("attId"))
+		fname, _ := url.QueryUnescape(c.Param("fname"))
+
+		log.Info().
+			Str("src_ip", c.RealIP()).
+			Str("method", c.Request().Method).
+			Str("path", c.Path()).
+			Dur("duration", time.Since(start)).
+			Send()
+
+		return c.File(attId + "/" + fname)
+	})
+
+	return e
+}
+
+func web() {
+	e := newServer()
 	e.Logger.Fatal(e.Start(":5000"))
 }
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+const (
+	subscriptionLifetime = 3 * 24 * time.Hour
+	subscriptionRenewal  = 24 * time.Hour
+)
+
+// Notification is a Graph change notification, as posted to notification_url
+type Notification struct {
+	SubscriptionID string `json:"subscriptionId"`
+	ClientState    string `json:"clientState"`
+	ChangeType     string `json:"changeType"`
+	Resource       string `json:"resource"`
+}
+
+type notificationPayload struct {
+	Value []*Notification `json:"value"`
+}
+
+func newClientState() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+func (c *Calendar) getSubscription() *Subscription {
+	c.subMu.Lock()
+	defer c.subMu.Unlock()
+
+	return c.subscription
+}
+
+// ensureSubscription makes sure Graph notifies notification_url of the changes
+// on the events of the user, renewing the subscription a day before it expires
+func (c *Calendar) ensureSubscription() error {
+	notificationURL := viper.GetString("notification_url")
+	if notificationURL == "" {
+		return nil
+	}
+
+	c.subMu.Lock()
+	defer c.subMu.Unlock()
+
+	if c.subscription == nil {
+		sub, err := cachedData.getSubscription(c.userName)
+		if err != nil {
+			return err
+		}
+
+		c.subscription = sub
+	}
+
+	if c.subscription != nil && time.Until(c.subscription.expiration) > subscriptionRenewal {
+		return nil
+	}
+
+	expiration := time.Now().Add(subscriptionLifetime).UTC()
+
+	if c.subscription != nil && time.Now().Before(c.subscription.expiration) {
+		body, err := c.sendRemoteData(http.MethodPatch, "/subscriptions/"+c.subscription.id, map[string]interface{}{
+			"expirationDateTime": expiration.Format(time.RFC3339),
+		})
+		if err == nil {
+			err = decodeGraphResponse(body, &GraphSubscription{})
+		}
+
+		if err == nil {
+			renewed := *c.subscription
+			renewed.expiration = expiration
+			c.subscription = &renewed
+
+			return cachedData.saveSubscription(c.userName, c.subscription)
+		}
+
+		log.Warn().
+			Err(err).
+			Str("user", c.userName).
+			Str("method", "ensureSubscription").
+			Msg("Unable to renew subscription, creating a new one")
+	}
+
+	clientState, err := newClientState()
+	if err != nil {
+		return err
+	}
+
+	body, err := c.sendRemoteData(http.MethodPost, "/subscriptions", map[string]interface{}{
+		"changeType":         "created,updated,deleted",
+		"notificationUrl":    notificationURL,
+		"resource":           strings.TrimPrefix(c.mailboxPath(""), "/") + "/events",
+		"expirationDateTime": expiration.Format(time.RFC3339),
+		"clientState":        clientState,
+	})
+	if err != nil {
+		return err
+	}
+
+	var created GraphSubscription
+
+	if err := decodeGraphResponse(body, &created); err != nil {
+		return err
+	}
+
+	sub := &Subscription{
+		id:          created.ID,
+		clientState: clientState,
+		expiration:  expiration,
+	}
+
+	if sub.id == "" {
+		return errors.New("subscription created without an id")
+	}
+
+	if t, err := time.Parse(time.RFC3339Nano, created.ExpirationDateTime); err == nil {
+		sub.expiration = t.UTC()
+	}
+
+	c.subscription = sub
+
+	log.Info().
+		Str("user", c.userName).
+		Str("subscription", sub.id).
+		Str("method", "ensureSubscription").
+		Msg("Subscribed to event changes")
+
+	return cachedData.saveSubscription(c.userName, sub)
+}
+
+// unsubscribe deletes the change notification subscription of the user, if
+// any, so Graph stops notifying notification_url about them
+func (c *Calendar) unsubscribe() error {
+	c.subMu.Lock()
+	defer c.subMu.Unlock()
+
+	sub := c.subscription
+	if sub == nil {
+		stored, err := cachedData.getSubscription(c.userName)
+		if err != nil {
+			return err
+		}
+
+		sub = stored
+	}
+
+	c.subscription = nil
+
+	if sub == nil || time.Now().After(sub.expiration) {
+		return nil
+	}
+
+	_, err := c.sendRemoteData(http.MethodDelete, "/subscriptions/"+sub.id, nil)
+	if isAccessLost(err) {
+		// Already gone on the Graph side
+		return nil
+	}
+
+	return err
+}
+
+// queueSync syncs the calendars of the user in the background, folding the
+// notifications received while a sync is already waiting into it
+func (c *Calendar) queueSync() {
+	if !atomic.CompareAndSwapInt32(&c.syncQueued, 0, 1) {
+		return
+	}
+
+	go func() {
+		c.syncMu.Lock()
+		defer c.syncMu.Unlock()
+
+		atomic.StoreInt32(&c.syncQueued, 0)
+
+		calendars, err := c.syncedCalendars()
+		if err != nil {
+			log.Error().
+				Err(err).
+				Str("user", c.userName).
+				Str("method", "queueSync").
+				Send()
+
+			return
+		}
+
+		for _, calendar := range calendars {
+			if err := c.syncEventsLocked(calendar); err != nil {
+				log.Error().
+					Err(err).
+					Str("user", c.userName).
+					Str("calendar", calendar).
+					Str("method", "queueSync").
+					Send()
+			}
+		}
+
+		// Feeds show the changes right away, as with no notifications at all
+		renderedFeeds.forget(c.userName)
+	}()
+}
+
+// findSubscriber returns the user the notification is meant for, provided
+// it carries the client state given to Graph when subscribing
+func findSubscriber(n *Notification) *Calendar {
+	for _, cal := range sessions.loggedIn() {
+		sub := cal.getSubscription()
+		if sub == nil || sub.id != n.SubscriptionID {
+			continue
+		}
+
+		if subtle.ConstantTimeCompare([]byte(sub.clientState), []byte(n.ClientState)) != 1 {
+			return nil
+		}
+
+		return cal
+	}
+
+	return nil
+}
+
+func handleNotifications(c echo.Context) error {
+	start := time.Now()
+
+	// Graph checks the endpoint when subscribing, expecting the token back
+	if token := c.QueryParam("validationToken"); token != "" {
+		log.Info().
+			Str("src_ip", c.RealIP()).
+			Str("method", c.Request().Method).
+			Str("path", c.Path()).
+			Int("status", http.StatusOK).
+			Dur("duration", time.Since(start)).
+			Msg("Notification endpoint validated")
+
+		return c.String(http.StatusOK, token)
+	}
+
+	var payload notificationPayload
+
+	if err := json.NewDecoder(c.Request().Body).Decode(&payload); err != nil {
+		log.Error().
+			Err(err).
+			Str("src_ip", c.RealIP()).
+			Str("method", c.Request().Method).
+			Str("path", c.Path()).
+			Dur("duration", time.Since(start)).
+			Int("status", http.StatusBadRequest).
+			Send()
+
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	for _, n := range payload.Value {
+		cal := findSubscriber(n)
+		if cal == nil {
+			log.Warn().
+				Str("src_ip", c.RealIP()).
+				Str("subscription", n.SubscriptionID).
+				Str("method", "handleNotifications").
+				Msg("Ignoring notification for unknown subscription")
+
+			continue
+		}
+
+		cal.queueSync()
+	}
+
+	log.Info().
+		Str("src_ip", c.RealIP()).
+		Str("method", c.Request().Method).
+		Str("path", c.Path()).
+		Int("status", http.StatusAccepted).
+		Dur("duration", time.Since(start)).
+		Int("notifications", len(payload.Value)).
+		Send()
+
+	return c.NoContent(http.StatusAccepted)
+}
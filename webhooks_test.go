@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/oauth2"
+)
+
+// fakeNotificationSender posts to the notification endpoint the way Graph does
+type fakeNotificationSender struct {
+	url    string
+	client *http.Client
+}
+
+func newFakeNotificationSender(t *testing.T) *fakeNotificationSender {
+	e := echo.New()
+	e.POST("/notifications", handleNotifications)
+
+	server := httptest.NewServer(e)
+	t.Cleanup(server.Close)
+
+	return &fakeNotificationSender{
+		url:    server.URL + "/notifications",
+		client: server.Client(),
+	}
+}
+
+// validate runs the handshake Graph does when subscribing, returning the
+// token echoed back by the endpoint
+func (s *fakeNotificationSender) validate(token string) (string, error) {
+	resp, err := s.client.Post(s.url+"?validationToken="+url.QueryEscape(token), "text/plain", nil)
+	if err != nil {
+		return "", err
+	}
+
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+
+	return string(body), err
+}
+
+func (s *fakeNotificationSender) notify(notifications ...*Notification) (int, error) {
+	data, err := json.Marshal(notificationPayload{Value: notifications})
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+
+	resp.Body.Close()
+
+	return resp.StatusCode, nil
+}
+
+// newSubscribedCalendar returns a logged user subscribed to notifications,
+// whose calendar on the fake Graph holds a single event
+func newSubscribedCalendar(t *testing.T) (*fakeGraph, *Calendar) {
+	graph := newTestEnv(t)
+
+	now := time.Now().UTC()
+	graph.putEvent(newTestEvent("event", "Moved", now, time.Hour))
+
+	cal := newCalendarHandlerFromToken("jane.doe", &oauth2.Token{
+		AccessToken: "fake-access-0",
+		TokenType:   "Bearer",
+		Expiry:      now.Add(time.Hour),
+	}, false)
+	cal.subscription = &Subscription{id: "sub", clientState: "state", expiration: now.Add(subscriptionLifetime)}
+
+	sessions.register("jane.doe", "token", cal)
+
+	return graph, cal
+}
+
+func TestNotificationValidation(t *testing.T) {
+	sender := newFakeNotificationSender(t)
+
+	got, err := sender.validate("Validation: Token+/=")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got != "Validation: Token+/=" {
+		t.Errorf("validation token echoed as %q", got)
+	}
+}
+
+func TestNotificationSyncsUser(t *testing.T) {
+	sender := newFakeNotificationSender(t)
+	_, cal := newSubscribedCalendar(t)
+
+	status, err := sender.notify(&Notification{SubscriptionID: "sub", ClientState: "state", ChangeType: "updated", Resource: "Users/1/Events/event"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status != http.StatusAccepted {
+		t.Fatalf("notification answered with %d", status)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if state, _ := cachedData.getDeltaState(cal.userName, ""); state != nil {
+			events, err := cachedData.getEvents(cal.userName, "", state.start, state.end)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(events) != 1 {
+				t.Fatalf("synced %d events, expected 1", len(events))
+			}
+
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatal("notification did not sync the user")
+}
+
+func TestNotificationWrongClientState(t *testing.T) {
+	sender := newFakeNotificationSender(t)
+	graph, _ := newSubscribedCalendar(t)
+
+	status, err := sender.notify(
+		&Notification{SubscriptionID: "sub", ClientState: "forged", ChangeType: "updated"},
+		&Notification{SubscriptionID: "unknown", ClientState: "state", ChangeType: "updated"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status != http.StatusAccepted {
+		t.Fatalf("notification answered with %d", status)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	if n := graph.countRequests("/"); n != 0 {
+		t.Errorf("%d requests made to Graph for rejected notifications", n)
+	}
+}